@@ -0,0 +1,10 @@
+package admin
+
+type Config struct {
+	Keys []Key `json:"keys"`
+}
+
+type Key struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"auth/common"
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	keyNameKey   = "admin_key_name"
+)
+
+// Handler guards admin endpoints with static api keys from the config.
+type Handler struct {
+	keys []Key
+}
+
+func New(config *Config) *Handler {
+	h := &Handler{}
+	if config != nil {
+		h.keys = config.Keys
+	}
+	return h
+}
+
+func (h *Handler) MiddlewareFunc() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		h.VerifyKey(ctx)
+	}
+}
+
+func (h *Handler) VerifyKey(ctx *gin.Context) {
+	value := ctx.GetHeader(apiKeyHeader)
+	if value == "" {
+		common.ErrorResponse(ctx, http.StatusUnauthorized, "api key is missing", nil)
+		ctx.Abort()
+		return
+	}
+	for _, key := range h.keys {
+		if key.Key != "" && subtle.ConstantTimeCompare([]byte(key.Key), []byte(value)) == 1 {
+			ctx.Set(keyNameKey, key.Name)
+			ctx.Next()
+			return
+		}
+	}
+	common.ErrorResponse(ctx, http.StatusUnauthorized, "invalid api key", nil)
+	ctx.Abort()
+}
+
+// KeyName returns the name of the api key that authorized the request.
+func KeyName(ctx *gin.Context) string {
+	return ctx.GetString(keyNameKey)
+}
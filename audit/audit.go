@@ -0,0 +1,171 @@
+package audit
+
+import (
+	"auth/database"
+	"auth/logger"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type Storage interface {
+	AddAuditEvent(ctx context.Context, e database.AuditEvent) error
+	GetAuditEvents(ctx context.Context, f database.AuditFilter) ([]database.AuditEvent, error)
+}
+
+type EventType string
+
+const (
+	EventSignup             EventType = "signup"
+	EventVerify             EventType = "verify"
+	EventVerifyResend       EventType = "verify_resend"
+	EventLoginSuccess       EventType = "login_success"
+	EventLoginFailure       EventType = "login_failure"
+	EventLogout             EventType = "logout"
+	EventPasswordRecover    EventType = "password_recover"
+	EventPasswordReset      EventType = "password_reset"
+	EventPasswordChange     EventType = "password_change"
+	EventEmailChange        EventType = "email_change"
+	EventEmailChangeConfirm EventType = "email_change_confirm"
+	EventEmailChangeCancel  EventType = "email_change_cancel"
+	EventAccountDeletion    EventType = "account_deletion"
+	EventSessionRevoke      EventType = "session_revoke"
+	EventTokenReuse         EventType = "token_reuse"
+	EventLoginReport        EventType = "login_report"
+	EventAdminUnlock        EventType = "admin_unlock"
+	EventAdminAppMetadata   EventType = "admin_app_metadata"
+)
+
+// limits of the AuditEvent columns, longer values are cut.
+const (
+	maxUserAgentLength = 512
+	maxDetailLength    = 255
+)
+
+// Event is an audit event as written to the json lines file and returned by
+// queries.
+type Event struct {
+	Id        int64     `json:"id,omitempty"`
+	Type      EventType `json:"type"`
+	Actor     string    `json:"actor,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Logger records audit events. events are stored in the database, and
+// appended to a json lines file if one is configured.
+type Logger struct {
+	db   Storage
+	mu   sync.Mutex
+	file io.WriteCloser
+	enc  *json.Encoder
+	now  func() time.Time
+}
+
+func New(config *Config, db Storage) (*Logger, error) {
+	l := &Logger{
+		db:  db,
+		now: time.Now,
+	}
+	if config != nil && config.File != "" {
+		f, err := os.OpenFile(config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+		l.enc = json.NewEncoder(f)
+	}
+	return l, nil
+}
+
+// Record stores an event caused by the request of c. failures are logged,
+// they never fail the request.
+func (l *Logger) Record(c *gin.Context, t EventType, actor string, target string, detail string) {
+	e := Event{
+		Type:      t,
+		Actor:     actor,
+		Target:    target,
+		IP:        c.ClientIP(),
+		UserAgent: truncate(c.Request.UserAgent(), maxUserAgentLength),
+		RequestId: logger.RequestId(c),
+		Detail:    truncate(detail, maxDetailLength),
+		At:        l.now().UTC().Truncate(time.Second),
+	}
+	// the event is kept even if the client went away
+	ctx := context.WithoutCancel(c.Request.Context())
+	err := l.db.AddAuditEvent(ctx, database.AuditEvent{
+		Type:      string(e.Type),
+		Actor:     e.Actor,
+		Target:    e.Target,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		RequestId: e.RequestId,
+		Detail:    e.Detail,
+		At:        e.At,
+	})
+	if err != nil {
+		zap.L().Error("cannot store audit event", zap.String("type", string(t)), zap.Error(err))
+	}
+	if l.enc == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		zap.L().Error("cannot write audit event", zap.String("type", string(t)), zap.Error(err))
+	}
+}
+
+// Query returns the stored events matching f, newest first.
+func (l *Logger) Query(ctx context.Context, f database.AuditFilter) ([]Event, error) {
+	stored, err := l.db.GetAuditEvents(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(stored))
+	for _, e := range stored {
+		events = append(events, Event{
+			Id:        e.Id,
+			Type:      EventType(e.Type),
+			Actor:     e.Actor,
+			Target:    e.Target,
+			IP:        e.IP,
+			UserAgent: e.UserAgent,
+			RequestId: e.RequestId,
+			Detail:    e.Detail,
+			At:        e.At.UTC(),
+		})
+	}
+	return events, nil
+}
+
+// Close closes the json lines file, if any.
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
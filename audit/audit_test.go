@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"auth/database"
+	"auth/logger"
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestLogger(t *testing.T) {
+	RegisterTestingT(t)
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	db := database.NewMemory()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := New(&Config{File: path}, db)
+	Expect(err).To(BeNil())
+
+	router := gin.New()
+	router.Use(logger.MiddlewareFunc(zap.NewNop()))
+	router.POST("/login", func(c *gin.Context) {
+		l.Record(c, EventLoginFailure, "", "user1@example.com", "password_mismatch")
+		l.Record(c, EventLoginSuccess, "id1", "id1", "")
+		c.Status(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.Header.Set("User-Agent", "test agent")
+	req.Header.Set(logger.RequestIdHeader, "request-1")
+	req.RemoteAddr = "1.1.1.1:1234"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	Expect(l.Close()).To(Succeed())
+
+	events, err := l.Query(ctx, database.AuditFilter{Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(events).To(HaveLen(2))
+	Expect(events[0].Type).To(Equal(EventLoginSuccess))
+	Expect(events[1]).To(And(
+		HaveField("Type", EventLoginFailure),
+		HaveField("Target", "user1@example.com"),
+		HaveField("IP", "1.1.1.1"),
+		HaveField("UserAgent", "test agent"),
+		HaveField("RequestId", "request-1"),
+		HaveField("Detail", "password_mismatch"),
+	))
+
+	f, err := os.Open(path)
+	Expect(err).To(BeNil())
+	defer f.Close()
+	var lines []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		Expect(json.Unmarshal(scanner.Bytes(), &e)).To(Succeed())
+		lines = append(lines, e)
+	}
+	Expect(lines).To(HaveLen(2))
+	Expect(lines[0].Type).To(Equal(EventLoginFailure))
+	Expect(lines[0].RequestId).To(Equal("request-1"))
+}
+
+func TestLoggerWithoutFile(t *testing.T) {
+	RegisterTestingT(t)
+	l, err := New(nil, database.NewMemory())
+	Expect(err).To(BeNil())
+	Expect(l.Close()).To(Succeed())
+
+	_, err = New(&Config{File: filepath.Join(t.TempDir(), "missing", "audit.log")}, database.NewMemory())
+	Expect(err).NotTo(BeNil())
+}
+
+func TestTruncate(t *testing.T) {
+	RegisterTestingT(t)
+	Expect(truncate("abc", 3)).To(Equal("abc"))
+	Expect(truncate("abcd", 3)).To(Equal("abc"))
+	// a multi-byte rune crossing the limit is dropped as a whole
+	Expect(truncate("ab€", 4)).To(Equal("ab"))
+	Expect(truncate("ab€", 5)).To(Equal("ab€"))
+	long := strings.Repeat("ä", maxUserAgentLength)
+	cut := truncate(long, maxUserAgentLength-1)
+	Expect(utf8.ValidString(cut)).To(BeTrue())
+	Expect(cut).To(Equal(strings.Repeat("ä", maxUserAgentLength/2-1)))
+}
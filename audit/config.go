@@ -0,0 +1,7 @@
+package audit
+
+// Config controls where audit events are written besides the database. File
+// is a path events are appended to as json lines, empty disables it.
+type Config struct {
+	File string `json:"file"`
+}
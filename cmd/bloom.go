@@ -0,0 +1,68 @@
+package main
+
+import (
+	"auth/password"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// buildBloom implements the bloom command, which turns a breached password
+// corpus into a filter for offline password screening.
+func buildBloom(args []string) error {
+	flags := flag.NewFlagSet("bloom", flag.ExitOnError)
+	inPtr := flags.String("in", "", "breach corpus, one SHA1[:COUNT] or plain password per line")
+	outPtr := flags.String("out", "breached.bloom", "path to write the bloom filter to")
+	fpPtr := flags.Float64("fp", 0.001, "false positive rate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *inPtr == "" {
+		return fmt.Errorf("missing -in")
+	}
+	if *fpPtr <= 0 || *fpPtr >= 1 {
+		return fmt.Errorf("-fp must be between 0 and 1")
+	}
+
+	in, err := os.Open(*inPtr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	// first pass sizes the filter, second pass fills it
+	var n uint64
+	if err := scanCorpus(in, func(_ [20]byte) { n++ }); err != nil {
+		return err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	filter := password.NewBloomFilter(n, *fpPtr)
+	if err := scanCorpus(in, filter.AddHash); err != nil {
+		return err
+	}
+
+	out, err := os.Create(*outPtr)
+	if err != nil {
+		return err
+	}
+	if _, err := filter.WriteTo(out); err != nil {
+		_ = out.Close()
+		return err
+	}
+	fmt.Printf("added %d entries to %s\n", n, *outPtr)
+	return out.Close()
+}
+
+func scanCorpus(r io.Reader, fn func(digest [20]byte)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if digest, ok := password.ParseCorpusLine(scanner.Text()); ok {
+			fn(digest)
+		}
+	}
+	return scanner.Err()
+}
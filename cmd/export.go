@@ -0,0 +1,58 @@
+package main
+
+import (
+	"auth/database"
+	"auth/export"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ilyakaznacheev/cleanenv"
+	"io"
+	"os"
+)
+
+// exportUser implements the export command, which writes the data export of
+// a user for answering data access requests.
+func exportUser(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPtr := flags.String("c", "config.json", "path to config file")
+	emailPtr := flags.String("email", "", "email of the user to export")
+	outPtr := flags.String("out", "", "path to write the export to, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *emailPtr == "" {
+		return fmt.Errorf("missing -email")
+	}
+
+	var config Config
+	if err := cleanenv.ReadConfig(*configPtr, &config); err != nil {
+		return err
+	}
+	db, err := database.Connect(&config.Database)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	user, err := db.GetUser(ctx, *emailPtr)
+	if err != nil {
+		return fmt.Errorf("cannot find user %s: %w", *emailPtr, err)
+	}
+	archive, err := export.New(db).Export(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPtr != "" {
+		f, err := os.Create(*outPtr)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+	return export.Write(out, archive)
+}
@@ -10,10 +10,28 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/ilyakaznacheev/cleanenv"
 	"go.uber.org/zap"
+	"os"
+	// profile timezones are validated against the tz database, which the
+	// runtime image does not ship
+	_ "time/tzdata"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bloom" {
+		if err := buildBloom(os.Args[2:]); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := exportUser(os.Args[2:]); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	configPtr := flag.String("c", "config.json", "path to config file")
+	devPtr := flag.Bool("dev", false, "use in-memory storage instead of database")
 	flag.Parse()
 	configFile := *configPtr
 	var config Config
@@ -29,9 +47,15 @@ func main() {
 
 	zap.ReplaceGlobals(eventLogger)
 
-	db, err := database.Connect(&config.Database)
-	if err != nil {
-		panic(err)
+	var db server.Storage
+	if *devPtr {
+		zap.L().Warn("running in dev mode, all data is kept in memory")
+		db = database.NewMemory()
+	} else {
+		db, err = database.Connect(&config.Database)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	m, err := mailer.NewSMTP(&config.Mailer)
@@ -2,6 +2,7 @@ package common
 
 import (
 	"auth/database"
+	"auth/password"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"net/http"
@@ -25,6 +26,10 @@ func StatusFromError(c *gin.Context, err error) (*gin.Context, int, string, erro
 		return c, http.StatusNotFound, "entry not found", err
 	case database.ErrUnauthorized:
 		return c, http.StatusForbidden, "authorization failed", err
+	case database.ErrTimeout:
+		return c, http.StatusServiceUnavailable, "service unavailable", err
+	case password.ErrBusy:
+		return c, http.StatusServiceUnavailable, "server is busy, try again later", err
 	default:
 		return c, http.StatusInternalServerError, "internal error", err
 	}
@@ -48,6 +53,21 @@ func ErrorResponse(c *gin.Context, code int, message string, err error) {
 	})
 }
 
+// ErrorResponseWithData is ErrorResponse with details the client can act on,
+// e.g. the list of failed validation rules.
+func ErrorResponseWithData(c *gin.Context, code int, message string, err error, data interface{}) {
+	if IsClientError(code) {
+		zap.L().Warn(message, zap.Int("status", code), zap.Error(err))
+	} else if IsServerError(code) {
+		zap.L().Error(message, zap.Int("status", code), zap.Error(err))
+	}
+	c.JSON(code, Response{
+		Code:    code,
+		Message: message,
+		Data:    data,
+	})
+}
+
 func SuccessResponse(c *gin.Context, code int, message string, data interface{}) {
 	c.JSON(code, Response{
 		Code:    code,
@@ -2,4 +2,24 @@ package database
 
 type Config struct {
 	ConnectionString string `env:"DB_CONNECTION_STRING" json:"connection_string"`
+	QueryTimeout     int    `env:"DB_QUERY_TIMEOUT" env-default:"5" json:"query_timeout"`
+	MaxOpenConns     int    `env:"DB_MAX_OPEN_CONNS" env-default:"25" json:"max_open_conns"`
+	MaxIdleConns     int    `env:"DB_MAX_IDLE_CONNS" env-default:"25" json:"max_idle_conns"`
+	ConnMaxLifetime  int    `env:"DB_CONN_MAX_LIFETIME" env-default:"300" json:"conn_max_lifetime"`
+	ConnMaxIdleTime  int    `env:"DB_CONN_MAX_IDLE_TIME" env-default:"60" json:"conn_max_idle_time"`
+	ConnectRetries   int    `env:"DB_CONNECT_RETRIES" env-default:"10" json:"connect_retries"`
+	ConnectBackoff   int    `env:"DB_CONNECT_BACKOFF" env-default:"1" json:"connect_backoff"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ConnectionString: "admin:admin@tcp(127.0.0.1:3306)/auth",
+		QueryTimeout:     5,
+		MaxOpenConns:     25,
+		MaxIdleConns:     25,
+		ConnMaxLifetime:  300,
+		ConnMaxIdleTime:  60,
+		ConnectRetries:   10,
+		ConnectBackoff:   1,
+	}
 }
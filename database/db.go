@@ -1,37 +1,32 @@
 package database
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"errors"
-	_ "github.com/go-sql-driver/mysql"
-	"math/rand"
+	"github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+	"math/big"
 	"time"
 )
 
-func randomString(n int) string {
-	const (
-		letterBytes   = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-		letterIdxBits = 6                    // 6 bits to represent a letter index
-		letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-		letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
-	)
+// randomString creates a code of n letters for verification links. codes
+// grant control over accounts, so they come from crypto/rand.
+func randomString(n int) (string, error) {
+	const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-	src := rand.NewSource(time.Now().UnixNano())
+	letters := big.NewInt(int64(len(letterBytes)))
 	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, letters)
+		if err != nil {
+			return "", err
 		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
+		b[i] = letterBytes[idx.Int64()]
 	}
-
-	return string(b)
+	return string(b), nil
 }
 
 var (
@@ -39,32 +34,102 @@ var (
 	ErrNotFound       = errors.New("not found")
 	ErrInvalid        = errors.New("invalid operation")
 	ErrUnauthorized   = errors.New("authorization failed")
+	ErrTimeout        = errors.New("operation timed out")
 )
 
 type Database struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration
 }
 
+// maxConnectBackoff caps the exponential delay between startup pings.
+const maxConnectBackoff = 30 * time.Second
+
 func Connect(config *Config) (*Database, error) {
-	db, err := sql.Open("mysql", config.ConnectionString)
+	dsn, err := mysql.ParseDSN(config.ConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	// timestamps are stored in UTC and scanned into time.Time
+	dsn.ParseTime = true
+	dsn.Loc = time.UTC
+	// updates report matched rather than changed rows, so that writing
+	// unchanged values is not mistaken for a missing row
+	dsn.ClientFoundRows = true
+	db, err := sql.Open("mysql", dsn.FormatDSN())
 	if err != nil {
 		return nil, parseError(err)
 	}
-	return &Database{db}, nil
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(config.ConnMaxLifetime) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(config.ConnMaxIdleTime) * time.Second)
+	database := &Database{
+		db:           db,
+		queryTimeout: time.Duration(config.QueryTimeout) * time.Second,
+	}
+
+	backoff := time.Duration(config.ConnectBackoff) * time.Second
+	for attempt := 0; ; attempt++ {
+		err = database.Health(context.Background())
+		if err == nil {
+			return database, nil
+		}
+		if attempt >= config.ConnectRetries {
+			_ = db.Close()
+			return nil, err
+		}
+		zap.L().Warn("database is not ready, retrying",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxConnectBackoff)
+	}
+}
+
+// Health checks that the database is reachable within the query timeout.
+func (db *Database) Health(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return parseError(db.db.PingContext(ctx))
 }
 
 func (db *Database) Close() error {
 	return db.db.Close()
 }
 
-func (db *Database) Clear(removeUsers bool) error {
-	var err error
-	err = db.withTransaction(func(t *sql.Tx) error {
-		if err := deleteVerifications(t); err != nil {
+func (db *Database) Clear(ctx context.Context, removeUsers bool) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		if err := deleteVerifications(ctx, t); err != nil {
+			return err
+		}
+		if err := deleteLoginFailures(ctx, t); err != nil {
+			return err
+		}
+		if err := deleteSessions(ctx, t); err != nil {
+			return err
+		}
+		if err := deleteKnownDevices(ctx, t); err != nil {
+			return err
+		}
+		if err := deleteStatusChanges(ctx, t); err != nil {
+			return err
+		}
+		if err := deleteAuditEvents(ctx, t); err != nil {
+			return err
+		}
+		if err := deleteWebhookDeliveries(ctx, t); err != nil {
+			return err
+		}
+		if err := deleteOutboxMessages(ctx, t); err != nil {
 			return err
 		}
 		if removeUsers {
-			if err := deleteUsers(t); err != nil {
+			if err := deleteUsers(ctx, t); err != nil {
 				return err
 			}
 		}
@@ -73,41 +138,68 @@ func (db *Database) Clear(removeUsers bool) error {
 	return parseError(err)
 }
 
-func (db *Database) AddUser(u NewUser) (ObjectId, string, error) {
-	hash, err := HashPassword(u.Password)
+// AddUser stores a new user together with the outbox messages of the signup,
+// so that they are either both stored or not at all.
+func (db *Database) AddUser(ctx context.Context, u NewUser, outbox ...OutboxMessage) (ObjectId, string, error) {
+	userId := u.Id
+	if userId == EmptyObjectId {
+		userId = NewObjectId()
+	}
+	code, err := randomString(50)
 	if err != nil {
 		return EmptyObjectId, "", err
 	}
-	u.Password = hash
-	userId := NewObjectId()
-	code := randomString(50)
-	err = db.withTransaction(func(t *sql.Tx) error {
-		if err := addUser(t, userId, u); err != nil {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		now := storedTime(time.Now())
+		if err := addUser(ctx, t, userId, u, now); err != nil {
+			return err
+		}
+		if err := addStatusChange(ctx, t, userId, u.Status, now); err != nil {
 			return err
 		}
 		if u.Status == UserStatusPending {
-			err := setVerification(t, userId, Verification{Code: code, Type: VerificationTypeSignup})
+			err := setVerification(ctx, t, userId, Verification{Code: code, Type: VerificationTypeSignup, Value: u.RedirectURI})
 			if err != nil {
 				return err
 			}
 		}
-		return nil
+		return addOutboxMessages(ctx, t, outbox)
 	})
 	return userId, code, parseError(err)
 }
 
-func (db *Database) Verify(code string) error {
-	err := db.applyVerifiedAction(code, VerificationTypeSignup, func(t *sql.Tx, userId ObjectId) error {
-		return setUserStatus(t, userId, UserStatusActive)
+func (db *Database) Verify(ctx context.Context, code string, outbox ...OutboxMessage) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.applyVerifiedAction(ctx, code, VerificationTypeSignup, func(ctx context.Context, t *sql.Tx, userId ObjectId) error {
+		if err := setUserStatus(ctx, t, userId, UserStatusActive); err != nil {
+			return err
+		}
+		if err := addStatusChange(ctx, t, userId, UserStatusActive, storedTime(time.Now())); err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
 	})
 	return parseError(err)
 }
 
-func (db *Database) SetRecoveryCode(userId ObjectId) (string, error) {
-	code := randomString(50)
-	err := db.withTransaction(func(t *sql.Tx) error {
-		err := setVerification(t, userId, Verification{Type: VerificationTypeRecover, Code: code})
-		return err
+// SetRecoveryCode replaces the recovery code of a user and stores the outbox
+// messages that hand it out.
+func (db *Database) SetRecoveryCode(ctx context.Context, userId ObjectId, outbox ...OutboxMessage) (string, error) {
+	code, err := randomString(50)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		err := setVerification(ctx, t, userId, Verification{Type: VerificationTypeRecover, Code: code})
+		if err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
 	})
 	if err != nil {
 		return "", parseError(err)
@@ -115,30 +207,539 @@ func (db *Database) SetRecoveryCode(userId ObjectId) (string, error) {
 	return code, nil
 }
 
-func (db *Database) ResetPassword(code string, newPassword string) error {
-	hash, err := HashPassword(newPassword)
+// SetSignupCode replaces the signup code and redirect uri of a pending user
+// and stores the outbox messages that hand it out. users that are not
+// pending fail with ErrInvalid.
+func (db *Database) SetSignupCode(ctx context.Context, userId ObjectId, redirectURI string, outbox ...OutboxMessage) (string, error) {
+	code, err := randomString(50)
 	if err != nil {
-		return err
+		return "", err
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		status, err := lockUserStatus(ctx, t, userId)
+		if err != nil {
+			return err
+		}
+		if status != UserStatusPending {
+			return ErrInvalid
+		}
+		err = setVerification(ctx, t, userId, Verification{Type: VerificationTypeSignup, Code: code, Value: redirectURI})
+		if err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
+	})
+	if err != nil {
+		return "", parseError(err)
+	}
+	return code, nil
+}
+
+// ResetPassword replaces the password hash of the owner of a recovery code.
+func (db *Database) ResetPassword(ctx context.Context, code string, newPasswordHash string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.applyVerifiedAction(ctx, code, VerificationTypeRecover, func(ctx context.Context, t *sql.Tx, userId ObjectId) error {
+		return setUserPassword(ctx, t, userId, newPasswordHash)
+	})
+	return parseError(err)
+}
+
+// SetEmailChange starts changing the email of a user to newEmail. it returns
+// a code that confirms the change, to be sent to the new address, and one
+// that cancels it, to be sent to the current address, and stores the outbox
+// messages that send them. a new request replaces a pending one.
+func (db *Database) SetEmailChange(ctx context.Context, userId ObjectId, newEmail string, outbox ...OutboxMessage) (string, string, error) {
+	confirmCode, err := randomString(50)
+	if err != nil {
+		return "", "", err
+	}
+	cancelCode, err := randomString(50)
+	if err != nil {
+		return "", "", err
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		err := setVerification(ctx, t, userId, Verification{Type: VerificationTypeChangeEmail, Code: confirmCode, Value: newEmail})
+		if err != nil {
+			return err
+		}
+		err = setVerification(ctx, t, userId, Verification{Type: VerificationTypeCancelEmail, Code: cancelCode})
+		if err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
+	})
+	if err != nil {
+		return "", "", parseError(err)
 	}
-	err = db.applyVerifiedAction(code, VerificationTypeRecover, func(t *sql.Tx, userId ObjectId) error {
-		return setUserPassword(t, userId, hash)
+	return confirmCode, cancelCode, nil
+}
+
+// ConfirmEmailChange replaces the email of the owner of a change_email code.
+// it fails with ErrDuplicateEntry if the address was taken in the meantime.
+// tokens issued before carry the old address, they are revoked along with
+// all sessions.
+func (db *Database) ConfirmEmailChange(ctx context.Context, code string, outbox ...OutboxMessage) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.applyVerifiedAction(ctx, code, VerificationTypeChangeEmail, func(ctx context.Context, t *sql.Tx, userId ObjectId) error {
+		if err := setEmailFromVerification(ctx, t, code); err != nil {
+			return err
+		}
+		if err := deleteUserSessions(ctx, t, userId, EmptyObjectId); err != nil {
+			return err
+		}
+		if err := deleteVerification(ctx, t, userId, VerificationTypeCancelEmail); err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
+	})
+	return parseError(err)
+}
+
+// CancelEmailChange drops the pending email change of the owner of a
+// cancel_email code.
+func (db *Database) CancelEmailChange(ctx context.Context, code string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.applyVerifiedAction(ctx, code, VerificationTypeCancelEmail, func(ctx context.Context, t *sql.Tx, userId ObjectId) error {
+		return deleteVerification(ctx, t, userId, VerificationTypeChangeEmail)
+	})
+	return parseError(err)
+}
+
+func (db *Database) SetPassword(ctx context.Context, userId ObjectId, passwordHash string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		return setUserPassword(ctx, t, userId, passwordHash)
+	})
+	return parseError(err)
+}
+
+// ChangePassword replaces the password hash of a user and bumps the user's
+// token version, which invalidates all tokens issued before.
+func (db *Database) ChangePassword(ctx context.Context, userId ObjectId, passwordHash string, outbox ...OutboxMessage) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		if err := changeUserPassword(ctx, t, userId, passwordHash); err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
 	})
 	return parseError(err)
 }
 
-func (db *Database) GetUser(name string) (User, error) {
-	u, err := db.getUser(name)
+func (db *Database) GetUser(ctx context.Context, name string) (User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	u, err := db.getUser(ctx, name)
+	return u, parseError(err)
+}
+
+func (db *Database) GetUserById(ctx context.Context, userId ObjectId) (User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	u, err := db.getUserById(ctx, userId)
+	return u, parseError(err)
+}
+
+// GetUserByCode returns the owner of a pending verification code.
+func (db *Database) GetUserByCode(ctx context.Context, code string, verificationType VerificationType) (User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	u, err := db.getUserByCode(ctx, code, verificationType)
 	return u, parseError(err)
 }
 
-func (db *Database) DeleteUser(name string) error {
-	return parseError(db.deleteUser(name))
+func (db *Database) DeleteUser(ctx context.Context, name string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return parseError(db.deleteUser(ctx, name))
 }
 
-func (db *Database) GetVerification(userId ObjectId, verificationType VerificationType) (string, error) {
-	code, err := db.getVerification(userId, verificationType)
+func (db *Database) GetVerification(ctx context.Context, userId ObjectId, verificationType VerificationType) (string, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	code, err := db.getVerification(ctx, userId, verificationType)
 	if err != nil {
 		return "", parseError(err)
 	}
 	return code, nil
 }
+
+// UpdateProfile replaces the profile and user metadata of a user.
+func (db *Database) UpdateProfile(ctx context.Context, userId ObjectId, p Profile, userMetadata json.RawMessage, at time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		return updateProfile(ctx, t, userId, p, userMetadata, storedTime(at))
+	})
+	return parseError(err)
+}
+
+// SetAppMetadata replaces the app metadata of a user.
+func (db *Database) SetAppMetadata(ctx context.Context, userId ObjectId, appMetadata json.RawMessage, at time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		return setAppMetadata(ctx, t, userId, appMetadata, storedTime(at))
+	})
+	return parseError(err)
+}
+
+func (db *Database) SetLastLogin(ctx context.Context, userId ObjectId, at time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return parseError(db.setLastLogin(ctx, userId, storedTime(at)))
+}
+
+// ScheduleDeletion moves an active user into the deleting status, to be
+// purged at the given time unless cancelled before. all tokens and sessions
+// of the user are revoked.
+func (db *Database) ScheduleDeletion(ctx context.Context, userId ObjectId, at time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		if err := scheduleDeletion(ctx, t, userId, storedTime(at)); err != nil {
+			return err
+		}
+		if err := addStatusChange(ctx, t, userId, UserStatusDeleting, storedTime(time.Now())); err != nil {
+			return err
+		}
+		return deleteUserSessions(ctx, t, userId, EmptyObjectId)
+	})
+	return parseError(err)
+}
+
+// CancelDeletion makes a user in the deleting status active again.
+func (db *Database) CancelDeletion(ctx context.Context, userId ObjectId) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		if err := cancelDeletion(ctx, t, userId); err != nil {
+			return err
+		}
+		return addStatusChange(ctx, t, userId, UserStatusActive, storedTime(time.Now()))
+	})
+	return parseError(err)
+}
+
+// GetDueDeletions returns up to limit users whose deletion is due before the
+// given time, oldest first.
+func (db *Database) GetDueDeletions(ctx context.Context, before time.Time, limit int) ([]User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	users, err := db.getDueDeletions(ctx, before.UTC(), limit)
+	return users, parseError(err)
+}
+
+// PurgeUser removes a user whose deletion is due before the given time, along
+// with everything referencing it. users that cancelled the deletion in the
+// meantime are not touched and give ErrNotFound. the outbox messages are
+// only stored if the user was purged.
+func (db *Database) PurgeUser(ctx context.Context, userId ObjectId, before time.Time, outbox ...OutboxMessage) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		if err := purgeUser(ctx, t, userId, before.UTC()); err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
+	})
+	return parseError(err)
+}
+
+// GetStatusHistory returns the status changes of a user, oldest first.
+func (db *Database) GetStatusHistory(ctx context.Context, userId ObjectId) ([]StatusChange, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	changes, err := db.getStatusHistory(ctx, userId)
+	return changes, parseError(err)
+}
+
+// GetVerifications returns all pending verifications of a user.
+func (db *Database) GetVerifications(ctx context.Context, userId ObjectId) ([]Verification, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	verifications, err := db.getVerifications(ctx, userId)
+	return verifications, parseError(err)
+}
+
+func (db *Database) AddAuditEvent(ctx context.Context, e AuditEvent) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	e.At = storedTime(e.At)
+	return parseError(db.addAuditEvent(ctx, e))
+}
+
+// GetAuditEvents returns up to f.Limit events matching f, newest first.
+func (db *Database) GetAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	events, err := db.getAuditEvents(ctx, f)
+	return events, parseError(err)
+}
+
+// AddWebhookDeliveries queues deliveries, all or none of them. deliveries of
+// an event that is already queued for the endpoint are skipped.
+func (db *Database) AddWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		for _, d := range deliveries {
+			d.NextAttempt = storedTime(d.NextAttempt)
+			d.CreatedAt = storedTime(d.CreatedAt)
+			d.UpdatedAt = storedTime(d.UpdatedAt)
+			if err := addWebhookDelivery(ctx, t, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return parseError(err)
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose next
+// attempt is not after before, the longest waiting first.
+func (db *Database) GetDueWebhookDeliveries(ctx context.Context, before time.Time, limit int) ([]WebhookDelivery, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	deliveries, err := db.queryWebhookDeliveries(ctx, "WHERE Status = ? AND NextAttempt <= ? ORDER BY NextAttempt, Id LIMIT ?",
+		WebhookPending, before.UTC(), limit)
+	return deliveries, parseError(err)
+}
+
+// UpdateWebhookDelivery stores the outcome of a delivery attempt.
+func (db *Database) UpdateWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	d.NextAttempt = storedTime(d.NextAttempt)
+	d.UpdatedAt = storedTime(d.UpdatedAt)
+	return parseError(db.updateWebhookDelivery(ctx, d))
+}
+
+// GetWebhookDeliveries returns up to f.Limit deliveries matching f, newest
+// first.
+func (db *Database) GetWebhookDeliveries(ctx context.Context, f WebhookFilter) ([]WebhookDelivery, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	query := "WHERE TRUE"
+	var args []any
+	if f.Endpoint != "" {
+		query += " AND Endpoint = ?"
+		args = append(args, f.Endpoint)
+	}
+	if f.Status != "" {
+		query += " AND Status = ?"
+		args = append(args, f.Status)
+	}
+	if f.BeforeId > 0 {
+		query += " AND Id < ?"
+		args = append(args, f.BeforeId)
+	}
+	query += " ORDER BY Id DESC LIMIT ?"
+	args = append(args, f.Limit)
+	deliveries, err := db.queryWebhookDeliveries(ctx, query, args...)
+	return deliveries, parseError(err)
+}
+
+// AddOutboxMessages stores outbox messages that do not belong to any other
+// change.
+func (db *Database) AddOutboxMessages(ctx context.Context, messages ...OutboxMessage) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		return addOutboxMessages(ctx, t, messages)
+	})
+	return parseError(err)
+}
+
+// GetDueOutboxMessages returns up to limit pending outbox messages whose next
+// attempt is not after before, the longest waiting first.
+func (db *Database) GetDueOutboxMessages(ctx context.Context, before time.Time, limit int) ([]OutboxMessage, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	messages, err := db.getDueOutboxMessages(ctx, before, limit)
+	return messages, parseError(err)
+}
+
+// UpdateOutboxMessage stores the outcome of an attempt to carry out an
+// outbox message.
+func (db *Database) UpdateOutboxMessage(ctx context.Context, m OutboxMessage) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	m.NextAttempt = storedTime(m.NextAttempt)
+	m.UpdatedAt = storedTime(m.UpdatedAt)
+	return parseError(db.updateOutboxMessage(ctx, m))
+}
+
+// SetReportCode creates the code of a "this wasn't me" link sent with a new
+// login alert, and stores the outbox messages sending the alert. a new alert
+// replaces the code of a previous one.
+func (db *Database) SetReportCode(ctx context.Context, userId ObjectId, outbox ...OutboxMessage) (string, error) {
+	code, err := randomString(50)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		err := setVerification(ctx, t, userId, Verification{Type: VerificationTypeReportLogin, Code: code})
+		if err != nil {
+			return err
+		}
+		return addOutboxMessages(ctx, t, outbox)
+	})
+	if err != nil {
+		return "", parseError(err)
+	}
+	return code, nil
+}
+
+// ReportLogin locks out whoever logged in as the owner of a report_login
+// code: all sessions and tokens are revoked and the password is cleared, so
+// it has to be reset through the recovery flow. it returns the owner's id.
+func (db *Database) ReportLogin(ctx context.Context, code string) (ObjectId, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var reported ObjectId
+	err := db.applyVerifiedAction(ctx, code, VerificationTypeReportLogin, func(ctx context.Context, t *sql.Tx, userId ObjectId) error {
+		reported = userId
+		if err := changeUserPassword(ctx, t, userId, ""); err != nil {
+			return err
+		}
+		return deleteUserSessions(ctx, t, userId, EmptyObjectId)
+	})
+	if err != nil {
+		return EmptyObjectId, parseError(err)
+	}
+	return reported, nil
+}
+
+// GetKnownDevices returns the devices a user logged in from, oldest first.
+func (db *Database) GetKnownDevices(ctx context.Context, userId ObjectId) ([]KnownDevice, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	devices, err := db.getKnownDevices(ctx, userId)
+	return devices, parseError(err)
+}
+
+// AddKnownDevice records a login from a device, or updates its last seen
+// time if it is known already.
+func (db *Database) AddKnownDevice(ctx context.Context, d KnownDevice) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	d.FirstSeen = storedTime(d.FirstSeen)
+	d.LastSeen = storedTime(d.LastSeen)
+	return parseError(db.addKnownDevice(ctx, d))
+}
+
+// AddSession records a new session, dropping the user's sessions that were
+// last seen before expiredBefore.
+func (db *Database) AddSession(ctx context.Context, s Session, expiredBefore time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	s.CreatedAt = storedTime(s.CreatedAt)
+	s.LastSeen = storedTime(s.LastSeen)
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		if err := deleteExpiredSessions(ctx, t, s.UserId, expiredBefore.UTC()); err != nil {
+			return err
+		}
+		return addSession(ctx, t, s)
+	})
+	return parseError(err)
+}
+
+func (db *Database) GetSession(ctx context.Context, sessionId ObjectId) (Session, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	s, err := db.getSession(ctx, sessionId)
+	return s, parseError(err)
+}
+
+// GetSessions returns the sessions of a user, oldest first.
+func (db *Database) GetSessions(ctx context.Context, userId ObjectId) ([]Session, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	sessions, err := db.getSessions(ctx, userId)
+	return sessions, parseError(err)
+}
+
+func (db *Database) TouchSession(ctx context.Context, sessionId ObjectId, at time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return parseError(db.touchSession(ctx, sessionId, storedTime(at)))
+}
+
+// RotateSession moves a session to its next generation when a token of the
+// given generation is refreshed, and returns the new one. it fails with
+// ErrNotFound if the session is gone or the token is not of its current
+// generation, so a token can only be refreshed once.
+func (db *Database) RotateSession(ctx context.Context, sessionId ObjectId, generation int, at time.Time) (int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	if err := db.rotateSession(ctx, sessionId, generation, storedTime(at)); err != nil {
+		return 0, parseError(err)
+	}
+	return generation + 1, nil
+}
+
+// DeleteSession revokes a session, it fails with ErrNotFound unless the
+// session belongs to the user.
+func (db *Database) DeleteSession(ctx context.Context, userId ObjectId, sessionId ObjectId) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return parseError(db.deleteSession(ctx, userId, sessionId))
+}
+
+// DeleteOtherSessions revokes all sessions of a user except keep.
+func (db *Database) DeleteOtherSessions(ctx context.Context, userId ObjectId, keep ObjectId) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		return deleteUserSessions(ctx, t, userId, keep)
+	})
+	return parseError(err)
+}
+
+func (db *Database) GetLoginFailure(ctx context.Context, kind LoginFailureKind, name string) (LoginFailure, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	f, err := getLoginFailure(ctx, db.db, kind, name)
+	return f, parseError(err)
+}
+
+// AddLoginFailure records a failed login for the given user or ip and returns
+// the updated record. failures older than resetBefore are forgotten.
+func (db *Database) AddLoginFailure(ctx context.Context, kind LoginFailureKind, name string, at time.Time, resetBefore time.Time) (LoginFailure, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var f LoginFailure
+	err := db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		if err := addLoginFailure(ctx, t, kind, name, at.UTC(), resetBefore.UTC()); err != nil {
+			return err
+		}
+		var err error
+		f, err = getLoginFailure(ctx, t, kind, name)
+		return err
+	})
+	return f, parseError(err)
+}
+
+func (db *Database) LockLogin(ctx context.Context, kind LoginFailureKind, name string, until time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return parseError(db.lockLogin(ctx, kind, name, until.UTC()))
+}
+
+func (db *Database) ClearLoginFailure(ctx context.Context, kind LoginFailureKind, name string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return parseError(db.deleteLoginFailure(ctx, kind, name))
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	. "github.com/onsi/gomega"
 	"testing"
 )
@@ -8,52 +9,75 @@ import (
 var (
 	connectionStr = "admin:admin@tcp(127.0.0.1:3306)/auth"
 	db            *Database
+	connectErr    error
+	ctx           = context.Background()
 )
 
 func TestConnect(t *testing.T) {
 	RegisterTestingT(t)
-	db, err := Connect(&Config{connectionStr})
+	db, err := Connect(&Config{ConnectionString: connectionStr})
 	Expect(err).To(BeNil())
 	err = db.Close()
 	Expect(err).To(BeNil())
 }
 
 func TestUser(t *testing.T) {
+	requireDatabase(t)
 	RegisterTestingT(t)
-	err := db.Clear(true)
+	err := db.Clear(ctx, true)
 	Expect(err).To(BeNil())
 
 	// add
-	_, _, err = db.AddUser(NewUser{Email: "dbUser1", Password: "12345678", Status: UserStatusActive})
+	_, _, err = db.AddUser(ctx, NewUser{Email: "dbUser1", Password: "12345678", Status: UserStatusActive})
 	Expect(err).To(BeNil())
 
 	// get
-	u, err := db.GetUser("dbUser1")
+	u, err := db.GetUser(ctx, "dbUser1")
 	Expect(err).To(BeNil())
 	Expect(u.Email).To(Equal("dbUser1"))
 	Expect(u.Status).To(Equal(UserStatusActive))
 
 	// get non-existing user
-	u, err = db.GetUser("dbUser2")
+	u, err = db.GetUser(ctx, "dbUser2")
 	Expect(err).To(Equal(ErrNotFound))
 
 	// duplicate
-	_, _, err = db.AddUser(NewUser{Email: "dbUser1", Password: "dbUser1", Status: UserStatusActive})
+	_, _, err = db.AddUser(ctx, NewUser{Email: "dbUser1", Password: "dbUser1", Status: UserStatusActive})
 	Expect(err).To(Equal(ErrDuplicateEntry))
 
 	// delete
-	err = db.DeleteUser("dbUser1")
+	err = db.DeleteUser(ctx, "dbUser1")
 	Expect(err).To(BeNil())
-	_, err = db.GetUser("dbUser1")
+	_, err = db.GetUser(ctx, "dbUser1")
 	Expect(err).NotTo(BeNil())
 
 	// delete non-existing user
-	err = db.DeleteUser("dbUser1")
+	err = db.DeleteUser(ctx, "dbUser1")
 	Expect(err).To(Equal(ErrNotFound))
 }
 
+func TestRandomString(t *testing.T) {
+	RegisterTestingT(t)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code, err := randomString(50)
+		Expect(err).To(BeNil())
+		Expect(code).To(MatchRegexp("^[0-9a-zA-Z]{50}$"))
+		Expect(seen).NotTo(HaveKey(code))
+		seen[code] = true
+	}
+}
+
 func TestMain(m *testing.M) {
-	db, _ = Connect(&Config{connectionStr})
+	db, connectErr = Connect(&Config{ConnectionString: connectionStr})
 	m.Run()
-	_ = db.Close()
+	if db != nil {
+		_ = db.Close()
+	}
+}
+
+func requireDatabase(t *testing.T) {
+	if db == nil {
+		t.Fatalf("database is not available: %v", connectErr)
+	}
 }
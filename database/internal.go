@@ -1,18 +1,21 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/go-sql-driver/mysql"
+	"time"
 )
 
-func addUser(t *sql.Tx, userId ObjectId, u NewUser) error {
-	_, err := t.Exec("INSERT INTO User(Id, Email, Password, Status) VALUES (?, ?, ?, ?)", userId, u.Email, u.Password, u.Status)
+func addUser(ctx context.Context, t *sql.Tx, userId ObjectId, u NewUser, at time.Time) error {
+	_, err := t.ExecContext(ctx, "INSERT INTO User(Id, Email, Password, Status, CreatedAt, UpdatedAt) VALUES (?, ?, ?, ?, ?, ?)",
+		userId, u.Email, u.Password, u.Status, at, at)
 	return err
 }
 
-func (db *Database) deleteUser(name string) error {
-	res, err := db.db.Exec("DELETE FROM User WHERE Email = ?", name)
+func (db *Database) deleteUser(ctx context.Context, name string) error {
+	res, err := db.db.ExecContext(ctx, "DELETE FROM User WHERE Email = ?", name)
 	if err != nil {
 		return err
 	}
@@ -26,50 +29,517 @@ func (db *Database) deleteUser(name string) error {
 	return nil
 }
 
-func (db *Database) getUser(name string) (User, error) {
-	res := db.db.QueryRow("SELECT Id, Email, Password, Status FROM User WHERE Email = ?", name)
-	var u User
-	err := res.Scan(&u.Id, &u.Email, &u.Password, &u.Status)
+// userColumns are the columns scanUser expects, prefixed with the User alias U.
+const userColumns = `U.Id, U.Email, U.Password, U.Status, U.TokenVersion, U.DeleteAt,
+	U.DisplayName, U.Locale, U.Timezone, U.AvatarURL, U.CreatedAt, U.UpdatedAt, U.LastLogin, U.AppMetadata, U.UserMetadata`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(res scanner) (User, error) {
+	var (
+		u                         User
+		deleteAt, lastLogin       sql.NullTime
+		appMetadata, userMetadata []byte
+	)
+	err := res.Scan(&u.Id, &u.Email, &u.Password, &u.Status, &u.TokenVersion, &deleteAt,
+		&u.Profile.DisplayName, &u.Profile.Locale, &u.Profile.Timezone, &u.Profile.AvatarURL,
+		&u.CreatedAt, &u.UpdatedAt, &lastLogin, &appMetadata, &userMetadata)
+	u.DeleteAt = deleteAt.Time
+	u.LastLogin = lastLogin.Time
+	u.AppMetadata = appMetadata
+	u.UserMetadata = userMetadata
 	return u, err
 }
 
-func deleteUsers(t *sql.Tx) error {
-	_, err := t.Exec("DELETE FROM User")
+func (db *Database) getUser(ctx context.Context, name string) (User, error) {
+	return scanUser(db.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM User U WHERE U.Email = ?", name))
+}
+
+func (db *Database) getUserById(ctx context.Context, userId ObjectId) (User, error) {
+	return scanUser(db.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM User U WHERE U.Id = ?", userId))
+}
+
+func (db *Database) getUserByCode(ctx context.Context, code string, verificationType VerificationType) (User, error) {
+	return scanUser(db.db.QueryRowContext(ctx, "SELECT "+userColumns+` FROM Verification V
+		JOIN User U ON U.Id = V.User_Id WHERE V.Code = ? AND V.Type = ?`, code, verificationType))
+}
+
+func deleteUsers(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM User")
 	return err
 }
 
-func (db *Database) getVerification(userId ObjectId, verificationType VerificationType) (string, error) {
-	res := db.db.QueryRow("SELECT Code FROM Verification WHERE User_Id = ? AND Type = ?", userId, verificationType)
+func (db *Database) getVerification(ctx context.Context, userId ObjectId, verificationType VerificationType) (string, error) {
+	res := db.db.QueryRowContext(ctx, "SELECT Code FROM Verification WHERE User_Id = ? AND Type = ?", userId, verificationType)
 	var code string
 	err := res.Scan(&code)
 	return code, err
 }
 
-func setVerification(t *sql.Tx, userId ObjectId, v Verification) error {
-	_, err := t.Exec("REPLACE INTO Verification(Code, Type, User_Id) VALUES (?, ?, ?)", v.Code, v.Type, userId)
+func (db *Database) getVerifications(ctx context.Context, userId ObjectId) ([]Verification, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT Code, Type, Value FROM Verification WHERE User_Id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var verifications []Verification
+	for rows.Next() {
+		var (
+			v     Verification
+			value sql.NullString
+		)
+		if err := rows.Scan(&v.Code, &v.Type, &value); err != nil {
+			return nil, err
+		}
+		v.Value = value.String
+		verifications = append(verifications, v)
+	}
+	return verifications, rows.Err()
+}
+
+func setVerification(ctx context.Context, t *sql.Tx, userId ObjectId, v Verification) error {
+	_, err := t.ExecContext(ctx, "REPLACE INTO Verification(Code, Type, Value, User_Id) VALUES (?, ?, ?, ?)", v.Code, v.Type, v.Value, userId)
+	return err
+}
+
+func deleteVerification(ctx context.Context, t *sql.Tx, userId ObjectId, verificationType VerificationType) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM Verification WHERE User_Id = ? AND Type = ?", userId, verificationType)
+	return err
+}
+
+// setEmailFromVerification moves the new address stored with a change_email
+// code into the user's email, the unique index rejects taken addresses.
+func setEmailFromVerification(ctx context.Context, t *sql.Tx, code string) error {
+	return expectRow(t.ExecContext(ctx, `UPDATE User U JOIN Verification V ON V.User_Id = U.Id
+		SET U.Email = V.Value, U.TokenVersion = U.TokenVersion + 1 WHERE V.Code = ?`, code))
+}
+
+func deleteVerifications(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM Verification")
 	return err
 }
 
-func deleteVerifications(t *sql.Tx) error {
-	_, err := t.Exec("DELETE FROM Verification")
+// lockUserStatus reads the status of a user and locks the user's row until
+// the end of the transaction.
+func lockUserStatus(ctx context.Context, t *sql.Tx, userId ObjectId) (UserStatus, error) {
+	var status UserStatus
+	err := t.QueryRowContext(ctx, "SELECT Status FROM User WHERE Id = ? FOR UPDATE", userId).Scan(&status)
+	return status, err
+}
+
+func setUserStatus(ctx context.Context, t *sql.Tx, userId ObjectId, status UserStatus) error {
+	_, err := t.ExecContext(ctx, "UPDATE User SET Status = ? WHERE Id = ?", status, userId)
 	return err
 }
 
-func setUserStatus(t *sql.Tx, userId ObjectId, status UserStatus) error {
-	_, err := t.Exec("UPDATE User SET Status = ? WHERE Id = ?", status, userId)
+func addStatusChange(ctx context.Context, t *sql.Tx, userId ObjectId, status UserStatus, at time.Time) error {
+	_, err := t.ExecContext(ctx, "INSERT INTO StatusChange(User_Id, Status, At) VALUES (?, ?, ?)", userId, status, at)
 	return err
 }
 
-func setUserPassword(t *sql.Tx, userId ObjectId, password string) error {
-	_, err := t.Exec("UPDATE User SET Password = ? WHERE Id = ?", password, userId)
+func deleteStatusChanges(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM StatusChange")
 	return err
 }
 
+func (db *Database) getStatusHistory(ctx context.Context, userId ObjectId) ([]StatusChange, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT Status, At FROM StatusChange WHERE User_Id = ? ORDER BY At, Id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var changes []StatusChange
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.Status, &c.At); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func setUserPassword(ctx context.Context, t *sql.Tx, userId ObjectId, password string) error {
+	_, err := t.ExecContext(ctx, "UPDATE User SET Password = ? WHERE Id = ?", password, userId)
+	return err
+}
+
+func changeUserPassword(ctx context.Context, t *sql.Tx, userId ObjectId, password string) error {
+	res, err := t.ExecContext(ctx, "UPDATE User SET Password = ?, TokenVersion = TokenVersion + 1 WHERE Id = ?", password, userId)
+	return expectRow(res, err)
+}
+
+func updateProfile(ctx context.Context, t *sql.Tx, userId ObjectId, p Profile, userMetadata []byte, at time.Time) error {
+	res, err := t.ExecContext(ctx, `UPDATE User SET DisplayName = ?, Locale = ?, Timezone = ?, AvatarURL = ?,
+		UserMetadata = ?, UpdatedAt = ? WHERE Id = ?`,
+		p.DisplayName, p.Locale, p.Timezone, p.AvatarURL, nullJSON(userMetadata), at, userId)
+	return expectRow(res, err)
+}
+
+func setAppMetadata(ctx context.Context, t *sql.Tx, userId ObjectId, appMetadata []byte, at time.Time) error {
+	res, err := t.ExecContext(ctx, "UPDATE User SET AppMetadata = ?, UpdatedAt = ? WHERE Id = ?", nullJSON(appMetadata), at, userId)
+	return expectRow(res, err)
+}
+
+func (db *Database) setLastLogin(ctx context.Context, userId ObjectId, at time.Time) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE User SET LastLogin = ? WHERE Id = ?", at, userId)
+	return err
+}
+
+// storedTime is t the way a DATETIME column keeps it, so both backends
+// return the same values.
+func storedTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// nullJSON stores empty metadata as NULL, JSON columns reject empty strings.
+func nullJSON(b []byte) any {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
+
+// expectRow turns an update that matched no row into ErrNotFound. MySQL
+// reports matched rather than changed rows, see Connect.
+func expectRow(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func scheduleDeletion(ctx context.Context, t *sql.Tx, userId ObjectId, at time.Time) error {
+	res, err := t.ExecContext(ctx, `UPDATE User SET Status = ?, DeleteAt = ?, TokenVersion = TokenVersion + 1
+		WHERE Id = ? AND Status = ?`, UserStatusDeleting, at, userId, UserStatusActive)
+	return expectRow(res, err)
+}
+
+func cancelDeletion(ctx context.Context, t *sql.Tx, userId ObjectId) error {
+	res, err := t.ExecContext(ctx, "UPDATE User SET Status = ?, DeleteAt = NULL WHERE Id = ? AND Status = ?",
+		UserStatusActive, userId, UserStatusDeleting)
+	return expectRow(res, err)
+}
+
+func (db *Database) getDueDeletions(ctx context.Context, before time.Time, limit int) ([]User, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT "+userColumns+` FROM User U
+		WHERE U.Status = ? AND U.DeleteAt <= ? ORDER BY U.DeleteAt LIMIT ?`, UserStatusDeleting, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func purgeUser(ctx context.Context, t *sql.Tx, userId ObjectId, before time.Time) error {
+	res, err := t.ExecContext(ctx, "DELETE FROM User WHERE Id = ? AND Status = ? AND DeleteAt <= ?",
+		userId, UserStatusDeleting, before)
+	return expectRow(res, err)
+}
+
+func addSession(ctx context.Context, t *sql.Tx, s Session) error {
+	_, err := t.ExecContext(ctx, "INSERT INTO Session(Id, User_Id, UserAgent, IP, CreatedAt, LastSeen, Generation) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		s.Id, s.UserId, s.UserAgent, s.IP, s.CreatedAt, s.LastSeen, s.Generation)
+	return err
+}
+
+const sessionColumns = "Id, User_Id, UserAgent, IP, CreatedAt, LastSeen, Generation"
+
+func scanSession(res scanner) (Session, error) {
+	var s Session
+	err := res.Scan(&s.Id, &s.UserId, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeen, &s.Generation)
+	return s, err
+}
+
+func (db *Database) getSession(ctx context.Context, sessionId ObjectId) (Session, error) {
+	return scanSession(db.db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM Session WHERE Id = ?", sessionId))
+}
+
+func (db *Database) getSessions(ctx context.Context, userId ObjectId) ([]Session, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT "+sessionColumns+" FROM Session WHERE User_Id = ? ORDER BY CreatedAt, Id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (db *Database) touchSession(ctx context.Context, sessionId ObjectId, at time.Time) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE Session SET LastSeen = ? WHERE Id = ?", at, sessionId)
+	return err
+}
+
+func (db *Database) rotateSession(ctx context.Context, sessionId ObjectId, generation int, at time.Time) error {
+	res, err := db.db.ExecContext(ctx, "UPDATE Session SET Generation = Generation + 1, LastSeen = ? WHERE Id = ? AND Generation = ?",
+		at, sessionId, generation)
+	return expectRow(res, err)
+}
+
+func (db *Database) deleteSession(ctx context.Context, userId ObjectId, sessionId ObjectId) error {
+	res, err := db.db.ExecContext(ctx, "DELETE FROM Session WHERE Id = ? AND User_Id = ?", sessionId, userId)
+	return expectRow(res, err)
+}
+
+// deleteUserSessions deletes all sessions of a user except keep.
+func deleteUserSessions(ctx context.Context, t *sql.Tx, userId ObjectId, keep ObjectId) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM Session WHERE User_Id = ? AND Id <> ?", userId, keep)
+	return err
+}
+
+func deleteExpiredSessions(ctx context.Context, t *sql.Tx, userId ObjectId, before time.Time) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM Session WHERE User_Id = ? AND LastSeen < ?", userId, before)
+	return err
+}
+
+func deleteSessions(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM Session")
+	return err
+}
+
+func deleteKnownDevices(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM KnownDevice")
+	return err
+}
+
+func (db *Database) getKnownDevices(ctx context.Context, userId ObjectId) ([]KnownDevice, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT User_Id, Fingerprint, Network, FirstSeen, LastSeen FROM KnownDevice WHERE User_Id = ? ORDER BY FirstSeen, Fingerprint, Network", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var devices []KnownDevice
+	for rows.Next() {
+		var d KnownDevice
+		if err := rows.Scan(&d.UserId, &d.Fingerprint, &d.Network, &d.FirstSeen, &d.LastSeen); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (db *Database) addKnownDevice(ctx context.Context, d KnownDevice) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO KnownDevice(User_Id, Fingerprint, Network, FirstSeen, LastSeen) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE LastSeen = ?`,
+		d.UserId, d.Fingerprint, d.Network, d.FirstSeen, d.LastSeen, d.LastSeen)
+	return err
+}
+
+func addLoginFailure(ctx context.Context, t *sql.Tx, kind LoginFailureKind, name string, at time.Time, resetBefore time.Time) error {
+	_, err := t.ExecContext(ctx, `INSERT INTO LoginFailure(Kind, Name, Count, LastFailure) VALUES (?, ?, 1, ?)
+		ON DUPLICATE KEY UPDATE Count = IF(LastFailure < ?, 1, Count + 1), LastFailure = ?`,
+		kind, name, at, resetBefore, at)
+	return err
+}
+
+func getLoginFailure(ctx context.Context, q queryer, kind LoginFailureKind, name string) (LoginFailure, error) {
+	res := q.QueryRowContext(ctx, "SELECT Kind, Name, Count, LastFailure, LockedUntil FROM LoginFailure WHERE Kind = ? AND Name = ?", kind, name)
+	var (
+		f           LoginFailure
+		lockedUntil sql.NullTime
+	)
+	err := res.Scan(&f.Kind, &f.Name, &f.Count, &f.LastFailure, &lockedUntil)
+	f.LockedUntil = lockedUntil.Time
+	return f, err
+}
+
+func (db *Database) lockLogin(ctx context.Context, kind LoginFailureKind, name string, until time.Time) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE LoginFailure SET LockedUntil = ? WHERE Kind = ? AND Name = ?", until, kind, name)
+	return err
+}
+
+func (db *Database) deleteLoginFailure(ctx context.Context, kind LoginFailureKind, name string) error {
+	_, err := db.db.ExecContext(ctx, "DELETE FROM LoginFailure WHERE Kind = ? AND Name = ?", kind, name)
+	return err
+}
+
+func (db *Database) addAuditEvent(ctx context.Context, e AuditEvent) error {
+	_, err := db.db.ExecContext(ctx, "INSERT INTO AuditEvent(Type, Actor, Target, IP, UserAgent, RequestId, Detail, At) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Type, e.Actor, e.Target, e.IP, e.UserAgent, e.RequestId, e.Detail, e.At)
+	return err
+}
+
+func (db *Database) getAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	query := "SELECT Id, Type, Actor, Target, IP, UserAgent, RequestId, Detail, At FROM AuditEvent WHERE TRUE"
+	var args []any
+	for _, c := range []struct {
+		column string
+		value  string
+	}{{"Type", f.Type}, {"Actor", f.Actor}, {"Target", f.Target}, {"IP", f.IP}} {
+		if c.value != "" {
+			query += " AND " + c.column + " = ?"
+			args = append(args, c.value)
+		}
+	}
+	if !f.From.IsZero() {
+		query += " AND At >= ?"
+		args = append(args, f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		query += " AND At < ?"
+		args = append(args, f.To.UTC())
+	}
+	if f.BeforeId > 0 {
+		query += " AND Id < ?"
+		args = append(args, f.BeforeId)
+	}
+	query += " ORDER BY Id DESC LIMIT ?"
+	args = append(args, f.Limit)
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.Id, &e.Type, &e.Actor, &e.Target, &e.IP, &e.UserAgent, &e.RequestId, &e.Detail, &e.At); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func addWebhookDelivery(ctx context.Context, t *sql.Tx, d WebhookDelivery) error {
+	_, err := t.ExecContext(ctx, `INSERT INTO WebhookDelivery(EventId, Endpoint, Event, Payload, Status, Attempts, NextAttempt, LastStatus, LastError, CreatedAt, UpdatedAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE Id = Id`,
+		d.EventId, d.Endpoint, d.Event, []byte(d.Payload), d.Status, d.Attempts, d.NextAttempt, d.LastStatus, d.LastError, d.CreatedAt, d.UpdatedAt)
+	return err
+}
+
+const webhookDeliveryColumns = "Id, EventId, Endpoint, Event, Payload, Status, Attempts, NextAttempt, LastStatus, LastError, CreatedAt, UpdatedAt"
+
+func (db *Database) queryWebhookDeliveries(ctx context.Context, query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT "+webhookDeliveryColumns+" FROM WebhookDelivery "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var (
+			d       WebhookDelivery
+			payload []byte
+		)
+		err := rows.Scan(&d.Id, &d.EventId, &d.Endpoint, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.LastStatus, &d.LastError, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (db *Database) updateWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	res, err := db.db.ExecContext(ctx, "UPDATE WebhookDelivery SET Status = ?, Attempts = ?, NextAttempt = ?, LastStatus = ?, LastError = ?, UpdatedAt = ? WHERE Id = ?",
+		d.Status, d.Attempts, d.NextAttempt, d.LastStatus, d.LastError, d.UpdatedAt, d.Id)
+	return expectRow(res, err)
+}
+
+func deleteWebhookDeliveries(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM WebhookDelivery")
+	return err
+}
+
+func addOutboxMessages(ctx context.Context, t *sql.Tx, messages []OutboxMessage) error {
+	for _, m := range messages {
+		_, err := t.ExecContext(ctx, `INSERT INTO Outbox(Kind, Payload, Status, Attempts, NextAttempt, LastError, CreatedAt, UpdatedAt)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			m.Kind, []byte(m.Payload), m.Status, m.Attempts, storedTime(m.NextAttempt), m.LastError, storedTime(m.CreatedAt), storedTime(m.UpdatedAt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) getDueOutboxMessages(ctx context.Context, before time.Time, limit int) ([]OutboxMessage, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT Id, Kind, Payload, Status, Attempts, NextAttempt, LastError, CreatedAt, UpdatedAt
+		FROM Outbox WHERE Status = ? AND NextAttempt <= ? ORDER BY NextAttempt, Id LIMIT ?`,
+		OutboxPending, before.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []OutboxMessage
+	for rows.Next() {
+		var (
+			m       OutboxMessage
+			payload []byte
+		)
+		err := rows.Scan(&m.Id, &m.Kind, &payload, &m.Status, &m.Attempts, &m.NextAttempt, &m.LastError, &m.CreatedAt, &m.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		m.Payload = payload
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func (db *Database) updateOutboxMessage(ctx context.Context, m OutboxMessage) error {
+	res, err := db.db.ExecContext(ctx, "UPDATE Outbox SET Status = ?, Attempts = ?, NextAttempt = ?, LastError = ?, UpdatedAt = ? WHERE Id = ?",
+		m.Status, m.Attempts, m.NextAttempt, m.LastError, m.UpdatedAt, m.Id)
+	return expectRow(res, err)
+}
+
+func deleteOutboxMessages(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM Outbox")
+	return err
+}
+
+func deleteAuditEvents(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM AuditEvent")
+	return err
+}
+
+func deleteLoginFailures(ctx context.Context, t *sql.Tx) error {
+	_, err := t.ExecContext(ctx, "DELETE FROM LoginFailure")
+	return err
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx, for reads that are used
+// inside and outside of transactions.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 func parseError(err error) error {
 	var mysqlErr *mysql.MySQLError
 	if errors.Is(err, sql.ErrNoRows) {
 		return ErrNotFound
 	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
 	if errors.As(err, &mysqlErr) {
 		switch mysqlErr.Number {
 		case 1062:
@@ -83,29 +553,38 @@ func parseError(err error) error {
 	return err
 }
 
-type actionFunction func(t *sql.Tx, userId ObjectId) error
-
-func (db *Database) applyVerifiedAction(code string, verificationType VerificationType, action actionFunction) error {
-	res := db.db.QueryRow("select U.Id, V.Type from Verification V left join User U on U.Id = V.User_Id WHERE Code = ?", code)
-	var (
-		userId     ObjectId
-		storedType VerificationType
-	)
-	if err := res.Scan(&userId, &storedType); err != nil {
-		return err
-	}
-	if storedType != verificationType {
-		return errors.New("unknown verification type")
+// withTimeout bounds a single storage call by the configured query timeout,
+// on top of whatever deadline the caller's context already carries.
+func (db *Database) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+var errUnknownVerificationType = errors.New("unknown verification type")
+
+type actionFunction func(ctx context.Context, t *sql.Tx, userId ObjectId) error
 
-	err := db.withTransaction(func(t *sql.Tx) error {
-		if err := action(t, userId); err != nil {
+// applyVerifiedAction looks up and locks the verification of code inside the
+// transaction, so concurrent requests with the same code apply it only once.
+func (db *Database) applyVerifiedAction(ctx context.Context, code string, verificationType VerificationType, action actionFunction) error {
+	return db.withTransaction(ctx, func(ctx context.Context, t *sql.Tx) error {
+		var (
+			userId     ObjectId
+			storedType VerificationType
+		)
+		err := t.QueryRowContext(ctx, `SELECT V.User_Id, V.Type FROM Verification V JOIN User U ON U.Id = V.User_Id
+			WHERE V.Code = ? FOR UPDATE`, code).Scan(&userId, &storedType)
+		if err != nil {
 			return err
 		}
-		if _, err := t.Exec("DELETE FROM Verification WHERE Code = ?", code); err != nil {
+		if storedType != verificationType {
+			return errUnknownVerificationType
+		}
+		if err := action(ctx, t, userId); err != nil {
 			return err
 		}
-		return nil
+		return expectRow(t.ExecContext(ctx, "DELETE FROM Verification WHERE Code = ?", code))
 	})
-	return err
 }
@@ -0,0 +1,1008 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryVerification struct {
+	Verification
+	UserId ObjectId
+}
+
+// Memory is a concurrency-safe in-memory implementation of the storage used by
+// the handlers. It is meant for unit tests and dev mode and keeps nothing on disk.
+type Memory struct {
+	mu            sync.RWMutex
+	users         map[ObjectId]User
+	verifications map[string]memoryVerification
+	loginFailures map[loginFailureKey]LoginFailure
+	sessions      map[ObjectId]Session
+	devices       map[knownDeviceKey]KnownDevice
+	statusHistory map[ObjectId][]StatusChange
+	auditEvents   []AuditEvent
+	lastAuditId   int64
+	webhooks      []WebhookDelivery
+	lastWebhookId int64
+	outbox        []OutboxMessage
+	lastOutboxId  int64
+}
+
+type knownDeviceKey struct {
+	userId      ObjectId
+	fingerprint string
+	network     string
+}
+
+type loginFailureKey struct {
+	Kind LoginFailureKind
+	Name string
+}
+
+func NewMemory() *Memory {
+	m := &Memory{}
+	m.reset(true)
+	return m
+}
+
+func (m *Memory) reset(removeUsers bool) {
+	m.verifications = make(map[string]memoryVerification)
+	m.loginFailures = make(map[loginFailureKey]LoginFailure)
+	m.sessions = make(map[ObjectId]Session)
+	m.devices = make(map[knownDeviceKey]KnownDevice)
+	m.statusHistory = make(map[ObjectId][]StatusChange)
+	m.auditEvents = nil
+	m.webhooks = nil
+	m.outbox = nil
+	if removeUsers {
+		m.users = make(map[ObjectId]User)
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) Health(ctx context.Context) error {
+	return contextError(ctx)
+}
+
+func (m *Memory) Clear(ctx context.Context, removeUsers bool) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reset(removeUsers)
+	return nil
+}
+
+func (m *Memory) AddUser(ctx context.Context, u NewUser, outbox ...OutboxMessage) (ObjectId, string, error) {
+	if err := contextError(ctx); err != nil {
+		return EmptyObjectId, "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.findUser(u.Email); ok {
+		return EmptyObjectId, "", ErrDuplicateEntry
+	}
+	userId := u.Id
+	if userId == EmptyObjectId {
+		userId = NewObjectId()
+	}
+	code, err := randomString(50)
+	if err != nil {
+		return EmptyObjectId, "", err
+	}
+	now := storedTime(time.Now())
+	m.users[userId] = User{
+		Id:        userId,
+		Email:     u.Email,
+		Password:  u.Password,
+		Status:    u.Status,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	m.addStatusChange(userId, u.Status, now)
+	if u.Status == UserStatusPending {
+		m.setVerification(userId, Verification{Code: code, Type: VerificationTypeSignup, Value: u.RedirectURI})
+	}
+	m.addOutboxMessages(outbox)
+	return userId, code, nil
+}
+
+func (m *Memory) Verify(ctx context.Context, code string, outbox ...OutboxMessage) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	return m.applyVerifiedAction(code, VerificationTypeSignup, func(u *User) {
+		u.Status = UserStatusActive
+		m.addOutboxMessages(outbox)
+	})
+}
+
+func (m *Memory) SetRecoveryCode(ctx context.Context, userId ObjectId, outbox ...OutboxMessage) (string, error) {
+	if err := contextError(ctx); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userId]; !ok {
+		return "", ErrInvalid
+	}
+	code, err := randomString(50)
+	if err != nil {
+		return "", err
+	}
+	m.setVerification(userId, Verification{Type: VerificationTypeRecover, Code: code})
+	m.addOutboxMessages(outbox)
+	return code, nil
+}
+
+func (m *Memory) SetSignupCode(ctx context.Context, userId ObjectId, redirectURI string, outbox ...OutboxMessage) (string, error) {
+	if err := contextError(ctx); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userId]
+	if !ok {
+		return "", ErrNotFound
+	}
+	if u.Status != UserStatusPending {
+		return "", ErrInvalid
+	}
+	code, err := randomString(50)
+	if err != nil {
+		return "", err
+	}
+	m.setVerification(userId, Verification{Type: VerificationTypeSignup, Code: code, Value: redirectURI})
+	m.addOutboxMessages(outbox)
+	return code, nil
+}
+
+func (m *Memory) addOutboxMessages(messages []OutboxMessage) {
+	for _, o := range messages {
+		m.lastOutboxId++
+		o.Id = m.lastOutboxId
+		o.NextAttempt = storedTime(o.NextAttempt)
+		o.CreatedAt = storedTime(o.CreatedAt)
+		o.UpdatedAt = storedTime(o.UpdatedAt)
+		m.outbox = append(m.outbox, o)
+	}
+}
+
+func (m *Memory) AddOutboxMessages(ctx context.Context, messages ...OutboxMessage) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addOutboxMessages(messages)
+	return nil
+}
+
+func (m *Memory) GetDueOutboxMessages(ctx context.Context, before time.Time, limit int) ([]OutboxMessage, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var messages []OutboxMessage
+	for _, o := range m.outbox {
+		if o.Status == OutboxPending && !o.NextAttempt.After(before) {
+			messages = append(messages, o)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].NextAttempt.Before(messages[j].NextAttempt)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (m *Memory) UpdateOutboxMessage(ctx context.Context, o OutboxMessage) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.outbox {
+		if m.outbox[i].Id == o.Id {
+			stored := &m.outbox[i]
+			stored.Status = o.Status
+			stored.Attempts = o.Attempts
+			stored.NextAttempt = storedTime(o.NextAttempt)
+			stored.LastError = o.LastError
+			stored.UpdatedAt = storedTime(o.UpdatedAt)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) ResetPassword(ctx context.Context, code string, newPasswordHash string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	return m.applyVerifiedAction(code, VerificationTypeRecover, func(u *User) {
+		u.Password = newPasswordHash
+	})
+}
+
+func (m *Memory) SetEmailChange(ctx context.Context, userId ObjectId, newEmail string, outbox ...OutboxMessage) (string, string, error) {
+	if err := contextError(ctx); err != nil {
+		return "", "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userId]; !ok {
+		return "", "", ErrInvalid
+	}
+	confirmCode, err := randomString(50)
+	if err != nil {
+		return "", "", err
+	}
+	cancelCode, err := randomString(50)
+	if err != nil {
+		return "", "", err
+	}
+	m.setVerification(userId, Verification{Type: VerificationTypeChangeEmail, Code: confirmCode, Value: newEmail})
+	m.setVerification(userId, Verification{Type: VerificationTypeCancelEmail, Code: cancelCode})
+	m.addOutboxMessages(outbox)
+	return confirmCode, cancelCode, nil
+}
+
+func (m *Memory) ConfirmEmailChange(ctx context.Context, code string, outbox ...OutboxMessage) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.verifications[code]
+	if !ok {
+		return ErrNotFound
+	}
+	if v.Type != VerificationTypeChangeEmail {
+		return errUnknownVerificationType
+	}
+	if _, ok := m.findUser(v.Value); ok {
+		return ErrDuplicateEntry
+	}
+	u, ok := m.users[v.UserId]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Email = v.Value
+	u.TokenVersion++
+	m.users[u.Id] = u
+	delete(m.verifications, code)
+	m.deleteVerification(u.Id, VerificationTypeCancelEmail)
+	m.deleteUserSessions(u.Id, EmptyObjectId)
+	m.addOutboxMessages(outbox)
+	return nil
+}
+
+func (m *Memory) CancelEmailChange(ctx context.Context, code string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.verifications[code]
+	if !ok {
+		return ErrNotFound
+	}
+	if v.Type != VerificationTypeCancelEmail {
+		return errUnknownVerificationType
+	}
+	if _, ok := m.users[v.UserId]; !ok {
+		return ErrNotFound
+	}
+	delete(m.verifications, code)
+	m.deleteVerification(v.UserId, VerificationTypeChangeEmail)
+	return nil
+}
+
+func (m *Memory) SetPassword(ctx context.Context, userId ObjectId, passwordHash string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userId]
+	if !ok {
+		return nil
+	}
+	u.Password = passwordHash
+	m.users[userId] = u
+	return nil
+}
+
+func (m *Memory) ChangePassword(ctx context.Context, userId ObjectId, passwordHash string, outbox ...OutboxMessage) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userId]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Password = passwordHash
+	u.TokenVersion++
+	m.users[userId] = u
+	m.addOutboxMessages(outbox)
+	return nil
+}
+
+func (m *Memory) GetUser(ctx context.Context, name string) (User, error) {
+	if err := contextError(ctx); err != nil {
+		return User{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.findUser(name)
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (m *Memory) GetUserById(ctx context.Context, userId ObjectId) (User, error) {
+	if err := contextError(ctx); err != nil {
+		return User{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[userId]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (m *Memory) GetUserByCode(ctx context.Context, code string, verificationType VerificationType) (User, error) {
+	if err := contextError(ctx); err != nil {
+		return User{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.verifications[code]
+	if !ok || v.Type != verificationType {
+		return User{}, ErrNotFound
+	}
+	u, ok := m.users[v.UserId]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, name string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.findUser(name)
+	if !ok {
+		return ErrNotFound
+	}
+	m.deleteUser(u.Id)
+	return nil
+}
+
+func (m *Memory) GetVerification(ctx context.Context, userId ObjectId, verificationType VerificationType) (string, error) {
+	if err := contextError(ctx); err != nil {
+		return "", err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for code, v := range m.verifications {
+		if v.UserId == userId && v.Type == verificationType {
+			return code, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) UpdateProfile(ctx context.Context, userId ObjectId, p Profile, userMetadata json.RawMessage, at time.Time) error {
+	return m.updateUser(ctx, userId, func(u *User) {
+		u.Profile = p
+		u.UserMetadata = userMetadata
+		u.UpdatedAt = storedTime(at)
+	})
+}
+
+func (m *Memory) SetAppMetadata(ctx context.Context, userId ObjectId, appMetadata json.RawMessage, at time.Time) error {
+	return m.updateUser(ctx, userId, func(u *User) {
+		u.AppMetadata = appMetadata
+		u.UpdatedAt = storedTime(at)
+	})
+}
+
+func (m *Memory) SetLastLogin(ctx context.Context, userId ObjectId, at time.Time) error {
+	err := m.updateUser(ctx, userId, func(u *User) {
+		u.LastLogin = storedTime(at)
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (m *Memory) ScheduleDeletion(ctx context.Context, userId ObjectId, at time.Time) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userId]
+	if !ok || u.Status != UserStatusActive {
+		return ErrNotFound
+	}
+	u.Status = UserStatusDeleting
+	u.DeleteAt = storedTime(at)
+	u.TokenVersion++
+	m.users[userId] = u
+	m.addStatusChange(userId, UserStatusDeleting, storedTime(time.Now()))
+	m.deleteUserSessions(userId, EmptyObjectId)
+	return nil
+}
+
+func (m *Memory) CancelDeletion(ctx context.Context, userId ObjectId) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userId]
+	if !ok || u.Status != UserStatusDeleting {
+		return ErrNotFound
+	}
+	u.Status = UserStatusActive
+	u.DeleteAt = time.Time{}
+	m.users[userId] = u
+	m.addStatusChange(userId, UserStatusActive, storedTime(time.Now()))
+	return nil
+}
+
+func (m *Memory) GetDueDeletions(ctx context.Context, before time.Time, limit int) ([]User, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var users []User
+	for _, u := range m.users {
+		if u.Status == UserStatusDeleting && !u.DeleteAt.After(before) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].DeleteAt.Before(users[j].DeleteAt) })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *Memory) PurgeUser(ctx context.Context, userId ObjectId, before time.Time, outbox ...OutboxMessage) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userId]
+	if !ok || u.Status != UserStatusDeleting || u.DeleteAt.After(before) {
+		return ErrNotFound
+	}
+	m.deleteUser(userId)
+	m.addOutboxMessages(outbox)
+	return nil
+}
+
+func (m *Memory) GetStatusHistory(ctx context.Context, userId ObjectId) ([]StatusChange, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]StatusChange(nil), m.statusHistory[userId]...), nil
+}
+
+func (m *Memory) GetVerifications(ctx context.Context, userId ObjectId) ([]Verification, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var verifications []Verification
+	for _, v := range m.verifications {
+		if v.UserId == userId {
+			verifications = append(verifications, v.Verification)
+		}
+	}
+	return verifications, nil
+}
+
+func (m *Memory) AddAuditEvent(ctx context.Context, e AuditEvent) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastAuditId++
+	e.Id = m.lastAuditId
+	e.At = storedTime(e.At)
+	m.auditEvents = append(m.auditEvents, e)
+	return nil
+}
+
+func (m *Memory) GetAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var events []AuditEvent
+	for i := len(m.auditEvents) - 1; i >= 0 && len(events) < f.Limit; i-- {
+		e := m.auditEvents[i]
+		switch {
+		case f.Type != "" && e.Type != f.Type,
+			f.Actor != "" && e.Actor != f.Actor,
+			f.Target != "" && e.Target != f.Target,
+			f.IP != "" && e.IP != f.IP,
+			!f.From.IsZero() && e.At.Before(f.From),
+			!f.To.IsZero() && !e.At.Before(f.To),
+			f.BeforeId > 0 && e.Id >= f.BeforeId:
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (m *Memory) AddWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range deliveries {
+		if m.hasWebhookDelivery(d.EventId, d.Endpoint) {
+			continue
+		}
+		m.lastWebhookId++
+		d.Id = m.lastWebhookId
+		d.NextAttempt = storedTime(d.NextAttempt)
+		d.CreatedAt = storedTime(d.CreatedAt)
+		d.UpdatedAt = storedTime(d.UpdatedAt)
+		m.webhooks = append(m.webhooks, d)
+	}
+	return nil
+}
+
+func (m *Memory) hasWebhookDelivery(eventId ObjectId, endpoint string) bool {
+	for _, d := range m.webhooks {
+		if d.EventId == eventId && d.Endpoint == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) GetDueWebhookDeliveries(ctx context.Context, before time.Time, limit int) ([]WebhookDelivery, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deliveries []WebhookDelivery
+	for _, d := range m.webhooks {
+		if d.Status == WebhookPending && !d.NextAttempt.After(before) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttempt.Before(deliveries[j].NextAttempt)
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (m *Memory) UpdateWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.webhooks {
+		if m.webhooks[i].Id == d.Id {
+			stored := &m.webhooks[i]
+			stored.Status = d.Status
+			stored.Attempts = d.Attempts
+			stored.NextAttempt = storedTime(d.NextAttempt)
+			stored.LastStatus = d.LastStatus
+			stored.LastError = d.LastError
+			stored.UpdatedAt = storedTime(d.UpdatedAt)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) GetWebhookDeliveries(ctx context.Context, f WebhookFilter) ([]WebhookDelivery, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deliveries []WebhookDelivery
+	for i := len(m.webhooks) - 1; i >= 0 && len(deliveries) < f.Limit; i-- {
+		d := m.webhooks[i]
+		switch {
+		case f.Endpoint != "" && d.Endpoint != f.Endpoint,
+			f.Status != "" && d.Status != f.Status,
+			f.BeforeId > 0 && d.Id >= f.BeforeId:
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+func (m *Memory) SetReportCode(ctx context.Context, userId ObjectId, outbox ...OutboxMessage) (string, error) {
+	if err := contextError(ctx); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userId]; !ok {
+		return "", ErrInvalid
+	}
+	code, err := randomString(50)
+	if err != nil {
+		return "", err
+	}
+	m.setVerification(userId, Verification{Type: VerificationTypeReportLogin, Code: code})
+	m.addOutboxMessages(outbox)
+	return code, nil
+}
+
+func (m *Memory) ReportLogin(ctx context.Context, code string) (ObjectId, error) {
+	if err := contextError(ctx); err != nil {
+		return EmptyObjectId, err
+	}
+	var reported ObjectId
+	err := m.applyVerifiedAction(code, VerificationTypeReportLogin, func(u *User) {
+		reported = u.Id
+		u.Password = ""
+		u.TokenVersion++
+		m.deleteUserSessions(u.Id, EmptyObjectId)
+	})
+	if err != nil {
+		return EmptyObjectId, err
+	}
+	return reported, nil
+}
+
+func (m *Memory) GetKnownDevices(ctx context.Context, userId ObjectId) ([]KnownDevice, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var devices []KnownDevice
+	for _, d := range m.devices {
+		if d.UserId == userId {
+			devices = append(devices, d)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if !devices[i].FirstSeen.Equal(devices[j].FirstSeen) {
+			return devices[i].FirstSeen.Before(devices[j].FirstSeen)
+		}
+		if devices[i].Fingerprint != devices[j].Fingerprint {
+			return devices[i].Fingerprint < devices[j].Fingerprint
+		}
+		return devices[i].Network < devices[j].Network
+	})
+	return devices, nil
+}
+
+func (m *Memory) AddKnownDevice(ctx context.Context, d KnownDevice) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[d.UserId]; !ok {
+		return ErrInvalid
+	}
+	key := knownDeviceKey{userId: d.UserId, fingerprint: d.Fingerprint, network: d.Network}
+	if existing, ok := m.devices[key]; ok {
+		existing.LastSeen = storedTime(d.LastSeen)
+		m.devices[key] = existing
+		return nil
+	}
+	d.FirstSeen = storedTime(d.FirstSeen)
+	d.LastSeen = storedTime(d.LastSeen)
+	m.devices[key] = d
+	return nil
+}
+
+func (m *Memory) AddSession(ctx context.Context, s Session, expiredBefore time.Time) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[s.UserId]; !ok {
+		return ErrInvalid
+	}
+	if _, ok := m.sessions[s.Id]; ok {
+		return ErrDuplicateEntry
+	}
+	for id, existing := range m.sessions {
+		if existing.UserId == s.UserId && existing.LastSeen.Before(expiredBefore) {
+			delete(m.sessions, id)
+		}
+	}
+	s.CreatedAt = storedTime(s.CreatedAt)
+	s.LastSeen = storedTime(s.LastSeen)
+	m.sessions[s.Id] = s
+	return nil
+}
+
+func (m *Memory) GetSession(ctx context.Context, sessionId ObjectId) (Session, error) {
+	if err := contextError(ctx); err != nil {
+		return Session{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[sessionId]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *Memory) GetSessions(ctx context.Context, userId ObjectId) ([]Session, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var sessions []Session
+	for _, s := range m.sessions {
+		if s.UserId == userId {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions, nil
+}
+
+func (m *Memory) TouchSession(ctx context.Context, sessionId ObjectId, at time.Time) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[sessionId]; ok {
+		s.LastSeen = storedTime(at)
+		m.sessions[sessionId] = s
+	}
+	return nil
+}
+
+func (m *Memory) RotateSession(ctx context.Context, sessionId ObjectId, generation int, at time.Time) (int, error) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionId]
+	if !ok || s.Generation != generation {
+		return 0, ErrNotFound
+	}
+	s.Generation++
+	s.LastSeen = storedTime(at)
+	m.sessions[sessionId] = s
+	return s.Generation, nil
+}
+
+func (m *Memory) DeleteSession(ctx context.Context, userId ObjectId, sessionId ObjectId) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionId]
+	if !ok || s.UserId != userId {
+		return ErrNotFound
+	}
+	delete(m.sessions, sessionId)
+	return nil
+}
+
+func (m *Memory) DeleteOtherSessions(ctx context.Context, userId ObjectId, keep ObjectId) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteUserSessions(userId, keep)
+	return nil
+}
+
+func (m *Memory) GetLoginFailure(ctx context.Context, kind LoginFailureKind, name string) (LoginFailure, error) {
+	if err := contextError(ctx); err != nil {
+		return LoginFailure{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.loginFailures[loginFailureKey{kind, name}]
+	if !ok {
+		return LoginFailure{}, ErrNotFound
+	}
+	return f, nil
+}
+
+func (m *Memory) AddLoginFailure(ctx context.Context, kind LoginFailureKind, name string, at time.Time, resetBefore time.Time) (LoginFailure, error) {
+	if err := contextError(ctx); err != nil {
+		return LoginFailure{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := loginFailureKey{kind, name}
+	f, ok := m.loginFailures[key]
+	if !ok {
+		f = LoginFailure{Kind: kind, Name: name}
+	}
+	if f.LastFailure.Before(resetBefore) {
+		f.Count = 0
+	}
+	f.Count++
+	f.LastFailure = at
+	m.loginFailures[key] = f
+	return f, nil
+}
+
+func (m *Memory) LockLogin(ctx context.Context, kind LoginFailureKind, name string, until time.Time) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := loginFailureKey{kind, name}
+	if f, ok := m.loginFailures[key]; ok {
+		f.LockedUntil = until
+		m.loginFailures[key] = f
+	}
+	return nil
+}
+
+func (m *Memory) ClearLoginFailure(ctx context.Context, kind LoginFailureKind, name string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.loginFailures, loginFailureKey{kind, name})
+	return nil
+}
+
+// updateUser applies update to a stored user, it fails with ErrNotFound for
+// unknown users.
+func (m *Memory) updateUser(ctx context.Context, userId ObjectId, update func(u *User)) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userId]
+	if !ok {
+		return ErrNotFound
+	}
+	update(&u)
+	m.users[userId] = u
+	return nil
+}
+
+// deleteUser removes a user and cascades like the foreign keys of the
+// database do.
+func (m *Memory) deleteUser(userId ObjectId) {
+	delete(m.users, userId)
+	for code, v := range m.verifications {
+		if v.UserId == userId {
+			delete(m.verifications, code)
+		}
+	}
+	m.deleteUserSessions(userId, EmptyObjectId)
+	delete(m.statusHistory, userId)
+	for key := range m.devices {
+		if key.userId == userId {
+			delete(m.devices, key)
+		}
+	}
+}
+
+func (m *Memory) addStatusChange(userId ObjectId, status UserStatus, at time.Time) {
+	m.statusHistory[userId] = append(m.statusHistory[userId], StatusChange{Status: status, At: at})
+}
+
+func (m *Memory) deleteUserSessions(userId ObjectId, keep ObjectId) {
+	for id, s := range m.sessions {
+		if s.UserId == userId && id != keep {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *Memory) findUser(name string) (User, bool) {
+	for _, u := range m.users {
+		if u.Email == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// setVerification mirrors the REPLACE semantics of the Verification table:
+// a user has at most one code per verification type.
+func (m *Memory) setVerification(userId ObjectId, v Verification) {
+	m.deleteVerification(userId, v.Type)
+	m.verifications[v.Code] = memoryVerification{Verification: v, UserId: userId}
+}
+
+func (m *Memory) deleteVerification(userId ObjectId, verificationType VerificationType) {
+	for code, existing := range m.verifications {
+		if existing.UserId == userId && existing.Type == verificationType {
+			delete(m.verifications, code)
+		}
+	}
+}
+
+func (m *Memory) applyVerifiedAction(code string, verificationType VerificationType, action func(u *User)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.verifications[code]
+	if !ok {
+		return ErrNotFound
+	}
+	if v.Type != verificationType {
+		return errUnknownVerificationType
+	}
+	u, ok := m.users[v.UserId]
+	if !ok {
+		return ErrNotFound
+	}
+	status := u.Status
+	action(&u)
+	m.users[u.Id] = u
+	if u.Status != status {
+		m.addStatusChange(u.Id, u.Status, storedTime(time.Now()))
+	}
+	delete(m.verifications, code)
+	return nil
+}
+
+// contextError reports a cancelled or expired context the same way the
+// database backend does.
+func contextError(ctx context.Context) error {
+	return parseError(ctx.Err())
+}
@@ -0,0 +1,849 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+// storage is the set of operations every backend has to provide. new backends
+// should be added to the tests below and pass the whole suite.
+type storage interface {
+	Health(ctx context.Context) error
+	Clear(ctx context.Context, removeUsers bool) error
+	AddUser(ctx context.Context, u NewUser, outbox ...OutboxMessage) (ObjectId, string, error)
+	GetUser(ctx context.Context, name string) (User, error)
+	GetUserById(ctx context.Context, userId ObjectId) (User, error)
+	GetUserByCode(ctx context.Context, code string, verificationType VerificationType) (User, error)
+	DeleteUser(ctx context.Context, name string) error
+	Verify(ctx context.Context, code string, outbox ...OutboxMessage) error
+	SetRecoveryCode(ctx context.Context, userId ObjectId, outbox ...OutboxMessage) (string, error)
+	SetSignupCode(ctx context.Context, userId ObjectId, redirectURI string, outbox ...OutboxMessage) (string, error)
+	ResetPassword(ctx context.Context, code string, newPasswordHash string) error
+	SetPassword(ctx context.Context, userId ObjectId, passwordHash string) error
+	SetEmailChange(ctx context.Context, userId ObjectId, newEmail string, outbox ...OutboxMessage) (string, string, error)
+	ConfirmEmailChange(ctx context.Context, code string, outbox ...OutboxMessage) error
+	CancelEmailChange(ctx context.Context, code string) error
+	ChangePassword(ctx context.Context, userId ObjectId, passwordHash string, outbox ...OutboxMessage) error
+	GetVerification(ctx context.Context, userId ObjectId, verificationType VerificationType) (string, error)
+	GetVerifications(ctx context.Context, userId ObjectId) ([]Verification, error)
+	GetStatusHistory(ctx context.Context, userId ObjectId) ([]StatusChange, error)
+	AddWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error
+	GetDueWebhookDeliveries(ctx context.Context, before time.Time, limit int) ([]WebhookDelivery, error)
+	UpdateWebhookDelivery(ctx context.Context, d WebhookDelivery) error
+	AddOutboxMessages(ctx context.Context, messages ...OutboxMessage) error
+	GetDueOutboxMessages(ctx context.Context, before time.Time, limit int) ([]OutboxMessage, error)
+	UpdateOutboxMessage(ctx context.Context, m OutboxMessage) error
+	GetWebhookDeliveries(ctx context.Context, f WebhookFilter) ([]WebhookDelivery, error)
+	AddAuditEvent(ctx context.Context, e AuditEvent) error
+	GetAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error)
+	SetReportCode(ctx context.Context, userId ObjectId, outbox ...OutboxMessage) (string, error)
+	ReportLogin(ctx context.Context, code string) (ObjectId, error)
+	GetKnownDevices(ctx context.Context, userId ObjectId) ([]KnownDevice, error)
+	AddKnownDevice(ctx context.Context, d KnownDevice) error
+	AddSession(ctx context.Context, s Session, expiredBefore time.Time) error
+	GetSession(ctx context.Context, sessionId ObjectId) (Session, error)
+	GetSessions(ctx context.Context, userId ObjectId) ([]Session, error)
+	TouchSession(ctx context.Context, sessionId ObjectId, at time.Time) error
+	RotateSession(ctx context.Context, sessionId ObjectId, generation int, at time.Time) (int, error)
+	DeleteSession(ctx context.Context, userId ObjectId, sessionId ObjectId) error
+	DeleteOtherSessions(ctx context.Context, userId ObjectId, keep ObjectId) error
+	GetLoginFailure(ctx context.Context, kind LoginFailureKind, name string) (LoginFailure, error)
+	AddLoginFailure(ctx context.Context, kind LoginFailureKind, name string, at time.Time, resetBefore time.Time) (LoginFailure, error)
+	LockLogin(ctx context.Context, kind LoginFailureKind, name string, until time.Time) error
+	ClearLoginFailure(ctx context.Context, kind LoginFailureKind, name string) error
+	UpdateProfile(ctx context.Context, userId ObjectId, p Profile, userMetadata json.RawMessage, at time.Time) error
+	SetAppMetadata(ctx context.Context, userId ObjectId, appMetadata json.RawMessage, at time.Time) error
+	SetLastLogin(ctx context.Context, userId ObjectId, at time.Time) error
+	ScheduleDeletion(ctx context.Context, userId ObjectId, at time.Time) error
+	CancelDeletion(ctx context.Context, userId ObjectId) error
+	GetDueDeletions(ctx context.Context, before time.Time, limit int) ([]User, error)
+	PurgeUser(ctx context.Context, userId ObjectId, before time.Time, outbox ...OutboxMessage) error
+}
+
+var (
+	_ storage = &Database{}
+	_ storage = &Memory{}
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storageSuite(t, NewMemory())
+}
+
+func TestDatabaseStorage(t *testing.T) {
+	requireDatabase(t)
+	storageSuite(t, db)
+}
+
+func storageSuite(t *testing.T, s storage) {
+	tests := []struct {
+		name string
+		fn   func(s storage)
+	}{
+		{"users", testStorageUsers},
+		{"verify", testStorageVerify},
+		{"recovery", testStorageRecovery},
+		{"email change", testStorageEmailChange},
+		{"deletion", testStorageDeletion},
+		{"status history", testStorageStatusHistory},
+		{"profile", testStorageProfile},
+		{"sessions", testStorageSessions},
+		{"known devices", testStorageKnownDevices},
+		{"report login", testStorageReportLogin},
+		{"audit events", testStorageAuditEvents},
+		{"webhook deliveries", testStorageWebhookDeliveries},
+		{"outbox", testStorageOutbox},
+		{"clear", testStorageClear},
+		{"login failures", testStorageLoginFailures},
+		{"context", testStorageContext},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			RegisterTestingT(t)
+			Expect(s.Clear(ctx, true)).To(BeNil())
+			test.fn(s)
+		})
+	}
+}
+
+func testStorageUsers(s storage) {
+	id, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+
+	u, err := s.GetUser(ctx, "storageUser1")
+	Expect(err).To(BeNil())
+	Expect(u.Id).To(Equal(id))
+	Expect(u.Email).To(Equal("storageUser1"))
+	Expect(u.Status).To(Equal(UserStatusActive))
+	Expect(u.Password).To(Equal("12345678"))
+
+	Expect(s.SetPassword(ctx, id, "87654321")).To(BeNil())
+	u, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(BeNil())
+	Expect(u.Password).To(Equal("87654321"))
+	Expect(u.TokenVersion).To(Equal(0))
+
+	Expect(s.ChangePassword(ctx, id, "12345678")).To(BeNil())
+	u, err = s.GetUserById(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(u.Email).To(Equal("storageUser1"))
+	Expect(u.Password).To(Equal("12345678"))
+	Expect(u.TokenVersion).To(Equal(1))
+	Expect(s.ChangePassword(ctx, NewObjectId(), "12345678")).To(Equal(ErrNotFound))
+	_, err = s.GetUserById(ctx, NewObjectId())
+	Expect(err).To(Equal(ErrNotFound))
+
+	// active users have no signup code
+	_, err = s.GetVerification(ctx, id, VerificationTypeSignup)
+	Expect(err).To(Equal(ErrNotFound))
+
+	_, err = s.GetUser(ctx, "storageUser2")
+	Expect(err).To(Equal(ErrNotFound))
+
+	_, _, err = s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "87654321", Status: UserStatusActive})
+	Expect(err).To(Equal(ErrDuplicateEntry))
+
+	Expect(s.DeleteUser(ctx, "storageUser1")).To(BeNil())
+	_, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(Equal(ErrNotFound))
+	Expect(s.DeleteUser(ctx, "storageUser1")).To(Equal(ErrNotFound))
+}
+
+func testStorageVerify(s storage) {
+	id, code, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusPending})
+	Expect(err).To(BeNil())
+
+	stored, err := s.GetVerification(ctx, id, VerificationTypeSignup)
+	Expect(err).To(BeNil())
+	Expect(stored).To(Equal(code))
+
+	u, err := s.GetUserByCode(ctx, code, VerificationTypeSignup)
+	Expect(err).To(BeNil())
+	Expect(u.Id).To(Equal(id))
+	Expect(u.Email).To(Equal("storageUser1"))
+	_, err = s.GetUserByCode(ctx, code, VerificationTypeRecover)
+	Expect(err).To(Equal(ErrNotFound))
+
+	// a signup code cannot be used for recovery
+	Expect(s.ResetPassword(ctx, code, "87654321")).NotTo(BeNil())
+
+	// a new signup code replaces the old one
+	oldCode := code
+	code, err = s.SetSignupCode(ctx, id, "https://app.example.com/verified")
+	Expect(err).To(BeNil())
+	Expect(code).NotTo(Equal(oldCode))
+	Expect(s.Verify(ctx, oldCode)).To(Equal(ErrNotFound))
+	verifications, err := s.GetVerifications(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(verifications).To(ConsistOf(Verification{Code: code, Type: VerificationTypeSignup, Value: "https://app.example.com/verified"}))
+	_, err = s.SetSignupCode(ctx, NewObjectId(), "")
+	Expect(err).To(Equal(ErrNotFound))
+
+	Expect(s.Verify(ctx, code)).To(BeNil())
+	u, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(BeNil())
+	Expect(u.Status).To(Equal(UserStatusActive))
+
+	// codes are single use
+	Expect(s.Verify(ctx, code)).To(Equal(ErrNotFound))
+	_, err = s.GetUserByCode(ctx, code, VerificationTypeSignup)
+	Expect(err).To(Equal(ErrNotFound))
+	_, err = s.GetVerification(ctx, id, VerificationTypeSignup)
+	Expect(err).To(Equal(ErrNotFound))
+
+	// verified users get no new codes
+	_, err = s.SetSignupCode(ctx, id, "")
+	Expect(err).To(Equal(ErrInvalid))
+}
+
+func testStorageRecovery(s storage) {
+	id, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+
+	code1, err := s.SetRecoveryCode(ctx, id)
+	Expect(err).To(BeNil())
+	code2, err := s.SetRecoveryCode(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(code2).NotTo(Equal(code1))
+
+	// a new code replaces the previous one
+	stored, err := s.GetVerification(ctx, id, VerificationTypeRecover)
+	Expect(err).To(BeNil())
+	Expect(stored).To(Equal(code2))
+	Expect(s.ResetPassword(ctx, code1, "87654321")).To(Equal(ErrNotFound))
+
+	// a recovery code cannot be used for signup verification
+	Expect(s.Verify(ctx, code2)).NotTo(BeNil())
+
+	Expect(s.ResetPassword(ctx, code2, "87654321")).To(BeNil())
+	u, err := s.GetUser(ctx, "storageUser1")
+	Expect(err).To(BeNil())
+	Expect(u.Password).To(Equal("87654321"))
+	Expect(s.ResetPassword(ctx, code2, "87654321")).To(Equal(ErrNotFound))
+
+	_, err = s.SetRecoveryCode(ctx, NewObjectId())
+	Expect(err).To(Equal(ErrInvalid))
+}
+
+func testStorageEmailChange(s storage) {
+	id, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	_, _, err = s.AddUser(ctx, NewUser{Email: "storageUser2", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+
+	// cancelling drops the pending change
+	confirmCode, cancelCode, err := s.SetEmailChange(ctx, id, "storageUser3")
+	Expect(err).To(BeNil())
+	Expect(confirmCode).NotTo(Equal(cancelCode))
+	Expect(s.ConfirmEmailChange(ctx, cancelCode)).NotTo(BeNil())
+	Expect(s.CancelEmailChange(ctx, cancelCode)).To(BeNil())
+	Expect(s.ConfirmEmailChange(ctx, confirmCode)).To(Equal(ErrNotFound))
+	_, err = s.GetVerification(ctx, id, VerificationTypeChangeEmail)
+	Expect(err).To(Equal(ErrNotFound))
+
+	// addresses taken after the request are rejected on confirmation
+	confirmCode, _, err = s.SetEmailChange(ctx, id, "storageUser2")
+	Expect(err).To(BeNil())
+	Expect(s.ConfirmEmailChange(ctx, confirmCode)).To(Equal(ErrDuplicateEntry))
+
+	// a new request replaces the pending one
+	_, oldCancelCode, err := s.SetEmailChange(ctx, id, "storageUser4")
+	Expect(err).To(BeNil())
+	confirmCode, cancelCode, err = s.SetEmailChange(ctx, id, "storageUser3")
+	Expect(err).To(BeNil())
+	verifications, err := s.GetVerifications(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(verifications).To(ConsistOf(
+		Verification{Code: confirmCode, Type: VerificationTypeChangeEmail, Value: "storageUser3"},
+		Verification{Code: cancelCode, Type: VerificationTypeCancelEmail},
+	))
+	Expect(s.CancelEmailChange(ctx, oldCancelCode)).To(Equal(ErrNotFound))
+	Expect(s.ConfirmEmailChange(ctx, confirmCode)).To(BeNil())
+	u, err := s.GetUserById(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(u.Email).To(Equal("storageUser3"))
+	Expect(u.TokenVersion).To(Equal(1))
+	_, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(Equal(ErrNotFound))
+
+	// both codes are used up
+	_, err = s.GetVerification(ctx, id, VerificationTypeChangeEmail)
+	Expect(err).To(Equal(ErrNotFound))
+	_, err = s.GetVerification(ctx, id, VerificationTypeCancelEmail)
+	Expect(err).To(Equal(ErrNotFound))
+
+	// a code used concurrently is applied once
+	confirmCode, _, err = s.SetEmailChange(ctx, id, "storageUser5")
+	Expect(err).To(BeNil())
+	results := make(chan error, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() { results <- s.ConfirmEmailChange(ctx, confirmCode) }()
+	}
+	applied := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			applied++
+		} else {
+			Expect(err).To(Equal(ErrNotFound))
+		}
+	}
+	Expect(applied).To(Equal(1))
+	u, err = s.GetUserById(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(u.TokenVersion).To(Equal(2))
+}
+
+func testStorageDeletion(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	id1, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	id2, _, err := s.AddUser(ctx, NewUser{Email: "storageUser2", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	id3, _, err := s.AddUser(ctx, NewUser{Email: "storageUser3", Password: "12345678", Status: UserStatusPending})
+	Expect(err).To(BeNil())
+
+	Expect(s.ScheduleDeletion(ctx, id1, now.Add(time.Hour))).To(BeNil())
+	Expect(s.ScheduleDeletion(ctx, id2, now.Add(2*time.Hour))).To(BeNil())
+	// only active users can be scheduled
+	Expect(s.ScheduleDeletion(ctx, id3, now)).To(Equal(ErrNotFound))
+	Expect(s.ScheduleDeletion(ctx, id1, now)).To(Equal(ErrNotFound))
+	u, err := s.GetUserById(ctx, id1)
+	Expect(err).To(BeNil())
+	Expect(u.Status).To(Equal(UserStatusDeleting))
+	Expect(u.DeleteAt).To(Equal(now.Add(time.Hour)))
+	Expect(u.TokenVersion).To(Equal(1))
+
+	users, err := s.GetDueDeletions(ctx, now, 10)
+	Expect(err).To(BeNil())
+	Expect(users).To(BeEmpty())
+	users, err = s.GetDueDeletions(ctx, now.Add(3*time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(2))
+	Expect(users[0].Id).To(Equal(id1))
+	Expect(users[1].Id).To(Equal(id2))
+	users, err = s.GetDueDeletions(ctx, now.Add(3*time.Hour), 1)
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(1))
+
+	Expect(s.CancelDeletion(ctx, id2)).To(BeNil())
+	Expect(s.CancelDeletion(ctx, id2)).To(Equal(ErrNotFound))
+	u, err = s.GetUserById(ctx, id2)
+	Expect(err).To(BeNil())
+	Expect(u.Status).To(Equal(UserStatusActive))
+	Expect(u.DeleteAt.IsZero()).To(BeTrue())
+
+	// not due yet, or cancelled
+	Expect(s.PurgeUser(ctx, id1, now)).To(Equal(ErrNotFound))
+	Expect(s.PurgeUser(ctx, id2, now.Add(3*time.Hour))).To(Equal(ErrNotFound))
+	Expect(s.PurgeUser(ctx, id1, now.Add(3*time.Hour))).To(BeNil())
+	_, err = s.GetUserById(ctx, id1)
+	Expect(err).To(Equal(ErrNotFound))
+	_, err = s.GetUserById(ctx, id2)
+	Expect(err).To(BeNil())
+}
+
+func testStorageStatusHistory(s storage) {
+	before := time.Now().UTC().Truncate(time.Second)
+	id, code, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusPending})
+	Expect(err).To(BeNil())
+	other, _, err := s.AddUser(ctx, NewUser{Email: "storageUser2", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	Expect(s.Verify(ctx, code)).To(BeNil())
+	Expect(s.ScheduleDeletion(ctx, id, before.Add(time.Hour))).To(BeNil())
+	Expect(s.CancelDeletion(ctx, id)).To(BeNil())
+	// failed transitions are not recorded
+	Expect(s.CancelDeletion(ctx, id)).To(Equal(ErrNotFound))
+
+	changes, err := s.GetStatusHistory(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(changes).To(HaveLen(4))
+	var statuses []UserStatus
+	for _, c := range changes {
+		Expect(c.At).NotTo(BeTemporally("<", before))
+		statuses = append(statuses, c.Status)
+	}
+	Expect(statuses).To(Equal([]UserStatus{UserStatusPending, UserStatusActive, UserStatusDeleting, UserStatusActive}))
+	changes, err = s.GetStatusHistory(ctx, other)
+	Expect(err).To(BeNil())
+	Expect(changes).To(HaveLen(1))
+	Expect(changes[0].Status).To(Equal(UserStatusActive))
+
+	// the history goes with the user
+	Expect(s.ScheduleDeletion(ctx, id, before)).To(BeNil())
+	Expect(s.PurgeUser(ctx, id, before.Add(time.Hour))).To(BeNil())
+	changes, err = s.GetStatusHistory(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(changes).To(BeEmpty())
+}
+
+func testStorageProfile(s storage) {
+	before := time.Now().UTC().Truncate(time.Second)
+	id, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	u, err := s.GetUserById(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(u.Profile).To(Equal(Profile{}))
+	Expect(u.CreatedAt).To(BeTemporally(">=", before))
+	Expect(u.UpdatedAt).To(Equal(u.CreatedAt))
+	Expect(u.LastLogin.IsZero()).To(BeTrue())
+	Expect(u.AppMetadata).To(BeEmpty())
+	Expect(u.UserMetadata).To(BeEmpty())
+
+	at := time.Date(2030, 1, 2, 3, 4, 5, 600, time.UTC)
+	p := Profile{DisplayName: "User One", Locale: "en-US", Timezone: "Europe/Berlin", AvatarURL: "https://example.com/a.png"}
+	Expect(s.UpdateProfile(ctx, id, p, json.RawMessage(`{"theme": "dark"}`), at)).To(BeNil())
+	// writing unchanged values is not a missing user
+	Expect(s.UpdateProfile(ctx, id, p, json.RawMessage(`{"theme": "dark"}`), at)).To(BeNil())
+	Expect(s.SetAppMetadata(ctx, id, json.RawMessage(`{"roles": ["admin"]}`), at.Add(time.Hour))).To(BeNil())
+	Expect(s.SetLastLogin(ctx, id, at)).To(BeNil())
+	u, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(BeNil())
+	Expect(u.Profile).To(Equal(p))
+	Expect(u.UserMetadata).To(MatchJSON(`{"theme": "dark"}`))
+	Expect(u.AppMetadata).To(MatchJSON(`{"roles": ["admin"]}`))
+	Expect(u.UpdatedAt).To(Equal(at.Add(time.Hour).Truncate(time.Second)))
+	Expect(u.LastLogin).To(Equal(at.Truncate(time.Second)))
+
+	Expect(s.UpdateProfile(ctx, id, Profile{}, nil, at)).To(BeNil())
+	u, err = s.GetUserById(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(u.Profile).To(Equal(Profile{}))
+	Expect(u.UserMetadata).To(BeEmpty())
+
+	Expect(s.UpdateProfile(ctx, NewObjectId(), p, nil, at)).To(Equal(ErrNotFound))
+	Expect(s.SetAppMetadata(ctx, NewObjectId(), nil, at)).To(Equal(ErrNotFound))
+}
+
+func testStorageSessions(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	id1, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	id2, _, err := s.AddUser(ctx, NewUser{Email: "storageUser2", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+
+	newSession := func(userId ObjectId, at time.Time) Session {
+		session := Session{Id: NewObjectId(), UserId: userId, UserAgent: "test", IP: "1.1.1.1", CreatedAt: at, LastSeen: at}
+		Expect(s.AddSession(ctx, session, now.Add(-time.Hour))).To(BeNil())
+		return session
+	}
+	old := newSession(id1, now.Add(-2*time.Hour))
+	s1 := newSession(id1, now.Add(-time.Minute))
+	s2 := newSession(id1, now)
+	s3 := newSession(id2, now)
+	Expect(s.AddSession(ctx, Session{Id: NewObjectId(), UserId: NewObjectId(), CreatedAt: now, LastSeen: now}, now)).To(Equal(ErrInvalid))
+
+	// expired sessions are dropped when the user logs in again
+	_, err = s.GetSession(ctx, old.Id)
+	Expect(err).To(Equal(ErrNotFound))
+	stored, err := s.GetSession(ctx, s1.Id)
+	Expect(err).To(BeNil())
+	Expect(stored).To(Equal(s1))
+	sessions, err := s.GetSessions(ctx, id1)
+	Expect(err).To(BeNil())
+	Expect(sessions).To(Equal([]Session{s1, s2}))
+
+	Expect(s.TouchSession(ctx, s1.Id, now.Add(time.Minute))).To(BeNil())
+	stored, err = s.GetSession(ctx, s1.Id)
+	Expect(err).To(BeNil())
+	Expect(stored.LastSeen).To(Equal(now.Add(time.Minute)))
+
+	// each generation of a session can be rotated only once
+	generation, err := s.RotateSession(ctx, s1.Id, 0, now.Add(2*time.Minute))
+	Expect(err).To(BeNil())
+	Expect(generation).To(Equal(1))
+	_, err = s.RotateSession(ctx, s1.Id, 0, now.Add(2*time.Minute))
+	Expect(err).To(Equal(ErrNotFound))
+	_, err = s.RotateSession(ctx, NewObjectId(), 0, now)
+	Expect(err).To(Equal(ErrNotFound))
+	stored, err = s.GetSession(ctx, s1.Id)
+	Expect(err).To(BeNil())
+	Expect(stored.Generation).To(Equal(1))
+	Expect(stored.LastSeen).To(Equal(now.Add(2 * time.Minute)))
+
+	// sessions of other users cannot be revoked
+	Expect(s.DeleteSession(ctx, id1, s3.Id)).To(Equal(ErrNotFound))
+	Expect(s.DeleteSession(ctx, id1, s1.Id)).To(BeNil())
+	Expect(s.DeleteSession(ctx, id1, s1.Id)).To(Equal(ErrNotFound))
+
+	s4 := newSession(id1, now)
+	Expect(s.DeleteOtherSessions(ctx, id1, s4.Id)).To(BeNil())
+	sessions, err = s.GetSessions(ctx, id1)
+	Expect(err).To(BeNil())
+	Expect(sessions).To(Equal([]Session{s4}))
+	_, err = s.GetSession(ctx, s3.Id)
+	Expect(err).To(BeNil())
+
+	// sessions go away with their user
+	Expect(s.DeleteUser(ctx, "storageUser1")).To(BeNil())
+	_, err = s.GetSession(ctx, s4.Id)
+	Expect(err).To(Equal(ErrNotFound))
+}
+
+func testStorageKnownDevices(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	id, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	devices, err := s.GetKnownDevices(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(devices).To(BeEmpty())
+
+	d1 := KnownDevice{UserId: id, Fingerprint: "f1", Network: "1.1.1.0/24", FirstSeen: now, LastSeen: now}
+	d2 := KnownDevice{UserId: id, Fingerprint: "f2", Network: "1.1.1.0/24", FirstSeen: now.Add(time.Minute), LastSeen: now.Add(time.Minute)}
+	Expect(s.AddKnownDevice(ctx, d1)).To(BeNil())
+	Expect(s.AddKnownDevice(ctx, d2)).To(BeNil())
+	// known devices only get a new last seen time
+	later := d1
+	later.FirstSeen = now.Add(time.Hour)
+	later.LastSeen = now.Add(time.Hour)
+	Expect(s.AddKnownDevice(ctx, later)).To(BeNil())
+	d1.LastSeen = later.LastSeen
+
+	devices, err = s.GetKnownDevices(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(devices).To(Equal([]KnownDevice{d1, d2}))
+
+	Expect(s.DeleteUser(ctx, "storageUser1")).To(BeNil())
+	devices, err = s.GetKnownDevices(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(devices).To(BeEmpty())
+}
+
+func testStorageReportLogin(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	id, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).To(BeNil())
+	session := Session{Id: NewObjectId(), UserId: id, UserAgent: "test", IP: "1.1.1.1", CreatedAt: now, LastSeen: now}
+	Expect(s.AddSession(ctx, session, now.Add(-time.Hour))).To(BeNil())
+
+	code, err := s.SetReportCode(ctx, id)
+	Expect(err).To(BeNil())
+	reported, err := s.ReportLogin(ctx, code)
+	Expect(err).To(BeNil())
+	Expect(reported).To(Equal(id))
+
+	user, err := s.GetUserById(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(user.Password).To(BeEmpty())
+	Expect(user.TokenVersion).To(Equal(1))
+	_, err = s.GetSession(ctx, session.Id)
+	Expect(err).To(Equal(ErrNotFound))
+
+	// codes are single use
+	_, err = s.ReportLogin(ctx, code)
+	Expect(err).To(Equal(ErrNotFound))
+}
+
+func testStorageAuditEvents(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, e := range []AuditEvent{
+		{Type: "login_failure", Target: "user1", IP: "1.1.1.1", Detail: "password_mismatch", At: now.Add(-time.Hour)},
+		{Type: "login_success", Actor: "id1", Target: "id1", IP: "1.1.1.1", UserAgent: "test", RequestId: "r1", At: now.Add(-time.Minute)},
+		{Type: "login_success", Actor: "id2", Target: "id2", IP: "2.2.2.2", At: now},
+	} {
+		Expect(s.AddAuditEvent(ctx, e)).To(BeNil(), i)
+	}
+
+	events, err := s.GetAuditEvents(ctx, AuditFilter{Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(events).To(HaveLen(3))
+	Expect(events[0].Actor).To(Equal("id2"))
+	Expect(events[2].Detail).To(Equal("password_mismatch"))
+	Expect(events[1].At).To(Equal(now.Add(-time.Minute)))
+	Expect(events[1].RequestId).To(Equal("r1"))
+
+	// pages continue before the last id
+	events, err = s.GetAuditEvents(ctx, AuditFilter{Limit: 2})
+	Expect(err).To(BeNil())
+	Expect(events).To(HaveLen(2))
+	events, err = s.GetAuditEvents(ctx, AuditFilter{Limit: 2, BeforeId: events[1].Id})
+	Expect(err).To(BeNil())
+	Expect(events).To(HaveLen(1))
+	Expect(events[0].Type).To(Equal("login_failure"))
+
+	for _, c := range []struct {
+		filter AuditFilter
+		count  int
+	}{
+		{AuditFilter{Type: "login_success"}, 2},
+		{AuditFilter{Actor: "id1"}, 1},
+		{AuditFilter{Target: "user1"}, 1},
+		{AuditFilter{IP: "1.1.1.1"}, 2},
+		{AuditFilter{From: now.Add(-time.Minute)}, 2},
+		{AuditFilter{To: now.Add(-time.Minute)}, 1},
+		{AuditFilter{Type: "login_success", IP: "2.2.2.2"}, 1},
+	} {
+		c.filter.Limit = 10
+		events, err = s.GetAuditEvents(ctx, c.filter)
+		Expect(err).To(BeNil())
+		Expect(events).To(HaveLen(c.count), "%+v", c.filter)
+	}
+}
+
+func testStorageOutbox(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	message := func(kind string, next time.Time) OutboxMessage {
+		return OutboxMessage{
+			Kind:        kind,
+			Payload:     json.RawMessage(`{"kind":"` + kind + `"}`),
+			Status:      OutboxPending,
+			NextAttempt: next,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+	}
+	userId := NewObjectId()
+	id, _, err := s.AddUser(ctx, NewUser{Id: userId, Email: "storageUser1", Password: "12345678", Status: UserStatusPending},
+		message("signup1", now), message("signup2", now.Add(-time.Minute)))
+	Expect(err).To(BeNil())
+	Expect(id).To(Equal(userId))
+	_, err = s.SetRecoveryCode(ctx, id, message("recover", now.Add(time.Hour)))
+	Expect(err).To(BeNil())
+
+	// messages of failed changes are not stored
+	_, _, err = s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusPending}, message("duplicate", now))
+	Expect(err).To(Equal(ErrDuplicateEntry))
+	_, err = s.SetRecoveryCode(ctx, NewObjectId(), message("unknown", now))
+	Expect(err).NotTo(BeNil())
+	_, _, err = s.SetEmailChange(ctx, NewObjectId(), "storageUser2", message("unknown", now))
+	Expect(err).NotTo(BeNil())
+	_, err = s.SetReportCode(ctx, NewObjectId(), message("unknown", now))
+	Expect(err).NotTo(BeNil())
+
+	due, err := s.GetDueOutboxMessages(ctx, now, 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(2))
+	Expect(due[0].Kind).To(Equal("signup2"))
+	Expect(due[1].Kind).To(Equal("signup1"))
+	Expect(due[1].Payload).To(MatchJSON(`{"kind":"signup1"}`))
+	Expect(due[1].Status).To(Equal(OutboxPending))
+
+	sent := due[0]
+	sent.Status = OutboxSent
+	sent.Attempts = 1
+	sent.UpdatedAt = now
+	Expect(s.UpdateOutboxMessage(ctx, sent)).To(BeNil())
+	retry := due[1]
+	retry.Attempts = 1
+	retry.NextAttempt = now.Add(time.Minute)
+	retry.LastError = "connection refused"
+	Expect(s.UpdateOutboxMessage(ctx, retry)).To(BeNil())
+
+	due, err = s.GetDueOutboxMessages(ctx, now.Add(2*time.Hour), 1)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(1))
+	Expect(due[0].Kind).To(Equal("signup1"))
+	Expect(due[0].Attempts).To(Equal(1))
+	Expect(due[0].LastError).To(Equal("connection refused"))
+	due, err = s.GetDueOutboxMessages(ctx, now.Add(2*time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(2))
+	Expect(due[1].Kind).To(Equal("recover"))
+
+	_, _, err = s.SetEmailChange(ctx, id, "storageUser2", message("email_change", now.Add(3*time.Hour)))
+	Expect(err).To(BeNil())
+	due, err = s.GetDueOutboxMessages(ctx, now.Add(3*time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(3))
+	Expect(due[2].Kind).To(Equal("email_change"))
+
+	_, err = s.SetReportCode(ctx, id, message("report", now.Add(4*time.Hour)))
+	Expect(err).To(BeNil())
+	due, err = s.GetDueOutboxMessages(ctx, now.Add(4*time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(4))
+	Expect(due[3].Kind).To(Equal("report"))
+
+	Expect(s.ChangePassword(ctx, id, "87654321", message("password_changed", now.Add(5*time.Hour)))).To(BeNil())
+	Expect(s.ChangePassword(ctx, NewObjectId(), "87654321", message("unknown", now))).NotTo(BeNil())
+	due, err = s.GetDueOutboxMessages(ctx, now.Add(5*time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(5))
+	Expect(due[4].Kind).To(Equal("password_changed"))
+
+	signupCode, err := s.GetVerification(ctx, id, VerificationTypeSignup)
+	Expect(err).To(BeNil())
+	Expect(s.Verify(ctx, "invalid", message("unknown", now))).To(Equal(ErrNotFound))
+	Expect(s.Verify(ctx, signupCode, message("verified", now.Add(6*time.Hour)))).To(BeNil())
+	confirmCode, err := s.GetVerification(ctx, id, VerificationTypeChangeEmail)
+	Expect(err).To(BeNil())
+	Expect(s.ConfirmEmailChange(ctx, confirmCode, message("email_changed", now.Add(7*time.Hour)))).To(BeNil())
+	due, err = s.GetDueOutboxMessages(ctx, now.Add(7*time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(7))
+	Expect(due[5].Kind).To(Equal("verified"))
+	Expect(due[6].Kind).To(Equal("email_changed"))
+
+	Expect(s.ScheduleDeletion(ctx, id, now.Add(8*time.Hour))).To(BeNil())
+	Expect(s.PurgeUser(ctx, id, now, message("unknown", now))).To(Equal(ErrNotFound))
+	Expect(s.PurgeUser(ctx, id, now.Add(8*time.Hour), message("deleted", now.Add(8*time.Hour)))).To(BeNil())
+	due, err = s.GetDueOutboxMessages(ctx, now.Add(8*time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(8))
+	Expect(due[7].Kind).To(Equal("deleted"))
+
+	Expect(s.AddOutboxMessages(ctx, message("standalone", now.Add(-time.Hour)))).To(BeNil())
+	due, err = s.GetDueOutboxMessages(ctx, now, 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(1))
+	Expect(due[0].Kind).To(Equal("standalone"))
+
+	Expect(s.UpdateOutboxMessage(ctx, OutboxMessage{Id: 1 << 40, UpdatedAt: now})).To(Equal(ErrNotFound))
+}
+
+func testStorageWebhookDeliveries(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	eventId := NewObjectId()
+	delivery := func(endpoint string, next time.Time) WebhookDelivery {
+		return WebhookDelivery{
+			EventId:     eventId,
+			Endpoint:    endpoint,
+			Event:       "user.created",
+			Payload:     json.RawMessage(`{"type":"user.created"}`),
+			Status:      WebhookPending,
+			NextAttempt: next,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+	}
+	Expect(s.AddWebhookDeliveries(ctx, []WebhookDelivery{
+		delivery("endpoint1", now),
+		delivery("endpoint2", now.Add(-time.Minute)),
+		delivery("endpoint3", now.Add(time.Hour)),
+	})).To(BeNil())
+	// an event is queued once per endpoint
+	Expect(s.AddWebhookDeliveries(ctx, []WebhookDelivery{
+		delivery("endpoint1", now),
+		delivery("endpoint3", now.Add(time.Hour)),
+	})).To(BeNil())
+
+	due, err := s.GetDueWebhookDeliveries(ctx, now, 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(2))
+	Expect(due[0].Endpoint).To(Equal("endpoint2"))
+	Expect(due[1].Endpoint).To(Equal("endpoint1"))
+	Expect(due[1].EventId).To(Equal(eventId))
+	Expect(due[1].Payload).To(MatchJSON(`{"type":"user.created"}`))
+	due, err = s.GetDueWebhookDeliveries(ctx, now, 1)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(1))
+
+	failed := due[0]
+	failed.Attempts = 1
+	failed.NextAttempt = now.Add(time.Minute)
+	failed.LastStatus = 500
+	failed.LastError = "internal server error"
+	failed.UpdatedAt = now
+	Expect(s.UpdateWebhookDelivery(ctx, failed)).To(BeNil())
+	due, err = s.GetDueWebhookDeliveries(ctx, now, 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(HaveLen(1))
+	delivered := due[0]
+	delivered.Status = WebhookDelivered
+	delivered.Attempts = 1
+	delivered.LastStatus = 204
+	Expect(s.UpdateWebhookDelivery(ctx, delivered)).To(BeNil())
+	due, err = s.GetDueWebhookDeliveries(ctx, now, 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(BeEmpty())
+	missing := delivered
+	missing.Id = 1 << 40
+	Expect(s.UpdateWebhookDelivery(ctx, missing)).To(Equal(ErrNotFound))
+
+	all, err := s.GetWebhookDeliveries(ctx, WebhookFilter{Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(all).To(HaveLen(3))
+	Expect(all[0].Endpoint).To(Equal("endpoint3"))
+	page, err := s.GetWebhookDeliveries(ctx, WebhookFilter{Limit: 10, BeforeId: all[1].Id})
+	Expect(err).To(BeNil())
+	Expect(page).To(HaveLen(1))
+	Expect(page[0].Endpoint).To(Equal("endpoint1"))
+	filtered, err := s.GetWebhookDeliveries(ctx, WebhookFilter{Limit: 10, Endpoint: "endpoint2"})
+	Expect(err).To(BeNil())
+	Expect(filtered).To(HaveLen(1))
+	Expect(filtered[0]).To(And(
+		HaveField("Attempts", 1),
+		HaveField("LastStatus", 500),
+		HaveField("LastError", "internal server error"),
+		HaveField("NextAttempt", now.Add(time.Minute)),
+	))
+	filtered, err = s.GetWebhookDeliveries(ctx, WebhookFilter{Limit: 10, Status: WebhookDelivered})
+	Expect(err).To(BeNil())
+	Expect(filtered).To(HaveLen(1))
+	Expect(filtered[0].Endpoint).To(Equal("endpoint1"))
+}
+
+func testStorageClear(s storage) {
+	id, _, err := s.AddUser(ctx, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusPending})
+	Expect(err).To(BeNil())
+
+	Expect(s.Clear(ctx, false)).To(BeNil())
+	_, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(BeNil())
+	_, err = s.GetVerification(ctx, id, VerificationTypeSignup)
+	Expect(err).To(Equal(ErrNotFound))
+
+	Expect(s.Clear(ctx, true)).To(BeNil())
+	_, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(Equal(ErrNotFound))
+}
+
+func testStorageLoginFailures(s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	_, err := s.GetLoginFailure(ctx, LoginFailureUser, "storageUser1")
+	Expect(err).To(Equal(ErrNotFound))
+
+	f, err := s.AddLoginFailure(ctx, LoginFailureUser, "storageUser1", now.Add(-time.Minute), now.Add(-time.Hour))
+	Expect(err).To(BeNil())
+	Expect(f.Count).To(Equal(1))
+	f, err = s.AddLoginFailure(ctx, LoginFailureUser, "storageUser1", now, now.Add(-time.Hour))
+	Expect(err).To(BeNil())
+	Expect(f.Count).To(Equal(2))
+	Expect(f.LastFailure).To(BeTemporally("==", now))
+	Expect(f.LockedUntil.IsZero()).To(BeTrue())
+
+	// same name, different kind
+	f, err = s.AddLoginFailure(ctx, LoginFailureIP, "storageUser1", now, now.Add(-time.Hour))
+	Expect(err).To(BeNil())
+	Expect(f.Count).To(Equal(1))
+
+	Expect(s.LockLogin(ctx, LoginFailureUser, "storageUser1", now.Add(time.Hour))).To(BeNil())
+	f, err = s.GetLoginFailure(ctx, LoginFailureUser, "storageUser1")
+	Expect(err).To(BeNil())
+	Expect(f.Count).To(Equal(2))
+	Expect(f.LockedUntil).To(BeTemporally("==", now.Add(time.Hour)))
+
+	// failures before resetBefore are forgotten
+	f, err = s.AddLoginFailure(ctx, LoginFailureUser, "storageUser1", now.Add(time.Minute), now.Add(time.Second))
+	Expect(err).To(BeNil())
+	Expect(f.Count).To(Equal(1))
+
+	Expect(s.ClearLoginFailure(ctx, LoginFailureUser, "storageUser1")).To(BeNil())
+	_, err = s.GetLoginFailure(ctx, LoginFailureUser, "storageUser1")
+	Expect(err).To(Equal(ErrNotFound))
+	_, err = s.GetLoginFailure(ctx, LoginFailureIP, "storageUser1")
+	Expect(err).To(BeNil())
+
+	Expect(s.Clear(ctx, false)).To(BeNil())
+	_, err = s.GetLoginFailure(ctx, LoginFailureIP, "storageUser1")
+	Expect(err).To(Equal(ErrNotFound))
+}
+
+func testStorageContext(s storage) {
+	Expect(s.Health(ctx)).To(BeNil())
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	Expect(s.Health(cancelled)).NotTo(BeNil())
+	_, _, err := s.AddUser(cancelled, NewUser{Email: "storageUser1", Password: "12345678", Status: UserStatusActive})
+	Expect(err).NotTo(BeNil())
+	_, err = s.GetUser(ctx, "storageUser1")
+	Expect(err).To(Equal(ErrNotFound))
+
+	expired, cancel := context.WithTimeout(ctx, -time.Second)
+	defer cancel()
+	_, err = s.GetUser(expired, "storageUser1")
+	Expect(err).To(Equal(ErrTimeout))
+}
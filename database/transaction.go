@@ -1,13 +1,14 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 )
 
-type txFn func(tx *sql.Tx) error
+type txFn func(ctx context.Context, tx *sql.Tx) error
 
-func (db *Database) withTransaction(fn txFn) (err error) {
-	tx, err := db.db.Begin()
+func (db *Database) withTransaction(ctx context.Context, fn txFn) (err error) {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -26,6 +27,6 @@ func (db *Database) withTransaction(fn txFn) (err error) {
 		}
 	}()
 
-	err = fn(tx)
+	err = fn(ctx, tx)
 	return err
 }
@@ -1,7 +1,9 @@
 package database
 
 import (
+	"encoding/json"
 	"github.com/google/uuid"
+	"time"
 )
 
 type ObjectId string
@@ -14,33 +16,199 @@ func NewObjectId() ObjectId {
 
 type UserStatus string
 
+// User is a stored user. TokenVersion is embedded in issued tokens and
+// changes whenever they have to be revoked. DeleteAt is set while the user
+// is in the deleting status. UpdatedAt is the time of the last change to the
+// profile or metadata. AppMetadata is only writable by admins, UserMetadata
+// by the user, both are json objects or empty.
 type User struct {
-	Id       ObjectId
-	Email    string
-	Password string
-	Status   UserStatus
+	Id           ObjectId
+	Email        string
+	Password     string
+	Status       UserStatus
+	TokenVersion int
+	DeleteAt     time.Time
+	Profile      Profile
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	LastLogin    time.Time
+	AppMetadata  json.RawMessage
+	UserMetadata json.RawMessage
+}
+
+// Profile holds the attributes users maintain themselves.
+type Profile struct {
+	DisplayName string
+	Locale      string
+	Timezone    string
+	AvatarURL   string
 }
 
 const (
 	UserStatusActive   UserStatus = "active"
 	UserStatusDisabled UserStatus = "disabled"
 	UserStatusPending  UserStatus = "pending"
+	UserStatusDeleting UserStatus = "deleting"
 )
 
+// NewUser is a user to be added, Password is the hash of the user's password.
+// NewUser is a user to be added, Id is generated if it is empty.
+// RedirectURI is kept with the signup code of pending users, for where to
+// send them once verified.
 type NewUser struct {
-	Email    string
-	Password string
-	Status   UserStatus
+	Id          ObjectId
+	Email       string
+	Password    string
+	Status      UserStatus
+	RedirectURI string
 }
 
 type VerificationType string
 
 const (
-	VerificationTypeSignup  VerificationType = "signup"
-	VerificationTypeRecover VerificationType = "recover"
+	VerificationTypeSignup      VerificationType = "signup"
+	VerificationTypeRecover     VerificationType = "recover"
+	VerificationTypeChangeEmail VerificationType = "change_email"
+	VerificationTypeCancelEmail VerificationType = "cancel_email"
+	VerificationTypeReportLogin VerificationType = "report_login"
 )
 
+// Verification is a single use code mailed to a user. Value holds data the
+// verified action needs, e.g. the new address of an email change.
 type Verification struct {
-	Code string
-	Type VerificationType
+	Code  string
+	Type  VerificationType
+	Value string
+}
+
+// Session is a login of a user. tokens refreshed from the login keep its
+// Id, so it also identifies the token family. Generation counts the refreshes,
+// only tokens of the current generation are accepted. LastSeen is updated
+// lazily.
+type Session struct {
+	Id         ObjectId
+	UserId     ObjectId
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeen   time.Time
+	Generation int
+}
+
+// KnownDevice is a device and network a user logged in from before.
+// Fingerprint identifies the client software, Network the address range.
+type KnownDevice struct {
+	UserId      ObjectId
+	Fingerprint string
+	Network     string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+}
+
+// StatusChange records a user entering Status, starting with the status the
+// user was created with.
+type StatusChange struct {
+	Status UserStatus
+	At     time.Time
+}
+
+// AuditEvent is a recorded security event. Actor is who caused it and
+// Target what it applied to, e.g. user ids or an email for unknown users.
+// Ids grow with every event.
+type AuditEvent struct {
+	Id        int64
+	Type      string
+	Actor     string
+	Target    string
+	IP        string
+	UserAgent string
+	RequestId string
+	Detail    string
+	At        time.Time
+}
+
+// AuditFilter selects audit events, empty fields match everything. events
+// are returned newest first, BeforeId continues a previous page.
+type AuditFilter struct {
+	Type     string
+	Actor    string
+	Target   string
+	IP       string
+	From     time.Time
+	To       time.Time
+	BeforeId int64
+	Limit    int
+}
+
+type WebhookStatus string
+
+const (
+	WebhookPending   WebhookStatus = "pending"
+	WebhookDelivered WebhookStatus = "delivered"
+	WebhookFailed    WebhookStatus = "failed"
+)
+
+// WebhookDelivery is an event queued for one webhook endpoint. Payload is
+// the exact body that is signed and sent on every attempt, EventId is shared
+// by the deliveries of the same event to different endpoints.
+type WebhookDelivery struct {
+	Id          int64
+	EventId     ObjectId
+	Endpoint    string
+	Event       string
+	Payload     json.RawMessage
+	Status      WebhookStatus
+	Attempts    int
+	NextAttempt time.Time
+	LastStatus  int
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// WebhookFilter selects webhook deliveries, empty fields match everything.
+// deliveries are returned newest first, BeforeId continues a previous page.
+type WebhookFilter struct {
+	Endpoint string
+	Status   WebhookStatus
+	BeforeId int64
+	Limit    int
+}
+
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSent    OutboxStatus = "sent"
+	OutboxFailed  OutboxStatus = "failed"
+)
+
+// OutboxMessage is a side effect of a change, like an email, that is stored
+// in the same transaction as the change and carried out afterwards. Kind
+// tells the dispatcher how to read Payload.
+type OutboxMessage struct {
+	Id          int64
+	Kind        string
+	Payload     json.RawMessage
+	Status      OutboxStatus
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type LoginFailureKind string
+
+const (
+	LoginFailureUser LoginFailureKind = "user"
+	LoginFailureIP   LoginFailureKind = "ip"
+)
+
+type LoginFailure struct {
+	Kind        LoginFailureKind
+	Name        string
+	Count       int
+	LastFailure time.Time
+	LockedUntil time.Time
 }
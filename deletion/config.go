@@ -0,0 +1,31 @@
+package deletion
+
+// Config controls self-service account deletion. GracePeriod is how long a
+// user can still cancel by logging in, the purge job runs every Interval and
+// removes up to BatchSize users per run. durations are in seconds.
+type Config struct {
+	GracePeriod int `json:"grace_period"`
+	Interval    int `json:"interval"`
+	BatchSize   int `json:"batch_size"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		GracePeriod: 30 * 24 * 3600,
+		Interval:    3600,
+		BatchSize:   100,
+	}
+}
+
+// withDefaults fills in the defaults of fields that are not set. a zero
+// grace period is kept, it purges users at the next run.
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.Interval <= 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaults.BatchSize
+	}
+	return c
+}
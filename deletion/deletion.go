@@ -0,0 +1,98 @@
+package deletion
+
+import (
+	"auth/database"
+	"auth/outbox"
+	"auth/webhook"
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"time"
+)
+
+type Storage interface {
+	ScheduleDeletion(ctx context.Context, userId database.ObjectId, at time.Time) error
+	CancelDeletion(ctx context.Context, userId database.ObjectId) error
+	GetDueDeletions(ctx context.Context, before time.Time, limit int) ([]database.User, error)
+	PurgeUser(ctx context.Context, userId database.ObjectId, before time.Time, outbox ...database.OutboxMessage) error
+}
+
+// Scheduler puts users into the deleting status and purges them once their
+// grace period is over.
+type Scheduler struct {
+	db     Storage
+	outbox *outbox.Dispatcher
+	config Config
+	now    func() time.Time
+}
+
+// New creates a scheduler, a nil config gives the defaults.
+func New(config *Config, db Storage, outbox *outbox.Dispatcher) *Scheduler {
+	s := &Scheduler{
+		db:     db,
+		outbox: outbox,
+		config: DefaultConfig(),
+		now:    time.Now,
+	}
+	if config != nil {
+		s.config = config.withDefaults()
+	}
+	return s
+}
+
+// Schedule starts the grace period of a user and returns when the user will
+// be deleted.
+func (s *Scheduler) Schedule(ctx context.Context, userId database.ObjectId) (time.Time, error) {
+	at := s.now().Add(time.Duration(s.config.GracePeriod) * time.Second)
+	return at, s.db.ScheduleDeletion(ctx, userId, at)
+}
+
+func (s *Scheduler) Cancel(ctx context.Context, userId database.ObjectId) error {
+	return s.db.CancelDeletion(ctx, userId)
+}
+
+// Run purges due users every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.config.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Purge(ctx); err != nil && ctx.Err() == nil {
+			zap.L().Error("purging deleted users failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge deletes one batch of users whose grace period is over, it returns
+// the number of deleted users. the account deleted mail and the user.deleted
+// event are queued in the outbox along with the deletion.
+func (s *Scheduler) Purge(ctx context.Context) (int, error) {
+	now := s.now()
+	users, err := s.db.GetDueDeletions(ctx, now, s.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, u := range users {
+		event, err := s.outbox.Event(webhook.EventUserDeleted, webhook.User{Id: u.Id, Email: u.Email})
+		if err != nil {
+			return deleted, err
+		}
+		err = s.db.PurgeUser(ctx, u.Id, now, s.outbox.Mail(outbox.KindAccountDeleted, u.Id, u.Email), event)
+		if errors.Is(err, database.ErrNotFound) {
+			// cancelled in the meantime
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+		s.outbox.Notify()
+		zap.L().Info("user deleted", zap.String("user", string(u.Id)))
+	}
+	return deleted, nil
+}
@@ -0,0 +1,83 @@
+package deletion
+
+import (
+	"auth/database"
+	"auth/mailer"
+	"auth/outbox"
+	"auth/webhook"
+	"context"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	db := database.NewMemory()
+	var notified []string
+	m := &mailer.Mock{
+		SendAccountDeletedFunc: func(toName string, toEmail string) error {
+			notified = append(notified, toEmail)
+			return nil
+		},
+	}
+	webhooks := webhook.New(&webhook.Config{Endpoints: []webhook.Endpoint{{Name: "test", URL: "http://localhost"}}}, db)
+	o := outbox.New(&outbox.Config{BatchSize: 10}, db, m, webhooks)
+	s := New(&Config{GracePeriod: 3600, BatchSize: 10}, db, o)
+	s.now = func() time.Time { return now }
+
+	var ids []database.ObjectId
+	for _, email := range []string{"user1@example.com", "user2@example.com", "user3@example.com"} {
+		id, _, err := db.AddUser(ctx, database.NewUser{Email: email, Password: "hash", Status: database.UserStatusActive})
+		Expect(err).To(BeNil())
+		ids = append(ids, id)
+	}
+	at, err := s.Schedule(ctx, ids[0])
+	Expect(err).To(BeNil())
+	Expect(at).To(Equal(now.Add(time.Hour)))
+	_, err = s.Schedule(ctx, ids[1])
+	Expect(err).To(BeNil())
+	Expect(s.Cancel(ctx, ids[1])).To(BeNil())
+
+	// nothing is due during the grace period
+	deleted, err := s.Purge(ctx)
+	Expect(err).To(BeNil())
+	Expect(deleted).To(BeZero())
+
+	now = now.Add(time.Hour)
+	deleted, err = s.Purge(ctx)
+	Expect(err).To(BeNil())
+	Expect(deleted).To(Equal(1))
+	// the mail and the event go out through the outbox
+	Expect(notified).To(BeEmpty())
+	sent, err := o.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(sent).To(Equal(2))
+	Expect(notified).To(Equal([]string{"user1@example.com"}))
+	events, err := db.GetWebhookDeliveries(ctx, database.WebhookFilter{Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(events).To(HaveLen(1))
+	Expect(events[0].Event).To(Equal(webhook.EventUserDeleted))
+	Expect(events[0].Payload).To(ContainSubstring(string(ids[0])))
+	_, err = db.GetUserById(ctx, ids[0])
+	Expect(err).To(Equal(database.ErrNotFound))
+	for _, id := range ids[1:] {
+		u, err := db.GetUserById(ctx, id)
+		Expect(err).To(BeNil())
+		Expect(u.Status).To(Equal(database.UserStatusActive))
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	RegisterTestingT(t)
+	db := database.NewMemory()
+	s := New(&Config{GracePeriod: 0}, db, outbox.New(nil, db, &mailer.Mock{}, webhook.New(nil, db)))
+	Expect(s.config).To(Equal(Config{GracePeriod: 0, Interval: 3600, BatchSize: 100}))
+
+	// a section without an interval must not make the ticker panic
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx)
+}
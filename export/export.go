@@ -0,0 +1,272 @@
+package export
+
+import (
+	"auth/audit"
+	"auth/database"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// Format identifies the layout of an archive, it changes whenever fields are
+// removed or change meaning.
+const Format = "auth-export/1"
+
+type Storage interface {
+	GetUserById(ctx context.Context, userId database.ObjectId) (database.User, error)
+	GetVerifications(ctx context.Context, userId database.ObjectId) ([]database.Verification, error)
+	GetStatusHistory(ctx context.Context, userId database.ObjectId) ([]database.StatusChange, error)
+	GetLoginFailure(ctx context.Context, kind database.LoginFailureKind, name string) (database.LoginFailure, error)
+	GetSessions(ctx context.Context, userId database.ObjectId) ([]database.Session, error)
+	GetAuditEvents(ctx context.Context, f database.AuditFilter) ([]database.AuditEvent, error)
+}
+
+// auditPageSize is the number of audit events read per query.
+const auditPageSize = 500
+
+// verificationEvents are the audit events that make up the verification
+// history.
+var verificationEvents = map[string]bool{
+	string(audit.EventSignup):             true,
+	string(audit.EventVerify):             true,
+	string(audit.EventVerifyResend):       true,
+	string(audit.EventPasswordRecover):    true,
+	string(audit.EventPasswordReset):      true,
+	string(audit.EventEmailChange):        true,
+	string(audit.EventEmailChangeConfirm): true,
+	string(audit.EventEmailChangeCancel):  true,
+	string(audit.EventLoginReport):        true,
+}
+
+// Archive is everything stored about a single user, in a form meant to be
+// handed out to the user. secrets like the password hash and verification
+// codes are left out.
+type Archive struct {
+	Format              string              `json:"format"`
+	GeneratedAt         time.Time           `json:"generated_at"`
+	Profile             Profile             `json:"profile"`
+	StatusHistory       []StatusChange      `json:"status_history"`
+	Verifications       []Verification      `json:"pending_verifications"`
+	VerificationHistory []VerificationEvent `json:"verification_history"`
+	Sessions            []Session           `json:"sessions"`
+	LoginFailures       *LoginFailures      `json:"login_failures,omitempty"`
+	AuditEvents         []AuditEvent        `json:"audit_events"`
+}
+
+type Profile struct {
+	Id           database.ObjectId   `json:"id"`
+	Email        string              `json:"email"`
+	Status       database.UserStatus `json:"status"`
+	DisplayName  string              `json:"display_name,omitempty"`
+	Locale       string              `json:"locale,omitempty"`
+	Timezone     string              `json:"timezone,omitempty"`
+	AvatarURL    string              `json:"avatar_url,omitempty"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+	LastLogin    *time.Time          `json:"last_login,omitempty"`
+	DeleteAt     *time.Time          `json:"delete_at,omitempty"`
+	AppMetadata  json.RawMessage     `json:"app_metadata,omitempty"`
+	UserMetadata json.RawMessage     `json:"user_metadata,omitempty"`
+}
+
+// Verification is a pending email verification, e.g. an unconfirmed email
+// change. Value is the data it would apply.
+type Verification struct {
+	Type  database.VerificationType `json:"type"`
+	Value string                    `json:"value,omitempty"`
+}
+
+// StatusChange is the user entering a status, oldest first.
+type StatusChange struct {
+	Status database.UserStatus `json:"status"`
+	At     time.Time           `json:"at"`
+}
+
+// VerificationEvent is a verification link sent to the user or used, newest
+// first. codes are deleted once used, so the history is taken from the
+// audit events.
+type VerificationEvent struct {
+	Type   string    `json:"type"`
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+type Session struct {
+	Id        database.ObjectId `json:"id"`
+	UserAgent string            `json:"user_agent"`
+	IP        string            `json:"ip"`
+	CreatedAt time.Time         `json:"created_at"`
+	LastSeen  time.Time         `json:"last_seen"`
+}
+
+type LoginFailures struct {
+	Count       int        `json:"count"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// AuditEvent is a security event caused by or applied to the user, newest
+// first.
+type AuditEvent struct {
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+type Exporter struct {
+	db  Storage
+	now func() time.Time
+}
+
+func New(db Storage) *Exporter {
+	return &Exporter{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+// Export collects the archive of a user.
+func (e *Exporter) Export(ctx context.Context, userId database.ObjectId) (*Archive, error) {
+	u, err := e.db.GetUserById(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{
+		Format:      Format,
+		GeneratedAt: e.now().UTC(),
+		Profile: Profile{
+			Id:           u.Id,
+			Email:        u.Email,
+			Status:       u.Status,
+			DisplayName:  u.Profile.DisplayName,
+			Locale:       u.Profile.Locale,
+			Timezone:     u.Profile.Timezone,
+			AvatarURL:    u.Profile.AvatarURL,
+			CreatedAt:    u.CreatedAt,
+			UpdatedAt:    u.UpdatedAt,
+			LastLogin:    optionalTime(u.LastLogin),
+			DeleteAt:     optionalTime(u.DeleteAt),
+			AppMetadata:  u.AppMetadata,
+			UserMetadata: u.UserMetadata,
+		},
+		StatusHistory:       []StatusChange{},
+		Verifications:       []Verification{},
+		VerificationHistory: []VerificationEvent{},
+		Sessions:            []Session{},
+		AuditEvents:         []AuditEvent{},
+	}
+
+	changes, err := e.db.GetStatusHistory(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		a.StatusHistory = append(a.StatusHistory, StatusChange{Status: c.Status, At: c.At.UTC()})
+	}
+
+	verifications, err := e.db.GetVerifications(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range verifications {
+		a.Verifications = append(a.Verifications, Verification{Type: v.Type, Value: v.Value})
+	}
+
+	sessions, err := e.db.GetSessions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		a.Sessions = append(a.Sessions, Session{
+			Id:        s.Id,
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			CreatedAt: s.CreatedAt.UTC(),
+			LastSeen:  s.LastSeen.UTC(),
+		})
+	}
+
+	f, err := e.db.GetLoginFailure(ctx, database.LoginFailureUser, u.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		a.LoginFailures = &LoginFailures{Count: f.Count, LastFailure: f.LastFailure.UTC(), LockedUntil: optionalTime(f.LockedUntil)}
+	}
+
+	events, err := e.auditEvents(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range events {
+		a.AuditEvents = append(a.AuditEvents, AuditEvent{
+			Type:      ev.Type,
+			Actor:     ev.Actor,
+			IP:        ev.IP,
+			UserAgent: ev.UserAgent,
+			Detail:    ev.Detail,
+			At:        ev.At.UTC(),
+		})
+		if verificationEvents[ev.Type] {
+			a.VerificationHistory = append(a.VerificationHistory, VerificationEvent{Type: ev.Type, Detail: ev.Detail, At: ev.At.UTC()})
+		}
+	}
+	return a, nil
+}
+
+// auditEvents returns the audit events of a user, newest first: those the
+// user caused, those applied to the account and those recorded for its
+// address, like throttled logins.
+func (e *Exporter) auditEvents(ctx context.Context, u database.User) ([]database.AuditEvent, error) {
+	found := make(map[int64]database.AuditEvent)
+	filters := []database.AuditFilter{
+		{Actor: string(u.Id)},
+		{Target: string(u.Id)},
+		{Target: u.Email},
+	}
+	for _, f := range filters {
+		f.Limit = auditPageSize
+		for {
+			page, err := e.db.GetAuditEvents(ctx, f)
+			if err != nil {
+				return nil, err
+			}
+			for _, ev := range page {
+				found[ev.Id] = ev
+			}
+			if len(page) < auditPageSize {
+				break
+			}
+			f.BeforeId = page[len(page)-1].Id
+		}
+	}
+	events := make([]database.AuditEvent, 0, len(found))
+	for _, ev := range found {
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id > events[j].Id
+	})
+	return events, nil
+}
+
+// Write encodes an archive as indented json.
+func Write(w io.Writer, a *Archive) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
@@ -0,0 +1,100 @@
+package export
+
+import (
+	"auth/database"
+	"bytes"
+	"context"
+	"encoding/json"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	db := database.NewMemory()
+	id, _, err := db.AddUser(ctx, database.NewUser{Email: "user1@example.com", Password: "secret hash", Status: database.UserStatusActive})
+	Expect(err).To(BeNil())
+	Expect(db.ScheduleDeletion(ctx, id, time.Now().Add(time.Hour))).To(Succeed())
+	Expect(db.CancelDeletion(ctx, id)).To(Succeed())
+	_, _, err = db.SetEmailChange(ctx, id, "user2@example.com")
+	Expect(err).To(BeNil())
+	Expect(db.UpdateProfile(ctx, id, database.Profile{DisplayName: "User One"}, json.RawMessage(`{"theme":"dark"}`), time.Now())).To(Succeed())
+	now := time.Now()
+	session := database.Session{Id: database.NewObjectId(), UserId: id, UserAgent: "curl/8.0", IP: "1.1.1.1", CreatedAt: now, LastSeen: now}
+	Expect(db.AddSession(ctx, session, now.Add(-time.Hour))).To(Succeed())
+	_, err = db.AddLoginFailure(ctx, database.LoginFailureUser, "user1@example.com", now, now.Add(-time.Hour))
+	Expect(err).To(BeNil())
+	at := now.UTC().Truncate(time.Second)
+	for _, e := range []database.AuditEvent{
+		{Type: "login_failure", Target: "user1@example.com", IP: "2.2.2.2", Detail: "throttled", At: at},
+		{Type: "login_success", Actor: string(id), Target: string(id), IP: "1.1.1.1", At: at},
+		{Type: "admin_unlock", Actor: "admin:ops", Target: string(id), At: at},
+		{Type: "email_change", Actor: string(id), Target: string(id), Detail: "new email user2@example.com", At: at},
+		{Type: "login_success", Actor: "other", Target: "other", At: at},
+	} {
+		Expect(db.AddAuditEvent(ctx, e)).To(Succeed())
+	}
+
+	a, err := New(db).Export(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(a.Format).To(Equal(Format))
+	Expect(a.Profile.Id).To(Equal(id))
+	Expect(a.Profile.Email).To(Equal("user1@example.com"))
+	Expect(a.Profile.Status).To(Equal(database.UserStatusActive))
+	Expect(a.Profile.DisplayName).To(Equal("User One"))
+	Expect(a.Profile.UserMetadata).To(MatchJSON(`{"theme":"dark"}`))
+	Expect(a.Profile.LastLogin).To(BeNil())
+	Expect(a.Verifications).To(ConsistOf(
+		Verification{Type: database.VerificationTypeChangeEmail, Value: "user2@example.com"},
+		Verification{Type: database.VerificationTypeCancelEmail},
+	))
+	Expect(a.Sessions).To(HaveLen(1))
+	Expect(a.Sessions[0].Id).To(Equal(session.Id))
+	Expect(a.Sessions[0].UserAgent).To(Equal("curl/8.0"))
+	Expect(a.LoginFailures.Count).To(Equal(1))
+	Expect(a.LoginFailures.LockedUntil).To(BeNil())
+	Expect(a.AuditEvents).To(Equal([]AuditEvent{
+		{Type: "email_change", Actor: string(id), Detail: "new email user2@example.com", At: at},
+		{Type: "admin_unlock", Actor: "admin:ops", At: at},
+		{Type: "login_success", Actor: string(id), IP: "1.1.1.1", At: at},
+		{Type: "login_failure", IP: "2.2.2.2", Detail: "throttled", At: at},
+	}))
+	Expect(a.VerificationHistory).To(Equal([]VerificationEvent{
+		{Type: "email_change", Detail: "new email user2@example.com", At: at},
+	}))
+	var statuses []database.UserStatus
+	for _, c := range a.StatusHistory {
+		statuses = append(statuses, c.Status)
+	}
+	Expect(statuses).To(Equal([]database.UserStatus{database.UserStatusActive, database.UserStatusDeleting, database.UserStatusActive}))
+
+	// secrets never end up in the archive
+	var b bytes.Buffer
+	Expect(Write(&b, a)).To(Succeed())
+	Expect(b.String()).NotTo(ContainSubstring("secret hash"))
+	code, err := db.GetVerification(ctx, id, database.VerificationTypeChangeEmail)
+	Expect(err).To(BeNil())
+	Expect(b.String()).NotTo(ContainSubstring(code))
+	var decoded Archive
+	Expect(json.Unmarshal(b.Bytes(), &decoded)).To(Succeed())
+	Expect(decoded.Profile.Email).To(Equal("user1@example.com"))
+
+	_, err = New(db).Export(ctx, database.NewObjectId())
+	Expect(err).To(Equal(database.ErrNotFound))
+}
+
+func TestExportAuditEventPages(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	db := database.NewMemory()
+	id, _, err := db.AddUser(ctx, database.NewUser{Email: "user1@example.com", Password: "hash", Status: database.UserStatusActive})
+	Expect(err).To(BeNil())
+	for i := 0; i < auditPageSize+10; i++ {
+		Expect(db.AddAuditEvent(ctx, database.AuditEvent{Type: "login_success", Actor: string(id), Target: string(id), At: time.Now()})).To(Succeed())
+	}
+	a, err := New(db).Export(ctx, id)
+	Expect(err).To(BeNil())
+	Expect(a.AuditEvents).To(HaveLen(auditPageSize + 10))
+}
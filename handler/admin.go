@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"auth/admin"
+	"auth/audit"
+	"auth/common"
+	"auth/database"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// defaultAuditLimit is the page size of the audit and delivery logs if the
+// query does not set one.
+const defaultAuditLimit = 50
+
+// RegisterAdminHandlers adds the admin endpoints to group, which is expected
+// to be guarded by the admin middleware.
+func (h *Handler) RegisterAdminHandlers(group *gin.RouterGroup) {
+	group.POST("/unlock", h.unlock)
+	group.GET("/metrics/hashing", h.hashingMetrics)
+	group.PATCH("/users/:id/app_metadata", h.updateAppMetadata)
+	group.GET("/audit", h.queryAudit)
+	group.GET("/webhooks/deliveries", h.webhookDeliveries)
+}
+
+// adminActor is the audit actor of admin requests.
+func adminActor(c *gin.Context) string {
+	return "admin:" + admin.KeyName(c)
+}
+
+func (h *Handler) unlock(c *gin.Context) {
+	var u unlock
+	err := c.ShouldBindBodyWith(&u, binding.JSON)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid unlock request", err)
+		return
+	}
+	err = h.lockout.Unlock(c.Request.Context(), u.Email, u.IP)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	zap.L().Info("login unlocked",
+		zap.String("email", u.Email),
+		zap.String("ip", u.IP),
+		zap.String("admin", admin.KeyName(c)),
+	)
+	h.audit.Record(c, audit.EventAdminUnlock, adminActor(c), u.Email, u.IP)
+
+	common.SuccessResponse(c, http.StatusOK, "login unlocked", nil)
+}
+
+func (h *Handler) hashingMetrics(c *gin.Context) {
+	common.SuccessResponse(c, http.StatusOK, "hashing pool metrics", h.hasher.Stats())
+}
+
+// queryAudit pages through the audit log, newest first. the next page is
+// requested with before set to the next id of the previous response.
+func (h *Handler) queryAudit(c *gin.Context) {
+	var q auditQuery
+	err := c.ShouldBindQuery(&q)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid audit query", err)
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultAuditLimit
+	}
+	events, err := h.audit.Query(c.Request.Context(), database.AuditFilter{
+		Type:     q.Type,
+		Actor:    q.Actor,
+		Target:   q.Target,
+		IP:       q.IP,
+		From:     q.From,
+		To:       q.To,
+		BeforeId: q.Before,
+		Limit:    q.Limit,
+	})
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	data := gin.H{"events": events}
+	if len(events) == q.Limit {
+		data["next"] = events[len(events)-1].Id
+	}
+	common.SuccessResponse(c, http.StatusOK, "audit events", data)
+}
+
+// webhookDeliveries pages through the webhook delivery log like queryAudit.
+func (h *Handler) webhookDeliveries(c *gin.Context) {
+	var q deliveryQuery
+	err := c.ShouldBindQuery(&q)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid delivery query", err)
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultAuditLimit
+	}
+	deliveries, err := h.webhooks.Deliveries(c.Request.Context(), database.WebhookFilter{
+		Endpoint: q.Endpoint,
+		Status:   database.WebhookStatus(q.Status),
+		BeforeId: q.Before,
+		Limit:    q.Limit,
+	})
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	data := gin.H{"deliveries": deliveries}
+	if len(deliveries) == q.Limit {
+		data["next"] = deliveries[len(deliveries)-1].Id
+	}
+	common.SuccessResponse(c, http.StatusOK, "webhook deliveries", data)
+}
@@ -1,45 +1,147 @@
 package handler
 
 import (
+	"auth/audit"
 	"auth/common"
 	"auth/database"
-	"auth/mailer"
+	"auth/deletion"
+	"auth/export"
+	"auth/lockout"
+	"auth/outbox"
+	"auth/password"
 	"auth/recaptcha"
+	"auth/webhook"
+	"context"
+	"encoding/json"
+	"errors"
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"go.uber.org/zap"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 )
 
-type storage interface {
-	AddUser(u database.NewUser) (database.ObjectId, string, error)
-	GetUser(name string) (database.User, error)
-	Verify(code string) error
-	SetRecoveryCode(userId database.ObjectId) (string, error)
-	ResetPassword(code string, newPassword string) error
+type Storage interface {
+	AddUser(ctx context.Context, u database.NewUser, outbox ...database.OutboxMessage) (database.ObjectId, string, error)
+	AddOutboxMessages(ctx context.Context, messages ...database.OutboxMessage) error
+	GetUser(ctx context.Context, name string) (database.User, error)
+	GetUserById(ctx context.Context, userId database.ObjectId) (database.User, error)
+	UpdateProfile(ctx context.Context, userId database.ObjectId, p database.Profile, userMetadata json.RawMessage, at time.Time) error
+	SetAppMetadata(ctx context.Context, userId database.ObjectId, appMetadata json.RawMessage, at time.Time) error
+	SetLastLogin(ctx context.Context, userId database.ObjectId, at time.Time) error
+	GetUserByCode(ctx context.Context, code string, verificationType database.VerificationType) (database.User, error)
+	Verify(ctx context.Context, code string, outbox ...database.OutboxMessage) error
+	GetVerifications(ctx context.Context, userId database.ObjectId) ([]database.Verification, error)
+	SetRecoveryCode(ctx context.Context, userId database.ObjectId, outbox ...database.OutboxMessage) (string, error)
+	SetSignupCode(ctx context.Context, userId database.ObjectId, redirectURI string, outbox ...database.OutboxMessage) (string, error)
+	ResetPassword(ctx context.Context, code string, newPasswordHash string) error
+	SetPassword(ctx context.Context, userId database.ObjectId, passwordHash string) error
+	SetEmailChange(ctx context.Context, userId database.ObjectId, newEmail string, outbox ...database.OutboxMessage) (string, string, error)
+	ConfirmEmailChange(ctx context.Context, code string, outbox ...database.OutboxMessage) error
+	CancelEmailChange(ctx context.Context, code string) error
+	ChangePassword(ctx context.Context, userId database.ObjectId, passwordHash string, outbox ...database.OutboxMessage) error
+	AddSession(ctx context.Context, s database.Session, expiredBefore time.Time) error
+	GetSession(ctx context.Context, sessionId database.ObjectId) (database.Session, error)
+	GetSessions(ctx context.Context, userId database.ObjectId) ([]database.Session, error)
+	TouchSession(ctx context.Context, sessionId database.ObjectId, at time.Time) error
+	RotateSession(ctx context.Context, sessionId database.ObjectId, generation int, at time.Time) (int, error)
+	DeleteSession(ctx context.Context, userId database.ObjectId, sessionId database.ObjectId) error
+	DeleteOtherSessions(ctx context.Context, userId database.ObjectId, keep database.ObjectId) error
+	GetKnownDevices(ctx context.Context, userId database.ObjectId) ([]database.KnownDevice, error)
+	AddKnownDevice(ctx context.Context, d database.KnownDevice) error
+	SetReportCode(ctx context.Context, userId database.ObjectId, outbox ...database.OutboxMessage) (string, error)
+	ReportLogin(ctx context.Context, code string) (database.ObjectId, error)
 }
 
 type Handler struct {
 	jwtMiddleWare    *jwt.GinJWTMiddleware
-	db               storage
-	mailer           mailer.Mailer
+	db               Storage
 	serverName       string
 	recaptchaHandler *recaptcha.Handler
+	lockout          *lockout.Tracker
+	passwordPolicy   *password.Policy
+	hasher           *password.Pool
+	deletion         *deletion.Scheduler
+	exporter         *export.Exporter
+	audit            *audit.Logger
+	webhooks         *webhook.Dispatcher
+	outbox           *outbox.Dispatcher
+	verification     *VerificationConfig
+	tokenClaims      []string
+	// privacyMode hides whether an account exists from signup, recover and
+	// login, dummyHash is checked by logins that have no password to check.
+	privacyMode bool
+	dummyHash   string
 }
 
 const (
-	emailKey   = "email"
-	apiNameKey = "key_name"
+	emailKey        = "email"
+	tokenVersionKey = "ver"
+	sessionKey      = "sid"
+	generationKey   = "gen"
+	apiNameKey      = "key_name"
 )
 
-func New(db storage, mailer mailer.Mailer, recaptchaHandler *recaptcha.Handler, serverName string) *Handler {
+// Dependencies are the services a Handler works with, all of them are
+// required.
+type Dependencies struct {
+	DB             Storage
+	Recaptcha      *recaptcha.Handler
+	Lockout        *lockout.Tracker
+	PasswordPolicy *password.Policy
+	Hasher         *password.Pool
+	Deletion       *deletion.Scheduler
+	Exporter       *export.Exporter
+	Audit          *audit.Logger
+	Webhooks       *webhook.Dispatcher
+	Outbox         *outbox.Dispatcher
+}
+
+// Options are the settings of a Handler. a nil Verification gives the
+// defaults, ServerName is the host links in pages point to.
+type Options struct {
+	Verification *VerificationConfig
+	PrivacyMode  bool
+	TokenClaims  []string
+	ServerName   string
+}
+
+func New(deps Dependencies, options Options) *Handler {
+	for _, name := range options.TokenClaims {
+		if _, ok := profileClaims[name]; !ok {
+			zap.L().Fatal("unknown token claim", zap.String("claim", name))
+		}
+	}
 	handler := &Handler{
-		db:               db,
-		mailer:           mailer,
-		serverName:       serverName,
-		recaptchaHandler: recaptchaHandler,
+		db:               deps.DB,
+		serverName:       options.ServerName,
+		recaptchaHandler: deps.Recaptcha,
+		lockout:          deps.Lockout,
+		passwordPolicy:   deps.PasswordPolicy,
+		hasher:           deps.Hasher,
+		deletion:         deps.Deletion,
+		exporter:         deps.Exporter,
+		audit:            deps.Audit,
+		webhooks:         deps.Webhooks,
+		outbox:           deps.Outbox,
+		verification:     options.Verification,
+		tokenClaims:      options.TokenClaims,
+		privacyMode:      options.PrivacyMode,
+	}
+	if handler.verification == nil {
+		handler.verification = &VerificationConfig{}
+	}
+	if handler.privacyMode {
+		// hashed with the configured algorithm, so checking it takes as
+		// long as checking a real password
+		dummyHash, err := handler.hasher.Hash(context.Background(), string(database.NewObjectId()))
+		if err != nil {
+			zap.L().Fatal("cannot create dummy password hash", zap.Error(err))
+		}
+		handler.dummyHash = dummyHash
 	}
 	jwtMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
 		Realm:       "z42 zone",
@@ -54,39 +156,93 @@ func New(db storage, mailer mailer.Mailer, recaptchaHandler *recaptcha.Handler,
 				return "", jwt.ErrMissingLoginValues
 			}
 			email := loginValues.Email
-			password := loginValues.Password
 
-			user, err := handler.db.GetUser(email)
+			user, err := handler.db.GetUser(c.Request.Context(), email)
 			if err != nil {
 				zap.L().Warn("user not found")
+				handler.dummyVerify(c, loginValues.Password)
+				handler.loginFailed(c, email, nil, "unknown_user")
 				return nil, jwt.ErrFailedAuthentication
 			}
 
-			if user.Status != database.UserStatusActive {
+			// users in their deletion grace period cancel it by logging in
+			if user.Status != database.UserStatusActive && user.Status != database.UserStatusDeleting {
 				zap.L().Warn("user not active")
+				handler.dummyVerify(c, loginValues.Password)
+				handler.loginFailed(c, email, &user, "inactive")
 				return nil, jwt.ErrFailedAuthentication
 			}
 
-			if !database.CheckPasswordHash(password, user.Password) {
+			match, err := handler.hasher.Verify(c.Request.Context(), loginValues.Password, user.Password)
+			if err == password.ErrBusy {
+				// not the user's fault, don't count it as a failure
+				_ = c.Error(err)
+				return nil, err
+			}
+			// reported logins leave the password empty until it is reset
+			if err != nil && user.Password != "" {
+				zap.L().Error("cannot verify password hash", zap.Error(err))
+			}
+			if !match {
 				zap.L().Warn("password mismatch")
+				handler.loginFailed(c, email, &user, "password_mismatch")
 				return nil, jwt.ErrFailedAuthentication
 			}
-			return &IdentityData{Id: user.Id, Email: user.Email}, nil
+			handler.rehashPassword(c, user, loginValues.Password)
+			if user.Status == database.UserStatusDeleting {
+				if err := handler.deletion.Cancel(c.Request.Context(), user.Id); err != nil {
+					zap.L().Error("cannot cancel account deletion", zap.Error(err))
+					return nil, jwt.ErrFailedAuthentication
+				}
+				zap.L().Info("account deletion cancelled", zap.String("user", string(user.Id)))
+			}
+
+			if err := handler.lockout.Succeed(c.Request.Context(), email); err != nil {
+				zap.L().Error("clearing login failures failed", zap.Error(err))
+			}
+			if err := handler.db.SetLastLogin(c.Request.Context(), user.Id, time.Now()); err != nil {
+				zap.L().Error("cannot record last login", zap.Error(err))
+			}
+			identity := handler.identity(user)
+			identity.SessionId, err = handler.startSession(c, user)
+			if err != nil {
+				zap.L().Error("cannot start session", zap.Error(err))
+				return nil, jwt.ErrFailedAuthentication
+			}
+			handler.audit.Record(c, audit.EventLoginSuccess, string(user.Id), string(user.Id), "session "+string(identity.SessionId))
+			handler.alertNewDevice(c, user)
+			return identity, nil
 		},
 		PayloadFunc: func(data interface{}) jwt.MapClaims {
 			if v, ok := data.(*IdentityData); ok {
-				return jwt.MapClaims{
-					IdentityKey: v.Id,
-					emailKey:    v.Email,
+				claims := jwt.MapClaims{
+					IdentityKey:     v.Id,
+					emailKey:        v.Email,
+					tokenVersionKey: v.TokenVersion,
+					sessionKey:      v.SessionId,
+					generationKey:   v.Generation,
+				}
+				for name, value := range v.Claims {
+					claims[name] = value
 				}
+				return claims
 			}
 			return jwt.MapClaims{}
 		},
+		Authorizator: func(data interface{}, c *gin.Context) bool {
+			return handler.authorize(c, data.(*IdentityData))
+		},
 		IdentityHandler: func(c *gin.Context) interface{} {
 			claims := jwt.ExtractClaims(c)
+			version, _ := claims[tokenVersionKey].(float64)
+			sessionId, _ := claims[sessionKey].(string)
+			generation, _ := claims[generationKey].(float64)
 			return &IdentityData{
-				Id:    database.ObjectId(claims[IdentityKey].(string)),
-				Email: claims[emailKey].(string),
+				Id:           database.ObjectId(claims[IdentityKey].(string)),
+				Email:        claims[emailKey].(string),
+				TokenVersion: int(version),
+				SessionId:    database.ObjectId(sessionId),
+				Generation:   int(generation),
 			}
 		},
 		LoginResponse: func(c *gin.Context, code int, token string, expire time.Time) {
@@ -99,14 +255,12 @@ func New(db storage, mailer mailer.Mailer, recaptchaHandler *recaptcha.Handler,
 		LogoutResponse: func(c *gin.Context, code int) {
 			common.SuccessResponse(c, code, "logout successful", nil)
 		},
-		RefreshResponse: func(c *gin.Context, code int, token string, expire time.Time) {
-			c.JSON(http.StatusOK, &authenticationToken{
-				Code:   http.StatusOK,
-				Token:  token,
-				Expire: expire.Format(time.RFC3339),
-			})
-		},
 		Unauthorized: func(c *gin.Context, code int, message string) {
+			if err := c.Errors.Last(); err != nil && err.Err == password.ErrBusy {
+				c.Header("Retry-After", "1")
+				common.ErrorResponse(common.StatusFromError(c, err.Err))
+				return
+			}
 			common.ErrorResponse(c, code, message, nil)
 		},
 		TokenLookup:   "header: Authorization, query: token, cookie: jwt",
@@ -124,19 +278,117 @@ func New(db storage, mailer mailer.Mailer, recaptchaHandler *recaptcha.Handler,
 
 func (h *Handler) RegisterHandlers(group *gin.RouterGroup) {
 	group.POST("/signup", h.recaptchaHandler.MiddlewareFunc(), h.signup)
+	group.GET("/verify", h.confirmPage("Verify your email address", "Please confirm the email address of your new account.", "Verify Your EMail Address"))
 	group.POST("/verify", h.verify)
+	group.POST("/verify/resend", h.recaptchaHandler.MiddlewareFunc(), h.resendVerification)
 	group.POST("/recover", h.recaptchaHandler.MiddlewareFunc(), h.recover)
 	group.PATCH("/reset", h.recaptchaHandler.MiddlewareFunc(), h.reset)
-	group.POST("/login", h.recaptchaHandler.MiddlewareFunc(), h.jwtMiddleWare.LoginHandler)
-	group.POST("/logout", h.jwtMiddleWare.LogoutHandler)
-	group.GET("/refresh_token", h.MiddlewareFunc(), h.jwtMiddleWare.RefreshHandler)
+	group.POST("/login", h.recaptchaHandler.MiddlewareFunc(), h.throttleLogin, h.jwtMiddleWare.LoginHandler)
+	group.POST("/logout", h.revokeCurrentSession, h.jwtMiddleWare.LogoutHandler)
+	group.GET("/refresh_token", h.detectTokenReuse, h.MiddlewareFunc(), h.refreshToken)
 	group.GET("/check", h.MiddlewareFunc())
+	group.PATCH("/password", h.MiddlewareFunc(), h.changePassword)
+	group.PATCH("/email", h.MiddlewareFunc(), h.changeEmail)
+	group.GET("/email/confirm", h.confirmPage("Confirm your new email address", "Please confirm that this address should become the email of your account.", "Confirm Your New EMail Address"))
+	group.POST("/email/confirm", h.confirmEmailChange)
+	group.GET("/email/cancel", h.confirmPage("Cancel the email change", "Please confirm that the requested email change of your account should be cancelled.", "Cancel The EMail Change"))
+	group.POST("/email/cancel", h.cancelEmailChange)
+	group.DELETE("/account", h.MiddlewareFunc(), h.deleteAccount)
+	group.GET("/export", h.MiddlewareFunc(), h.exportAccount)
+	group.GET("/me", h.MiddlewareFunc(), h.getProfile)
+	group.PATCH("/me", h.MiddlewareFunc(), h.updateProfile)
+	group.GET("/sessions", h.MiddlewareFunc(), h.listSessions)
+	group.DELETE("/sessions", h.MiddlewareFunc(), h.revokeOtherSessions)
+	group.DELETE("/sessions/:id", h.MiddlewareFunc(), h.revokeSession)
+	group.GET("/sessions/report", h.confirmPage("Report this login", "Reporting logs out all sessions of your account and disables your password until you choose a new one.", "This Wasn't Me"))
+	group.POST("/sessions/report", h.reportLogin)
 }
 
 func (h *Handler) MiddlewareFunc() gin.HandlerFunc {
 	return h.jwtMiddleWare.MiddlewareFunc()
 }
 
+// authorize rejects tokens of users that no longer exist, tokens that were
+// revoked by bumping the user's token version, and tokens of revoked
+// sessions.
+func (h *Handler) authorize(c *gin.Context, identity *IdentityData) bool {
+	user, err := h.db.GetUserById(c.Request.Context(), identity.Id)
+	if err != nil {
+		zap.L().Warn("cannot load token user", zap.String("user", string(identity.Id)), zap.Error(err))
+		return false
+	}
+	if identity.TokenVersion != user.TokenVersion {
+		return false
+	}
+	return h.checkSession(c, identity)
+}
+
+// throttleLogin rejects login attempts for users or ips that are locked or
+// still inside their back-off delay after previous failures.
+func (h *Handler) throttleLogin(c *gin.Context) {
+	var loginValues loginCredentials
+	if err := c.ShouldBindBodyWith(&loginValues, binding.JSON); err != nil {
+		// let the login handler report invalid input
+		c.Next()
+		return
+	}
+	wait, err := h.lockout.Check(c.Request.Context(), loginValues.Email, c.ClientIP())
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		c.Abort()
+		return
+	}
+	if wait > 0 {
+		h.audit.Record(c, audit.EventLoginFailure, "", loginValues.Email, "throttled")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		common.ErrorResponse(c, http.StatusTooManyRequests, "too many failed login attempts, try again later", nil)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// loginFailed records a failed login for email, user is nil for unknown
+// users. reason ends up in the audit log.
+func (h *Handler) loginFailed(c *gin.Context, email string, user *database.User, reason string) {
+	target := email
+	if user != nil {
+		target = string(user.Id)
+	}
+	h.audit.Record(c, audit.EventLoginFailure, "", target, reason)
+	lockedUntil, err := h.lockout.Fail(c.Request.Context(), email, c.ClientIP())
+	if err != nil {
+		zap.L().Error("recording login failure failed", zap.Error(err))
+		return
+	}
+	if lockedUntil.IsZero() || user == nil {
+		return
+	}
+	zap.L().Warn("login locked", zap.String("email", email), zap.Time("until", lockedUntil))
+	err = h.db.AddOutboxMessages(c.Request.Context(), h.outbox.AccountLocked(user.Id, user.Email, lockedUntil))
+	if err != nil {
+		zap.L().Error("cannot queue account locked notification", zap.Error(err))
+		return
+	}
+	h.outbox.Notify()
+}
+
+// rehashPassword upgrades the stored hash of a user who just logged in with
+// password, if it was made with an outdated algorithm or parameters.
+func (h *Handler) rehashPassword(c *gin.Context, user database.User, password string) {
+	if !h.hasher.NeedsRehash(user.Password) {
+		return
+	}
+	hash, err := h.hasher.Hash(c.Request.Context(), password)
+	if err != nil {
+		zap.L().Error("cannot rehash password", zap.Error(err))
+		return
+	}
+	if err := h.db.SetPassword(c.Request.Context(), user.Id, hash); err != nil {
+		zap.L().Error("cannot store rehashed password", zap.Error(err))
+	}
+}
+
 func (h *Handler) signup(c *gin.Context) {
 	var u NewUser
 	err := c.ShouldBindBodyWith(&u, binding.JSON)
@@ -144,21 +396,43 @@ func (h *Handler) signup(c *gin.Context) {
 		common.ErrorResponse(c, http.StatusBadRequest, "invalid input format", err)
 		return
 	}
-	model := database.NewUser{
-		Email:    u.Email,
-		Password: u.Password,
-		Status:   database.UserStatusPending,
+	if !h.checkRedirect(c, u.ClientId, u.RedirectURI) {
+		return
+	}
+	if !h.checkPassword(c, u.Password, u.Email) {
+		return
 	}
-	_, code, err := h.db.AddUser(model)
+	hash, err := h.hashPassword(c, u.Password)
 	if err != nil {
-		common.ErrorResponse(common.StatusFromError(c, err))
 		return
 	}
-	err = h.mailer.SendEMailVerification(u.Email, u.Email, code)
+	model := database.NewUser{
+		Id:          database.NewObjectId(),
+		Email:       u.Email,
+		Password:    hash,
+		Status:      database.UserStatusPending,
+		RedirectURI: u.RedirectURI,
+	}
+	created, err := h.outbox.Event(webhook.EventUserCreated, webhook.User{Id: model.Id, Email: model.Email})
 	if err != nil {
-		common.ErrorResponse(c, http.StatusInternalServerError, "cannot send email verification", err)
+		common.ErrorResponse(c, http.StatusInternalServerError, "cannot create user event", err)
 		return
 	}
+	// the verification mail and the event are stored with the user and sent
+	// by the outbox, so a mail server outage does not lose them
+	verificationMail := h.outbox.Mail(outbox.KindEmailVerification, model.Id, model.Email)
+	userId, _, err := h.db.AddUser(c.Request.Context(), model, verificationMail, created)
+	switch {
+	case err == database.ErrDuplicateEntry && h.privacyMode:
+		// the owner of the address is told instead of the client
+		h.notifySignupAttempt(c, model.Email)
+	case err != nil:
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	default:
+		h.outbox.Notify()
+		h.audit.Record(c, audit.EventSignup, "", string(userId), "")
+	}
 
 	common.SuccessResponse(c, http.StatusCreated,
 		"You still have to verify your email address inorder to complete your account validation process. Please check your inbox and click the link emailed to you.",
@@ -166,50 +440,126 @@ func (h *Handler) signup(c *gin.Context) {
 	)
 }
 
+// notifySignupAttempt mails the owner of an address that someone tried to
+// sign up with it. failures are only logged, the response must look like
+// a successful signup.
+func (h *Handler) notifySignupAttempt(c *gin.Context, email string) {
+	user, err := h.db.GetUser(c.Request.Context(), email)
+	if err != nil {
+		zap.L().Error("cannot load user of signup attempt", zap.Error(err))
+		return
+	}
+	err = h.db.AddOutboxMessages(c.Request.Context(), h.outbox.Mail(outbox.KindSignupAttempt, user.Id, user.Email))
+	if err != nil {
+		zap.L().Error("cannot queue signup attempt notice", zap.Error(err))
+		return
+	}
+	h.outbox.Notify()
+	h.audit.Record(c, audit.EventSignup, "", string(user.Id), "existing account")
+}
+
+// dummyVerify spends the time of a password check on logins that fail
+// before one, so that response times do not tell whether an account exists.
+func (h *Handler) dummyVerify(c *gin.Context, pw string) {
+	if !h.privacyMode {
+		return
+	}
+	_, _ = h.hasher.Verify(c.Request.Context(), pw, h.dummyHash)
+}
+
 func (h *Handler) verify(c *gin.Context) {
 	var v verification
 	err := c.ShouldBindQuery(&v)
 	if err != nil {
-		common.ErrorResponse(c, http.StatusBadRequest, "invalid code", err)
+		h.verificationFailed(c, verifyInvalidRequest, http.StatusBadRequest, "invalid code", err)
+		return
+	}
+	user, err := h.db.GetUserByCode(c.Request.Context(), v.Code, database.VerificationTypeSignup)
+	if err == database.ErrNotFound {
+		h.verificationFailed(c, verifyInvalidCode, http.StatusNotFound, "entry not found", err)
 		return
 	}
-	err = h.db.Verify(v.Code)
 	if err != nil {
-		common.ErrorResponse(c, http.StatusInternalServerError, "verification failed", err)
+		_, code, message, _ := common.StatusFromError(c, err)
+		h.verificationFailed(c, verifyServerError, code, message, err)
 		return
 	}
-
-	c.HTML(
-		http.StatusOK,
-		"verification-successful.tmpl",
-		gin.H{
-			"Server": h.serverName,
-		},
-	)
+	redirectURI := h.signupRedirect(c, user.Id)
+	verified, err := h.outbox.Event(webhook.EventUserVerified, webhook.User{Id: user.Id, Email: user.Email})
+	if err != nil {
+		h.verificationFailed(c, verifyServerError, http.StatusInternalServerError, "cannot create user event", err)
+		return
+	}
+	err = h.db.Verify(c.Request.Context(), v.Code, verified)
+	if err != nil {
+		h.verificationFailed(c, verifyServerError, http.StatusInternalServerError, "verification failed", err)
+		return
+	}
+	h.outbox.Notify()
+	h.audit.Record(c, audit.EventVerify, "", string(user.Id), "")
+	h.verified(c, redirectURI)
 }
 
-func (h *Handler) recover(c *gin.Context) {
-	var r recovery
+// resendVerification sends a new verification link to a pending user. the
+// response is the same for unknown and already verified addresses, so that
+// it does not tell which accounts exist.
+func (h *Handler) resendVerification(c *gin.Context) {
+	var r verificationResend
 	err := c.ShouldBindBodyWith(&r, binding.JSON)
 	if err != nil {
 		common.ErrorResponse(c, http.StatusBadRequest, "invalid email", err)
 		return
 	}
-	user, err := h.db.GetUser(r.Email)
-	if err != nil {
-		common.ErrorResponse(common.StatusFromError(c, err))
+	if !h.checkRedirect(c, r.ClientId, r.RedirectURI) {
 		return
 	}
-	code, err := h.db.SetRecoveryCode(user.Id)
-	if err != nil {
+	user, err := h.db.GetUser(c.Request.Context(), r.Email)
+	if err != nil && err != database.ErrNotFound {
 		common.ErrorResponse(common.StatusFromError(c, err))
 		return
 	}
-	err = h.mailer.SendPasswordReset(user.Email, user.Email, code)
+	if err == nil && user.Status == database.UserStatusPending {
+		_, err = h.db.SetSignupCode(c.Request.Context(), user.Id, r.RedirectURI, h.outbox.Mail(outbox.KindEmailVerification, user.Id, user.Email))
+		switch {
+		case err == nil:
+			h.outbox.Notify()
+			h.audit.Record(c, audit.EventVerifyResend, "", string(user.Id), "")
+		case err == database.ErrInvalid, err == database.ErrNotFound:
+			// verified or deleted in the meantime
+		default:
+			common.ErrorResponse(common.StatusFromError(c, err))
+			return
+		}
+	}
+
+	common.SuccessResponse(c, http.StatusOK,
+		"if the address belongs to an account that is not verified yet, a new verification link has been sent to it. Please check your inbox and click the link emailed to you.",
+		nil)
+}
+
+func (h *Handler) recover(c *gin.Context) {
+	var r recovery
+	err := c.ShouldBindBodyWith(&r, binding.JSON)
 	if err != nil {
-		common.ErrorResponse(c, http.StatusInternalServerError, "send password reset failed", err)
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid email", err)
 		return
 	}
+	user, err := h.db.GetUser(c.Request.Context(), r.Email)
+	switch {
+	case err == database.ErrNotFound && h.privacyMode:
+		// answered like known addresses
+	case err != nil:
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	default:
+		_, err = h.db.SetRecoveryCode(c.Request.Context(), user.Id, h.outbox.Mail(outbox.KindPasswordReset, user.Id, user.Email))
+		if err != nil {
+			common.ErrorResponse(common.StatusFromError(c, err))
+			return
+		}
+		h.outbox.Notify()
+		h.audit.Record(c, audit.EventPasswordRecover, "", string(user.Id), "")
+	}
 
 	common.SuccessResponse(c, http.StatusOK,
 		"a password recovery link has been sent to your email address. Please check your inbox and click the link emailed to you.",
@@ -223,14 +573,312 @@ func (h *Handler) reset(c *gin.Context) {
 		common.ErrorResponse(c, http.StatusBadRequest, "invalid password reset request", err)
 		return
 	}
-	err = h.db.ResetPassword(r.Code, r.Password)
+	user, err := h.db.GetUserByCode(c.Request.Context(), r.Code, database.VerificationTypeRecover)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	if !h.checkPassword(c, r.Password, user.Email) {
+		return
+	}
+	hash, err := h.hashPassword(c, r.Password)
+	if err != nil {
+		return
+	}
+	err = h.db.ResetPassword(c.Request.Context(), r.Code, hash)
 	if err != nil {
 		common.ErrorResponse(common.StatusFromError(c, err))
 		return
 	}
+	h.audit.Record(c, audit.EventPasswordReset, "", string(user.Id), "")
 
 	common.SuccessResponse(c, http.StatusAccepted,
 		"your password has been updated successfully. you may now login using your new password",
 		nil,
 	)
 }
+
+// changePassword replaces the password of the logged-in user. all other
+// sessions are revoked, the caller gets a fresh token instead of the one it
+// used.
+func (h *Handler) changePassword(c *gin.Context) {
+	var r passwordChange
+	err := c.ShouldBindBodyWith(&r, binding.JSON)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid password change request", err)
+		return
+	}
+	current := extractIdentity(c)
+	user, err := h.db.GetUserById(c.Request.Context(), current.Id)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	if !h.reauthenticate(c, user, r.CurrentPassword) {
+		return
+	}
+	if !h.checkPassword(c, r.Password, user.Email) {
+		return
+	}
+	hash, err := h.hashPassword(c, r.Password)
+	if err != nil {
+		return
+	}
+	err = h.db.ChangePassword(c.Request.Context(), user.Id, hash, h.outbox.Mail(outbox.KindPasswordChanged, user.Id, user.Email))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.outbox.Notify()
+	err = h.db.DeleteOtherSessions(c.Request.Context(), user.Id, current.SessionId)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.audit.Record(c, audit.EventPasswordChange, string(user.Id), string(user.Id), "")
+	user, err = h.db.GetUserById(c.Request.Context(), user.Id)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+
+	identity := h.identity(user)
+	identity.SessionId = current.SessionId
+	identity.Generation = current.Generation
+	h.sendToken(c, identity)
+}
+
+// changeEmail starts changing the email of the logged-in user. nothing
+// changes until the new address is confirmed, and the current address gets a
+// link to cancel the request.
+func (h *Handler) changeEmail(c *gin.Context) {
+	var r emailChange
+	err := c.ShouldBindBodyWith(&r, binding.JSON)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid email change request", err)
+		return
+	}
+	user, err := h.db.GetUserById(c.Request.Context(), ExtractUser(c))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	if !h.reauthenticate(c, user, r.Password) {
+		return
+	}
+	_, err = h.db.GetUser(c.Request.Context(), r.Email)
+	if err == nil {
+		common.ErrorResponse(c, http.StatusConflict, "email address is already in use", nil)
+		return
+	}
+	if err != database.ErrNotFound {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	// both mails are stored with the change, so a failing mail server
+	// cannot leave a pending change the current address never heard of
+	_, _, err = h.db.SetEmailChange(c.Request.Context(), user.Id, r.Email,
+		h.outbox.Mail(outbox.KindEmailChangeVerification, user.Id, r.Email),
+		h.outbox.EmailChangeNotice(user.Id, user.Email, r.Email),
+	)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.outbox.Notify()
+	h.audit.Record(c, audit.EventEmailChange, string(user.Id), string(user.Id), "new email "+r.Email)
+
+	common.SuccessResponse(c, http.StatusAccepted,
+		"a confirmation link has been sent to your new email address. your email will be changed once you click the link emailed to you.",
+		nil,
+	)
+}
+
+func (h *Handler) confirmEmailChange(c *gin.Context) {
+	var v verification
+	err := c.ShouldBindQuery(&v)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid code", err)
+		return
+	}
+	user, err := h.db.GetUserByCode(c.Request.Context(), v.Code, database.VerificationTypeChangeEmail)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	newEmail, err := h.pendingEmail(c, user.Id, v.Code)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	changed, err := h.outbox.Event(webhook.EventUserEmailChanged, webhook.EmailChange{Id: user.Id, Email: newEmail, PreviousEmail: user.Email})
+	if err != nil {
+		common.ErrorResponse(c, http.StatusInternalServerError, "cannot create user event", err)
+		return
+	}
+	err = h.db.ConfirmEmailChange(c.Request.Context(), v.Code, changed)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.outbox.Notify()
+	h.audit.Record(c, audit.EventEmailChangeConfirm, string(user.Id), string(user.Id), "")
+
+	c.HTML(
+		http.StatusOK,
+		"email-change-successful.tmpl",
+		gin.H{
+			"Server": h.serverName,
+		},
+	)
+}
+
+func (h *Handler) cancelEmailChange(c *gin.Context) {
+	var v verification
+	err := c.ShouldBindQuery(&v)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid code", err)
+		return
+	}
+	user, err := h.db.GetUserByCode(c.Request.Context(), v.Code, database.VerificationTypeCancelEmail)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	err = h.db.CancelEmailChange(c.Request.Context(), v.Code)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.audit.Record(c, audit.EventEmailChangeCancel, string(user.Id), string(user.Id), "")
+
+	c.HTML(
+		http.StatusOK,
+		"email-change-cancelled.tmpl",
+		gin.H{
+			"Server": h.serverName,
+		},
+	)
+}
+
+// deleteAccount schedules the deletion of the logged-in user and logs the
+// user out everywhere. logging in again during the grace period cancels it.
+func (h *Handler) deleteAccount(c *gin.Context) {
+	var r accountDeletion
+	err := c.ShouldBindBodyWith(&r, binding.JSON)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid account deletion request", err)
+		return
+	}
+	user, err := h.db.GetUserById(c.Request.Context(), ExtractUser(c))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	if !h.reauthenticate(c, user, r.Password) {
+		return
+	}
+	deleteAt, err := h.deletion.Schedule(c.Request.Context(), user.Id)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.audit.Record(c, audit.EventAccountDeletion, string(user.Id), string(user.Id), "delete at "+deleteAt.UTC().Format(time.RFC3339))
+
+	common.SuccessResponse(c, http.StatusAccepted,
+		"your account will be deleted. you may cancel the deletion by logging in before then.",
+		gin.H{"delete_at": deleteAt.UTC().Format(time.RFC3339)},
+	)
+}
+
+// exportAccount sends the logged-in user a download of everything stored
+// about the user.
+func (h *Handler) exportAccount(c *gin.Context) {
+	archive, err := h.exporter.Export(c.Request.Context(), ExtractUser(c))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="account-export.json"`)
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	if err := export.Write(c.Writer, archive); err != nil {
+		zap.L().Error("cannot write export", zap.Error(err))
+	}
+}
+
+// pendingEmail returns the address a change_email code changes the email of
+// userId to.
+func (h *Handler) pendingEmail(c *gin.Context, userId database.ObjectId, code string) (string, error) {
+	verifications, err := h.db.GetVerifications(c.Request.Context(), userId)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range verifications {
+		if v.Type == database.VerificationTypeChangeEmail && v.Code == code {
+			return v.Value, nil
+		}
+	}
+	return "", database.ErrNotFound
+}
+
+// reauthenticate checks the password of a logged-in user before a sensitive
+// change. wrong passwords count as failed logins, it returns false if the
+// request was rejected.
+func (h *Handler) reauthenticate(c *gin.Context, user database.User, pw string) bool {
+	wait, err := h.lockout.Check(c.Request.Context(), user.Email, c.ClientIP())
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return false
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		common.ErrorResponse(c, http.StatusTooManyRequests, "too many failed login attempts, try again later", nil)
+		return false
+	}
+	match, err := h.hasher.Verify(c.Request.Context(), pw, user.Password)
+	// reported logins leave the password empty until it is reset, like any
+	// hash the hasher cannot read it matches no password
+	if errors.Is(err, password.ErrUnknownHash) {
+		if user.Password != "" {
+			zap.L().Error("cannot verify password hash", zap.Error(err))
+		}
+		err = nil
+	}
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return false
+	}
+	if !match {
+		h.loginFailed(c, user.Email, &user, "reauthentication")
+		common.ErrorResponse(c, http.StatusForbidden, "current password is incorrect", nil)
+		return false
+	}
+	return true
+}
+
+// checkPassword applies the password policy and reports the failed rules to
+// the client, it returns false if the password was rejected.
+func (h *Handler) checkPassword(c *gin.Context, password string, email string) bool {
+	violations := h.passwordPolicy.Check(c.Request.Context(), password, email)
+	if len(violations) == 0 {
+		return true
+	}
+	common.ErrorResponseWithData(c, http.StatusBadRequest, "password does not meet the requirements", nil,
+		gin.H{"violations": violations},
+	)
+	return false
+}
+
+// hashPassword hashes a new password, reporting failures to the client.
+func (h *Handler) hashPassword(c *gin.Context, pw string) (string, error) {
+	hash, err := h.hasher.Hash(c.Request.Context(), pw)
+	if err != nil {
+		if err == password.ErrBusy {
+			c.Header("Retry-After", "1")
+		}
+		common.ErrorResponse(common.StatusFromError(c, err))
+	}
+	return hash, err
+}
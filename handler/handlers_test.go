@@ -0,0 +1,1108 @@
+package handler
+
+import (
+	"auth/admin"
+	"auth/audit"
+	"auth/database"
+	"auth/deletion"
+	"auth/export"
+	"auth/lockout"
+	"auth/mailer"
+	"auth/outbox"
+	"auth/password"
+	"auth/recaptcha"
+	"auth/webhook"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+	"time"
+)
+
+type testEnv struct {
+	db     *database.Memory
+	hasher *password.Pool
+	router *gin.Engine
+	codes  map[string]string
+	locked map[string]time.Time
+	// changed counts password changed notifications per email
+	changed map[string]int
+	// cancelCodes holds the email change cancel codes per current email
+	cancelCodes map[string]string
+	// reportCodes holds the code of the last new login alert per email
+	reportCodes map[string]string
+	// signupAttempts counts signup attempt notices per email
+	signupAttempts map[string]int
+	deletion       *deletion.Scheduler
+	dispatcher     *webhook.Dispatcher
+	// webhooks receives webhook deliveries, their events end up in events
+	webhooks *httptest.Server
+	events   []string
+	outbox   *outbox.Dispatcher
+}
+
+const testAdminKey = "admin-key"
+
+// testHasherConfig keeps hashing cheap, tests don't need real work factors.
+var testHasherConfig = password.HasherConfig{
+	Algorithm:  password.AlgorithmArgon2id,
+	BcryptCost: 4,
+	Argon2:     password.Argon2Config{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+}
+
+// testOptions are the handler settings tests may change.
+type testOptions struct {
+	privacyMode  bool
+	verification *VerificationConfig
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	return newTestEnvWith(t, testOptions{})
+}
+
+func newTestEnvWith(t *testing.T, options testOptions) *testEnv {
+	RegisterTestingT(t)
+	recaptchaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(recaptcha.Response{Success: true, Action: "login", ChallengeTS: time.Now()})
+	}))
+	t.Cleanup(recaptchaServer.Close)
+
+	env := &testEnv{
+		db:             database.NewMemory(),
+		router:         gin.New(),
+		codes:          make(map[string]string),
+		locked:         make(map[string]time.Time),
+		changed:        make(map[string]int),
+		cancelCodes:    make(map[string]string),
+		reportCodes:    make(map[string]string),
+		signupAttempts: make(map[string]int),
+	}
+	env.router.LoadHTMLGlob("../templates/*.tmpl")
+	m := &mailer.Mock{
+		SendEMailVerificationFunc: func(toName string, toEmail string, code string) error {
+			env.codes[toEmail] = code
+			return nil
+		},
+		SendPasswordResetFunc: func(toName string, toEmail string, code string) error {
+			env.codes[toEmail] = code
+			return nil
+		},
+		SendAccountLockedFunc: func(toName string, toEmail string, until time.Time) error {
+			env.locked[toEmail] = until
+			return nil
+		},
+		SendPasswordChangedFunc: func(toName string, toEmail string) error {
+			env.changed[toEmail]++
+			return nil
+		},
+		SendEmailChangeVerificationFunc: func(toName string, toEmail string, code string) error {
+			env.codes[toEmail] = code
+			return nil
+		},
+		SendEmailChangeNoticeFunc: func(toName string, toEmail string, newEmail string, code string) error {
+			env.cancelCodes[toEmail] = code
+			return nil
+		},
+		SendAccountDeletedFunc: func(toName string, toEmail string) error {
+			return nil
+		},
+		SendNewLoginAlertFunc: func(toName string, toEmail string, userAgent string, ip string, at time.Time, code string) error {
+			env.reportCodes[toEmail] = code
+			return nil
+		},
+		SendSignupAttemptFunc: func(toName string, toEmail string) error {
+			env.signupAttempts[toEmail]++
+			return nil
+		},
+	}
+	lockoutTracker := lockout.New(&lockout.Config{UserThreshold: 3, LockoutDuration: 60}, env.db)
+	hasher, err := password.NewHasher(&testHasherConfig)
+	Expect(err).To(BeNil())
+	env.hasher = password.NewPool(hasher, &password.PoolConfig{Workers: 2})
+	t.Cleanup(env.hasher.Close)
+	// no grace period, so tests can purge right away
+	env.webhooks = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.events = append(env.events, r.Header.Get(webhook.HeaderEvent))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(env.webhooks.Close)
+	env.dispatcher = webhook.New(&webhook.Config{
+		Endpoints: []webhook.Endpoint{{Name: "test", URL: env.webhooks.URL, Secret: "secret"}},
+		BatchSize: 10,
+		Timeout:   1,
+	}, env.db)
+	auditLogger, err := audit.New(nil, env.db)
+	Expect(err).To(BeNil())
+	env.outbox = outbox.New(&outbox.Config{BatchSize: 10, MaxAttempts: 3, BaseDelay: 60}, env.db, m, env.dispatcher)
+	env.deletion = deletion.New(&deletion.Config{BatchSize: 10}, env.db, env.outbox)
+	h := New(Dependencies{
+		DB:             env.db,
+		Recaptcha:      recaptcha.New(&recaptcha.Config{Server: recaptchaServer.URL}),
+		Lockout:        lockoutTracker,
+		PasswordPolicy: password.NewPolicy(nil, nil),
+		Hasher:         env.hasher,
+		Deletion:       env.deletion,
+		Exporter:       export.New(env.db),
+		Audit:          auditLogger,
+		Webhooks:       env.dispatcher,
+		Outbox:         env.outbox,
+	}, Options{
+		Verification: options.verification,
+		PrivacyMode:  options.privacyMode,
+		TokenClaims:  []string{ClaimName, ClaimAppMetadata},
+		ServerName:   "z42.com",
+	})
+	h.RegisterHandlers(env.router.Group("/auth"))
+	adminHandler := admin.New(&admin.Config{Keys: []admin.Key{{Name: "test", Key: testAdminKey}}})
+	h.RegisterAdminHandlers(env.router.Group("/admin", adminHandler.MiddlewareFunc()))
+	return env
+}
+
+func (env *testEnv) request(method string, path string, body string, token string) (int, map[string]interface{}) {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	w := env.serve(method, path, body, header)
+	resp := make(map[string]interface{})
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func (env *testEnv) serve(method string, path string, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	// stands in for the background outbox dispatcher
+	_, err := env.outbox.Deliver(context.Background())
+	Expect(err).To(BeNil())
+	return w
+}
+
+func (env *testEnv) adminRequest(method string, path string, body string) int {
+	header := http.Header{}
+	header.Set("X-API-Key", testAdminKey)
+	return env.serve(method, path, body, header).Code
+}
+
+func (env *testEnv) addUser(email string, pw string, status database.UserStatus) database.ObjectId {
+	hash, err := env.hasher.Hash(context.Background(), pw)
+	Expect(err).To(BeNil())
+	id, _, err := env.db.AddUser(context.Background(), database.NewUser{Email: email, Password: hash, Status: status})
+	Expect(err).To(BeNil())
+	return id
+}
+
+func (env *testEnv) login(email string, password string) (int, string) {
+	body := fmt.Sprintf(`{"email": "%s", "password": "%s", "recaptcha_token": "123456"}`, email, password)
+	code, resp := env.request(http.MethodPost, "/auth/login", body, "")
+	token, _ := resp["token"].(string)
+	return code, token
+}
+
+func TestSignupAndVerify(t *testing.T) {
+	env := newTestEnv(t)
+
+	body := `{"email": "user1@example.com", "password": "Tr0ub4dor&3", "recaptcha_token": "123456"}`
+	code, _ := env.request(http.MethodPost, "/auth/signup", body, "")
+	Expect(code).To(Equal(http.StatusCreated))
+	user, err := env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(BeNil())
+	Expect(user.Status).To(Equal(database.UserStatusPending))
+
+	// pending users cannot login
+	code, _ = env.login("user1@example.com", "Tr0ub4dor&3")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+
+	// duplicate signup
+	code, _ = env.request(http.MethodPost, "/auth/signup", body, "")
+	Expect(code).To(Equal(http.StatusConflict))
+
+	code, _ = env.request(http.MethodPost, "/auth/verify?code="+env.codes["user1@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusOK))
+	user, err = env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(BeNil())
+	Expect(user.Status).To(Equal(database.UserStatusActive))
+
+	code, token := env.login("user1@example.com", "Tr0ub4dor&3")
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token)
+	Expect(code).To(Equal(http.StatusOK))
+}
+
+func TestRecoverAndReset(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+
+	code, _ := env.request(http.MethodPost, "/auth/recover", `{"email": "user2@example.com", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusNotFound))
+
+	code, _ = env.request(http.MethodPost, "/auth/recover", `{"email": "user1@example.com", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusOK))
+
+	body := fmt.Sprintf(`{"password": "correct horse battery", "code": "%s", "recaptcha_token": "123456"}`, env.codes["user1@example.com"])
+	code, _ = env.request(http.MethodPatch, "/auth/reset", body, "")
+	Expect(code).To(Equal(http.StatusAccepted))
+
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	code, _ = env.login("user1@example.com", "correct horse battery")
+	Expect(code).To(Equal(http.StatusOK))
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	env := newTestEnv(t)
+	legacy, err := (&password.Bcrypt{Cost: 4}).Hash("password1")
+	Expect(err).To(BeNil())
+	_, _, err = env.db.AddUser(context.Background(), database.NewUser{Email: "user1@example.com", Password: legacy, Status: database.UserStatusActive})
+	Expect(err).To(BeNil())
+
+	code, _ := env.login("user1@example.com", "wrong")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	user, err := env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(BeNil())
+	Expect(user.Password).To(Equal(legacy))
+
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusOK))
+	user, err = env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(BeNil())
+	Expect(user.Password).To(HavePrefix("$argon2id$"))
+	Expect(env.hasher.NeedsRehash(user.Password)).To(BeFalse())
+
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusOK))
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	env := newTestEnv(t)
+
+	code, resp := env.request(http.MethodPost, "/auth/signup", `{"email": "user1@example.com", "password": "12345", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusBadRequest))
+	Expect(resp["data"]).To(HaveKeyWithValue("violations", ContainElement(HaveKeyWithValue("rule", password.RuleMinLength))))
+	_, err := env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(Equal(database.ErrNotFound))
+
+	env.addUser("john.smith@example.com", "password1", database.UserStatusActive)
+	code, _ = env.request(http.MethodPost, "/auth/recover", `{"email": "john.smith@example.com", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusOK))
+	body := fmt.Sprintf(`{"password": "JohnSmith!2024", "code": "%s", "recaptcha_token": "123456"}`, env.codes["john.smith@example.com"])
+	code, resp = env.request(http.MethodPatch, "/auth/reset", body, "")
+	Expect(code).To(Equal(http.StatusBadRequest))
+	Expect(resp["data"]).To(HaveKeyWithValue("violations", ContainElement(HaveKeyWithValue("rule", password.RuleEmail))))
+
+	// invalid codes are rejected before the policy is checked
+	code, _ = env.request(http.MethodPatch, "/auth/reset", `{"password": "x", "code": "invalid", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusNotFound))
+}
+
+func TestLoginLockout(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+
+	for i := 0; i < 3; i++ {
+		code, _ := env.login("user1@example.com", "wrong")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+	}
+	Expect(env.locked).To(HaveKey("user1@example.com"))
+
+	// correct password is rejected while locked
+	body := `{"email": "user1@example.com", "password": "password1", "recaptcha_token": "123456"}`
+	w := env.serve(http.MethodPost, "/auth/login", body, http.Header{})
+	Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+	Expect(w.Header().Get("Retry-After")).To(Equal("60"))
+
+	// unknown users are throttled the same way
+	for i := 0; i < 3; i++ {
+		code, _ := env.login("user2@example.com", "wrong")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+	}
+	code, _ := env.login("user2@example.com", "wrong")
+	Expect(code).To(Equal(http.StatusTooManyRequests))
+	Expect(env.locked).NotTo(HaveKey("user2@example.com"))
+
+	// admin unlock
+	unlockBody := `{"email": "user1@example.com"}`
+	Expect(env.serve(http.MethodPost, "/admin/unlock", unlockBody, http.Header{}).Code).To(Equal(http.StatusUnauthorized))
+	Expect(env.adminRequest(http.MethodPost, "/admin/unlock", unlockBody)).To(Equal(http.StatusOK))
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusOK))
+}
+
+func TestChangePassword(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	_, token1 := env.login("user1@example.com", "password1")
+	_, token2 := env.login("user1@example.com", "password1")
+
+	code, _ := env.request(http.MethodPatch, "/auth/password", `{"current_password": "password1", "password": "correct horse battery"}`, "")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	code, _ = env.request(http.MethodPatch, "/auth/password", `{"current_password": "wrong", "password": "correct horse battery"}`, token1)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, resp := env.request(http.MethodPatch, "/auth/password", `{"current_password": "password1", "password": "12345"}`, token1)
+	Expect(code).To(Equal(http.StatusBadRequest))
+	Expect(resp["data"]).To(HaveKey("violations"))
+	Expect(env.changed).To(BeEmpty())
+
+	code, resp = env.request(http.MethodPatch, "/auth/password", `{"current_password": "password1", "password": "correct horse battery"}`, token1)
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(env.changed["user1@example.com"]).To(Equal(1))
+	token3, _ := resp["token"].(string)
+
+	// all previous sessions are revoked, the new token works
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token1)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token2)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token3)
+	Expect(code).To(Equal(http.StatusOK))
+
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	code, _ = env.login("user1@example.com", "correct horse battery")
+	Expect(code).To(Equal(http.StatusOK))
+}
+
+func TestChangeEmail(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	env.addUser("user2@example.com", "password1", database.UserStatusActive)
+	_, token := env.login("user1@example.com", "password1")
+
+	code, _ := env.request(http.MethodPatch, "/auth/email", `{"email": "user2@example.com", "password": "password1"}`, token)
+	Expect(code).To(Equal(http.StatusConflict))
+	code, _ = env.request(http.MethodPatch, "/auth/email", `{"email": "user3@example.com", "password": "wrong"}`, token)
+	Expect(code).To(Equal(http.StatusForbidden))
+	Expect(env.codes).NotTo(HaveKey("user3@example.com"))
+
+	// cancelled from the old address
+	code, _ = env.request(http.MethodPatch, "/auth/email", `{"email": "user3@example.com", "password": "password1"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	code, _ = env.request(http.MethodPost, "/auth/email/cancel?code="+env.cancelCodes["user1@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodPost, "/auth/email/confirm?code="+env.codes["user3@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusNotFound))
+
+	code, _ = env.request(http.MethodPatch, "/auth/email", `{"email": "user3@example.com", "password": "password1"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	// nothing changes before confirmation
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodPost, "/auth/email/confirm?code="+env.codes["user3@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusOK))
+
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	code, _ = env.login("user3@example.com", "password1")
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token)
+	Expect(code).To(Equal(http.StatusForbidden))
+}
+
+func TestDeleteAccount(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	_, token := env.login("user1@example.com", "password1")
+
+	code, _ := env.request(http.MethodDelete, "/auth/account", `{"password": "wrong"}`, token)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, resp := env.request(http.MethodDelete, "/auth/account", `{"password": "password1"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	Expect(resp["data"]).To(HaveKey("delete_at"))
+	user, err := env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(BeNil())
+	Expect(user.Status).To(Equal(database.UserStatusDeleting))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token)
+	Expect(code).To(Equal(http.StatusForbidden))
+
+	// logging in cancels the deletion
+	code, token = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusOK))
+	user, err = env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(BeNil())
+	Expect(user.Status).To(Equal(database.UserStatusActive))
+	deleted, err := env.deletion.Purge(context.Background())
+	Expect(err).To(BeNil())
+	Expect(deleted).To(BeZero())
+
+	code, _ = env.request(http.MethodDelete, "/auth/account", `{"password": "password1"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	deleted, err = env.deletion.Purge(context.Background())
+	Expect(err).To(BeNil())
+	Expect(deleted).To(Equal(1))
+	_, err = env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(Equal(database.ErrNotFound))
+}
+
+func TestExportAccount(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	_, token := env.login("user1@example.com", "password1")
+
+	code, _ := env.request(http.MethodGet, "/auth/export", "", "")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	w := env.serve(http.MethodGet, "/auth/export", "", header)
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Header().Get("Content-Disposition")).To(HavePrefix("attachment"))
+	var archive export.Archive
+	Expect(json.Unmarshal(w.Body.Bytes(), &archive)).To(Succeed())
+	Expect(archive.Format).To(Equal(export.Format))
+	Expect(archive.Profile.Email).To(Equal("user1@example.com"))
+	Expect(w.Body.String()).NotTo(ContainSubstring("argon2"))
+}
+
+func TestProfile(t *testing.T) {
+	env := newTestEnv(t)
+	id := env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	_, token := env.login("user1@example.com", "password1")
+
+	code, resp := env.request(http.MethodGet, "/auth/me", "", token)
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(resp["data"]).To(And(
+		HaveKeyWithValue("email", "user1@example.com"),
+		HaveKeyWithValue("display_name", ""),
+		HaveKeyWithValue("user_metadata", BeEmpty()),
+		HaveKey("last_login"),
+		Not(HaveKey("password")),
+	))
+
+	body := `{"display_name": "User One", "locale": "en-US", "timezone": "Europe/Berlin", "user_metadata": {"theme": "dark", "lang": "en"}}`
+	code, resp = env.request(http.MethodPatch, "/auth/me", body, token)
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(resp["data"]).To(And(
+		HaveKeyWithValue("display_name", "User One"),
+		HaveKeyWithValue("timezone", "Europe/Berlin"),
+		HaveKeyWithValue("user_metadata", Equal(map[string]interface{}{"theme": "dark", "lang": "en"})),
+	))
+
+	// only given fields change, metadata is merged
+	code, resp = env.request(http.MethodPatch, "/auth/me", `{"locale": "de", "user_metadata": {"lang": null}}`, token)
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(resp["data"]).To(And(
+		HaveKeyWithValue("display_name", "User One"),
+		HaveKeyWithValue("locale", "de"),
+		HaveKeyWithValue("user_metadata", Equal(map[string]interface{}{"theme": "dark"})),
+	))
+
+	for _, body := range []string{
+		`{"timezone": "Mars/Olympus"}`,
+		`{"locale": "not a locale"}`,
+		`{"avatar_url": "http://example.com/a.png"}`,
+		`{"user_metadata": [1, 2]}`,
+	} {
+		code, _ = env.request(http.MethodPatch, "/auth/me", body, token)
+		Expect(code).To(Equal(http.StatusBadRequest), body)
+	}
+
+	// app metadata is only writable by admins
+	code, _ = env.request(http.MethodPatch, "/auth/me", `{"app_metadata": {"roles": ["admin"]}}`, token)
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(env.serve(http.MethodPatch, "/admin/users/"+string(id)+"/app_metadata", `{"plan": "pro"}`, http.Header{}).Code).To(Equal(http.StatusUnauthorized))
+	Expect(env.adminRequest(http.MethodPatch, "/admin/users/"+string(id)+"/app_metadata", `{"plan": "pro"}`)).To(Equal(http.StatusOK))
+	Expect(env.adminRequest(http.MethodPatch, "/admin/users/unknown/app_metadata", `{"plan": "pro"}`)).To(Equal(http.StatusNotFound))
+	user, err := env.db.GetUserById(context.Background(), id)
+	Expect(err).To(BeNil())
+	Expect(user.AppMetadata).To(MatchJSON(`{"plan": "pro"}`))
+
+	// configured profile fields are embedded in new tokens
+	_, token = env.login("user1@example.com", "password1")
+	claims, err := jwtClaims(token)
+	Expect(err).To(BeNil())
+	Expect(claims).To(HaveKeyWithValue(ClaimName, "User One"))
+	Expect(claims).To(HaveKeyWithValue(ClaimAppMetadata, map[string]interface{}{"plan": "pro"}))
+	Expect(claims).NotTo(HaveKey(ClaimUserMetadata))
+}
+
+func TestProfileETag(t *testing.T) {
+	env := newTestEnv(t)
+	id := env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	Expect(env.db.SetAppMetadata(context.Background(), id, json.RawMessage(`{"roles": ["admin", 7, "editor"]}`), time.Now())).To(Succeed())
+	_, token := env.login("user1@example.com", "password1")
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+
+	w := env.serve(http.MethodGet, "/auth/me", "", header)
+	Expect(w.Code).To(Equal(http.StatusOK))
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+	Expect(resp.Data).To(HaveKeyWithValue("roles", []interface{}{"admin", "editor"}))
+	Expect(resp.Data).To(HaveKeyWithValue("mfa", HaveKeyWithValue("enabled", false)))
+	etag := w.Header().Get("ETag")
+	Expect(etag).NotTo(BeEmpty())
+
+	header.Set("If-None-Match", etag)
+	w = env.serve(http.MethodGet, "/auth/me", "", header)
+	Expect(w.Code).To(Equal(http.StatusNotModified))
+	Expect(w.Body.Len()).To(BeZero())
+
+	// updates with a stale etag are rejected
+	header.Del("If-None-Match")
+	header.Set("If-Match", etag)
+	Expect(env.serve(http.MethodPatch, "/auth/me", `{"display_name": "User One"}`, header).Code).To(Equal(http.StatusOK))
+	Expect(env.serve(http.MethodPatch, "/auth/me", `{"display_name": "User Two"}`, header).Code).To(Equal(http.StatusPreconditionFailed))
+
+	header.Del("If-Match")
+	header.Set("If-None-Match", etag)
+	w = env.serve(http.MethodGet, "/auth/me", "", header)
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Header().Get("ETag")).NotTo(Equal(etag))
+}
+
+func TestSessions(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	env.addUser("user2@example.com", "password1", database.UserStatusActive)
+	_, token1 := env.login("user1@example.com", "password1")
+	_, token2 := env.login("user1@example.com", "password1")
+	_, token3 := env.login("user1@example.com", "password1")
+	_, other := env.login("user2@example.com", "password1")
+
+	code, resp := env.request(http.MethodGet, "/auth/sessions", "", token1)
+	Expect(code).To(Equal(http.StatusOK))
+	sessions, _ := resp["data"].([]interface{})
+	Expect(sessions).To(HaveLen(3))
+	claims, err := jwtClaims(token2)
+	Expect(err).To(BeNil())
+	Expect(claims).To(HaveKey(sessionKey))
+	Expect(sessions).To(ContainElement(And(
+		HaveKeyWithValue("current", true),
+		HaveKeyWithValue("ip", "192.0.2.1"),
+	)))
+
+	// refreshed tokens stay in the session
+	code, resp = env.request(http.MethodGet, "/auth/refresh_token", "", token2)
+	Expect(code).To(Equal(http.StatusOK))
+	refreshed, _ := resp["token"].(string)
+	refreshedClaims, err := jwtClaims(refreshed)
+	Expect(err).To(BeNil())
+	Expect(refreshedClaims[sessionKey]).To(Equal(claims[sessionKey]))
+	Expect(refreshedClaims[generationKey]).To(BeNumerically("==", 1))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", refreshed)
+	Expect(code).To(Equal(http.StatusOK))
+
+	// sessions of other users cannot be revoked
+	otherClaims, err := jwtClaims(other)
+	Expect(err).To(BeNil())
+	code, _ = env.request(http.MethodDelete, "/auth/sessions/"+otherClaims[sessionKey].(string), "", token1)
+	Expect(code).To(Equal(http.StatusNotFound))
+
+	code, _ = env.request(http.MethodDelete, "/auth/sessions/"+claims[sessionKey].(string), "", token1)
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token2)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", refreshed)
+	Expect(code).To(Equal(http.StatusForbidden))
+
+	code, _ = env.request(http.MethodDelete, "/auth/sessions", "", token1)
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token3)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, resp = env.request(http.MethodGet, "/auth/sessions", "", token1)
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(resp["data"]).To(HaveLen(1))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", other)
+	Expect(code).To(Equal(http.StatusOK))
+
+	// logging out ends the session
+	code, _ = env.request(http.MethodPost, "/auth/logout", "", token1)
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token1)
+	Expect(code).To(Equal(http.StatusForbidden))
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	env := newTestEnv(t)
+	userId := env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	_, token1 := env.login("user1@example.com", "password1")
+	code, resp := env.request(http.MethodGet, "/auth/refresh_token", "", token1)
+	Expect(code).To(Equal(http.StatusOK))
+	token2, _ := resp["token"].(string)
+
+	// a refreshed token is no longer accepted
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token1)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, resp = env.request(http.MethodGet, "/auth/refresh_token", "", token2)
+	Expect(code).To(Equal(http.StatusOK))
+	token3, _ := resp["token"].(string)
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token3)
+	Expect(code).To(Equal(http.StatusOK))
+
+	// refreshing it again revokes the whole session
+	code, _ = env.request(http.MethodGet, "/auth/refresh_token", "", token1)
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token3)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, _ = env.request(http.MethodGet, "/auth/refresh_token", "", token3)
+	Expect(code).To(Equal(http.StatusForbidden))
+	sessions, err := env.db.GetSessions(context.Background(), userId)
+	Expect(err).To(BeNil())
+	Expect(sessions).To(BeEmpty())
+	events, err := env.db.GetAuditEvents(context.Background(), database.AuditFilter{Type: string(audit.EventTokenReuse), Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(events).To(HaveLen(1))
+	Expect(events[0].Target).To(Equal(string(userId)))
+
+	// other logins of the user are not affected
+	_, token4 := env.login("user1@example.com", "password1")
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token4)
+	Expect(code).To(Equal(http.StatusOK))
+}
+
+func TestNewLoginAlert(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	login := func(userAgent string, ip string) string {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email": "user1@example.com", "password": "password1", "recaptcha_token": "123456"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		env.router.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		_, err := env.outbox.Deliver(context.Background())
+		Expect(err).To(BeNil())
+		var resp authenticationToken
+		Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+		return resp.Token
+	}
+
+	// the first login and logins from known devices are not alerted
+	token := login("browser", "1.1.1.1")
+	login("browser", "1.1.1.2")
+	Expect(env.reportCodes).To(BeEmpty())
+
+	login("other browser", "1.1.1.1")
+	Expect(env.reportCodes).To(HaveKey("user1@example.com"))
+	delete(env.reportCodes, "user1@example.com")
+	login("browser", "2.2.2.2")
+	Expect(env.reportCodes).To(HaveKey("user1@example.com"))
+
+	// reporting logs out everyone and forces a password reset
+	code, _ := env.request(http.MethodPost, "/auth/sessions/report?code=invalid", "", "")
+	Expect(code).To(Equal(http.StatusNotFound))
+	code, _ = env.request(http.MethodPost, "/auth/sessions/report?code="+env.reportCodes["user1@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodGet, "/auth/check", "", token)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, _ = env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	Expect(env.codes).To(HaveKey("user1@example.com"))
+
+	body := fmt.Sprintf(`{"password": "correct horse battery", "code": "%s", "recaptcha_token": "123456"}`, env.codes["user1@example.com"])
+	code, _ = env.request(http.MethodPatch, "/auth/reset", body, "")
+	Expect(code).To(Equal(http.StatusAccepted))
+	code, _ = env.login("user1@example.com", "correct horse battery")
+	Expect(code).To(Equal(http.StatusOK))
+}
+
+func TestReauthenticateWithoutPassword(t *testing.T) {
+	env := newTestEnv(t)
+	id := env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	_, token := env.login("user1@example.com", "password1")
+
+	// a password cleared by a login report matches nothing
+	Expect(env.db.SetPassword(context.Background(), id, "")).To(Succeed())
+	code, _ := env.request(http.MethodPatch, "/auth/password", `{"current_password": "password1", "password": "correct horse battery"}`, token)
+	Expect(code).To(Equal(http.StatusForbidden))
+	code, _ = env.request(http.MethodPatch, "/auth/email", `{"email": "user2@example.com", "password": "password1"}`, token)
+	Expect(code).To(Equal(http.StatusForbidden))
+
+	// neither does a hash the hasher cannot read
+	Expect(env.db.SetPassword(context.Background(), id, "legacy$hash")).To(Succeed())
+	code, _ = env.request(http.MethodDelete, "/auth/account", `{"password": "password1"}`, token)
+	Expect(code).To(Equal(http.StatusForbidden))
+}
+
+func TestIPNetwork(t *testing.T) {
+	RegisterTestingT(t)
+	Expect(ipNetwork("192.0.2.17")).To(Equal("192.0.2.0/24"))
+	Expect(ipNetwork("2001:db8:1:2::1")).To(Equal("2001:db8:1::/48"))
+	Expect(ipNetwork("unknown")).To(Equal("unknown"))
+}
+
+func TestAuditLog(t *testing.T) {
+	env := newTestEnv(t)
+	code, _ := env.request(http.MethodPost, "/auth/signup", `{"email": "user1@example.com", "password": "Tr0ub4dor&3", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusCreated))
+	code, _ = env.request(http.MethodPost, "/auth/verify?code="+env.codes["user1@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusOK))
+	user, err := env.db.GetUser(context.Background(), "user1@example.com")
+	Expect(err).To(BeNil())
+	code, _ = env.login("user1@example.com", "wrong")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	code, _ = env.login("user2@example.com", "wrong")
+	Expect(code).To(Equal(http.StatusUnauthorized))
+	code, token := env.login("user1@example.com", "Tr0ub4dor&3")
+	Expect(code).To(Equal(http.StatusOK))
+	code, _ = env.request(http.MethodPost, "/auth/logout", "", token)
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(env.adminRequest(http.MethodPost, "/admin/unlock", `{"email": "user2@example.com"}`)).To(Equal(http.StatusOK))
+
+	query := func(params string) (int, []interface{}, interface{}) {
+		header := http.Header{}
+		header.Set("X-API-Key", testAdminKey)
+		w := env.serve(http.MethodGet, "/admin/audit"+params, "", header)
+		var resp struct {
+			Data struct {
+				Events []interface{} `json:"events"`
+				Next   interface{}   `json:"next"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data.Events, resp.Data.Next
+	}
+	types := func(events []interface{}) []string {
+		var t []string
+		for _, e := range events {
+			t = append(t, e.(map[string]interface{})["type"].(string))
+		}
+		return t
+	}
+
+	code, events, next := query("")
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(types(events)).To(Equal([]string{
+		string(audit.EventAdminUnlock),
+		string(audit.EventLogout),
+		string(audit.EventLoginSuccess),
+		string(audit.EventLoginFailure),
+		string(audit.EventLoginFailure),
+		string(audit.EventVerify),
+		string(audit.EventSignup),
+	}))
+	Expect(next).To(BeNil())
+	Expect(events[0]).To(And(
+		HaveKeyWithValue("actor", "admin:test"),
+		HaveKeyWithValue("target", "user2@example.com"),
+	))
+	Expect(events[3]).To(And(
+		HaveKeyWithValue("target", "user2@example.com"),
+		HaveKeyWithValue("detail", "unknown_user"),
+		HaveKeyWithValue("ip", "192.0.2.1"),
+	))
+
+	_, events, _ = query("?type=login_failure&target=" + string(user.Id))
+	Expect(events).To(HaveLen(1))
+	Expect(events[0]).To(HaveKeyWithValue("detail", "password_mismatch"))
+	_, events, _ = query("?actor=" + string(user.Id))
+	Expect(types(events)).To(Equal([]string{string(audit.EventLogout), string(audit.EventLoginSuccess)}))
+	_, events, _ = query("?from=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	Expect(events).To(BeEmpty())
+
+	// pagination
+	_, events, next = query("?limit=4")
+	Expect(events).To(HaveLen(4))
+	Expect(next).NotTo(BeNil())
+	_, events, next = query(fmt.Sprintf("?limit=4&before=%v", next))
+	Expect(types(events)).To(Equal([]string{string(audit.EventLoginFailure), string(audit.EventVerify), string(audit.EventSignup)}))
+	Expect(next).To(BeNil())
+
+	code, _, _ = query("?limit=1000")
+	Expect(code).To(Equal(http.StatusBadRequest))
+	code, _, _ = query("?from=yesterday")
+	Expect(code).To(Equal(http.StatusBadRequest))
+	Expect(env.serve(http.MethodGet, "/admin/audit", "", http.Header{}).Code).To(Equal(http.StatusUnauthorized))
+}
+
+func TestResendVerification(t *testing.T) {
+	env := newTestEnv(t)
+	body := `{"email": "user1@example.com", "password": "Tr0ub4dor&3", "recaptcha_token": "123456"}`
+	code, _ := env.request(http.MethodPost, "/auth/signup", body, "")
+	Expect(code).To(Equal(http.StatusCreated))
+	firstCode := env.codes["user1@example.com"]
+	Expect(firstCode).NotTo(BeEmpty())
+
+	code, resp := env.request(http.MethodPost, "/auth/verify/resend", `{"email": "user1@example.com", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusOK))
+	secondCode := env.codes["user1@example.com"]
+	Expect(secondCode).NotTo(Equal(firstCode))
+
+	// unknown and verified addresses get the same answer and no mail
+	code, unknown := env.request(http.MethodPost, "/auth/verify/resend", `{"email": "user2@example.com", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(unknown).To(Equal(resp))
+	Expect(env.codes).NotTo(HaveKey("user2@example.com"))
+
+	code, _ = env.request(http.MethodPost, "/auth/verify?code="+firstCode, "", "")
+	Expect(code).To(Equal(http.StatusNotFound))
+	code, _ = env.request(http.MethodPost, "/auth/verify?code="+secondCode, "", "")
+	Expect(code).To(Equal(http.StatusOK))
+	code, verified := env.request(http.MethodPost, "/auth/verify/resend", `{"email": "user1@example.com", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusOK))
+	Expect(verified).To(Equal(resp))
+	Expect(env.codes["user1@example.com"]).To(Equal(secondCode))
+
+	code, _ = env.request(http.MethodPost, "/auth/verify/resend", `{}`, "")
+	Expect(code).To(Equal(http.StatusBadRequest))
+}
+
+func TestPrivacyMode(t *testing.T) {
+	for _, privacyMode := range []bool{false, true} {
+		env := newTestEnvWith(t, testOptions{privacyMode: privacyMode})
+		env.addUser("user1@example.com", "Tr0ub4dor&3", database.UserStatusActive)
+
+		// signing up with a taken address
+		body := `{"email": "user1@example.com", "password": "correct horse battery", "recaptcha_token": "123456"}`
+		code, taken := env.request(http.MethodPost, "/auth/signup", body, "")
+		body = `{"email": "user2@example.com", "password": "correct horse battery", "recaptcha_token": "123456"}`
+		_, created := env.request(http.MethodPost, "/auth/signup", body, "")
+		if privacyMode {
+			Expect(code).To(Equal(http.StatusCreated))
+			Expect(taken).To(Equal(created))
+			Expect(env.signupAttempts["user1@example.com"]).To(Equal(1))
+			user, err := env.db.GetUser(context.Background(), "user1@example.com")
+			Expect(err).To(BeNil())
+			Expect(env.hasher.Verify(context.Background(), "Tr0ub4dor&3", user.Password)).To(BeTrue())
+		} else {
+			Expect(code).To(Equal(http.StatusConflict))
+			Expect(env.signupAttempts).To(BeEmpty())
+		}
+
+		// recovering an unknown address
+		code, unknown := env.request(http.MethodPost, "/auth/recover", `{"email": "user3@example.com", "recaptcha_token": "123456"}`, "")
+		_, known := env.request(http.MethodPost, "/auth/recover", `{"email": "user1@example.com", "recaptcha_token": "123456"}`, "")
+		if privacyMode {
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(unknown).To(Equal(known))
+		} else {
+			Expect(code).To(Equal(http.StatusNotFound))
+		}
+		Expect(env.codes).NotTo(HaveKey("user3@example.com"))
+
+		// logins of unknown, pending and existing users fail alike
+		code, _ = env.login("user3@example.com", "Tr0ub4dor&3")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+		code, _ = env.login("user2@example.com", "correct horse battery")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+		code, _ = env.login("user1@example.com", "wrong password")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+	}
+}
+
+func TestVerifyRedirect(t *testing.T) {
+	env := newTestEnvWith(t, testOptions{verification: &VerificationConfig{
+		SuccessURL: "https://www.example.com/verified",
+		FailureURL: "https://www.example.com/verify-failed?lang=en",
+		Clients: []Client{
+			{Id: "app", RedirectURIs: []string{"https://app.example.com/welcome"}},
+			{Id: "other", RedirectURIs: []string{"https://other.example.com/welcome"}},
+		},
+	}})
+	signup := func(email string, client string, redirectURI string) int {
+		body := fmt.Sprintf(`{"email": "%s", "password": "Tr0ub4dor&3", "client_id": "%s", "redirect_uri": "%s", "recaptcha_token": "123456"}`, email, client, redirectURI)
+		code, _ := env.request(http.MethodPost, "/auth/signup", body, "")
+		return code
+	}
+
+	// redirect uris must be registered for the client
+	Expect(signup("user1@example.com", "app", "https://evil.example.com/")).To(Equal(http.StatusBadRequest))
+	Expect(signup("user1@example.com", "other", "https://app.example.com/welcome")).To(Equal(http.StatusBadRequest))
+	Expect(signup("user1@example.com", "", "https://app.example.com/welcome")).To(Equal(http.StatusBadRequest))
+	Expect(env.codes).To(BeEmpty())
+
+	Expect(signup("user1@example.com", "app", "https://app.example.com/welcome")).To(Equal(http.StatusCreated))
+	w := env.serve(http.MethodPost, "/auth/verify?code="+env.codes["user1@example.com"], "", http.Header{})
+	Expect(w.Code).To(Equal(http.StatusSeeOther))
+	Expect(w.Header().Get("Location")).To(Equal("https://app.example.com/welcome?status=verified"))
+
+	// without a redirect uri users go to the success url
+	Expect(signup("user2@example.com", "", "")).To(Equal(http.StatusCreated))
+	w = env.serve(http.MethodPost, "/auth/verify?code="+env.codes["user2@example.com"], "", http.Header{})
+	Expect(w.Code).To(Equal(http.StatusSeeOther))
+	Expect(w.Header().Get("Location")).To(Equal("https://www.example.com/verified?status=verified"))
+
+	// a resend may change the redirect uri
+	Expect(signup("user3@example.com", "app", "https://app.example.com/welcome")).To(Equal(http.StatusCreated))
+	code, _ := env.request(http.MethodPost, "/auth/verify/resend", `{"email": "user3@example.com", "client_id": "other", "redirect_uri": "https://app.example.com/welcome", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusBadRequest))
+	code, _ = env.request(http.MethodPost, "/auth/verify/resend", `{"email": "user3@example.com", "client_id": "other", "redirect_uri": "https://other.example.com/welcome", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusOK))
+	w = env.serve(http.MethodPost, "/auth/verify?code="+env.codes["user3@example.com"], "", http.Header{})
+	Expect(w.Header().Get("Location")).To(Equal("https://other.example.com/welcome?status=verified"))
+
+	// failures go to the failure url
+	w = env.serve(http.MethodPost, "/auth/verify?code="+env.codes["user1@example.com"], "", http.Header{})
+	Expect(w.Code).To(Equal(http.StatusSeeOther))
+	Expect(w.Header().Get("Location")).To(Equal("https://www.example.com/verify-failed?error=invalid_code&lang=en"))
+	w = env.serve(http.MethodPost, "/auth/verify", "", http.Header{})
+	Expect(w.Header().Get("Location")).To(Equal("https://www.example.com/verify-failed?error=invalid_request&lang=en"))
+}
+
+func TestVerifyPage(t *testing.T) {
+	env := newTestEnv(t)
+	code, _ := env.request(http.MethodPost, "/auth/signup", `{"email": "user1@example.com", "password": "Tr0ub4dor&3", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusCreated))
+
+	// without redirects the page is rendered and errors are json
+	w := env.serve(http.MethodPost, "/auth/verify?code="+env.codes["user1@example.com"], "", http.Header{})
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Header().Get("Content-Type")).To(HavePrefix("text/html"))
+	Expect(w.Body.String()).To(ContainSubstring("https://z42.com/login"))
+	w = env.serve(http.MethodPost, "/auth/verify?code="+env.codes["user1@example.com"], "", http.Header{})
+	Expect(w.Code).To(Equal(http.StatusNotFound))
+	Expect(w.Header().Get("Content-Type")).To(HavePrefix("application/json"))
+
+	// redirect uris cannot be used without registered clients
+	code, _ = env.request(http.MethodPost, "/auth/signup", `{"email": "user2@example.com", "password": "Tr0ub4dor&3", "client_id": "app", "redirect_uri": "https://app.example.com/welcome", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusBadRequest))
+}
+
+func TestTextMailLinks(t *testing.T) {
+	env := newTestEnv(t)
+	mails, err := texttemplate.ParseGlob("../templates/*.txt")
+	Expect(err).To(BeNil())
+	link := regexp.MustCompile(`https://z42\.com(/\S+)`)
+	action := regexp.MustCompile(`<form method="post" action="([^"]+)"`)
+	// follow opens the link of a text mail and confirms the page it gets
+	follow := func(name string, data map[string]string) *httptest.ResponseRecorder {
+		data["Server"] = "z42.com"
+		var text strings.Builder
+		Expect(mails.ExecuteTemplate(&text, name, data)).To(Succeed())
+		match := link.FindStringSubmatch(text.String())
+		Expect(match).NotTo(BeNil())
+		w := env.serve(http.MethodGet, match[1], "", http.Header{})
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("Content-Type")).To(HavePrefix("text/html"))
+		form := action.FindStringSubmatch(w.Body.String())
+		Expect(form).NotTo(BeNil())
+		Expect(form[1]).To(Equal(match[1]))
+		return env.serve(http.MethodPost, form[1], "", http.Header{})
+	}
+
+	code, _ := env.request(http.MethodPost, "/auth/signup", `{"email": "user1@example.com", "password": "Tr0ub4dor&3", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusCreated))
+	w := follow("verification-email.txt", map[string]string{"Code": env.codes["user1@example.com"]})
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Body.String()).To(ContainSubstring("Your account is now active"))
+	_, token := env.login("user1@example.com", "Tr0ub4dor&3")
+
+	code, _ = env.request(http.MethodPatch, "/auth/email", `{"email": "user2@example.com", "password": "Tr0ub4dor&3"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	w = follow("email-change-notice-email.txt", map[string]string{"NewEmail": "user2@example.com", "Code": env.cancelCodes["user1@example.com"]})
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Body.String()).To(ContainSubstring("has been cancelled"))
+
+	code, _ = env.request(http.MethodPatch, "/auth/email", `{"email": "user3@example.com", "password": "Tr0ub4dor&3"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	// opening the link alone changes nothing
+	w = env.serve(http.MethodGet, "/auth/email/confirm?code="+env.codes["user3@example.com"], "", http.Header{})
+	Expect(w.Code).To(Equal(http.StatusOK))
+	code, _ = env.login("user1@example.com", "Tr0ub4dor&3")
+	Expect(code).To(Equal(http.StatusOK))
+	w = follow("email-change-verification-email.txt", map[string]string{"Code": env.codes["user3@example.com"]})
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Body.String()).To(ContainSubstring("Your email address has been changed"))
+
+	header := http.Header{}
+	header.Set("User-Agent", "other browser")
+	w = env.serve(http.MethodPost, "/auth/login", `{"email": "user3@example.com", "password": "Tr0ub4dor&3", "recaptcha_token": "123456"}`, header)
+	Expect(w.Code).To(Equal(http.StatusOK))
+	w = follow("new-login-email.txt", map[string]string{"Code": env.reportCodes["user3@example.com"]})
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Body.String()).To(ContainSubstring("All sessions of your account have been logged out"))
+
+	w = env.serve(http.MethodGet, "/auth/verify", "", http.Header{})
+	Expect(w.Code).To(Equal(http.StatusBadRequest))
+}
+
+func TestWebhooks(t *testing.T) {
+	env := newTestEnv(t)
+	code, _ := env.request(http.MethodPost, "/auth/signup", `{"email": "user1@example.com", "password": "Tr0ub4dor&3", "recaptcha_token": "123456"}`, "")
+	Expect(code).To(Equal(http.StatusCreated))
+	code, _ = env.request(http.MethodPost, "/auth/verify?code="+env.codes["user1@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusOK))
+	_, token := env.login("user1@example.com", "Tr0ub4dor&3")
+	code, _ = env.request(http.MethodPatch, "/auth/email", `{"email": "user2@example.com", "password": "Tr0ub4dor&3"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	code, _ = env.request(http.MethodPost, "/auth/email/confirm?code="+env.codes["user2@example.com"], "", "")
+	Expect(code).To(Equal(http.StatusOK))
+	_, token = env.login("user2@example.com", "Tr0ub4dor&3")
+	code, _ = env.request(http.MethodDelete, "/auth/account", `{"password": "Tr0ub4dor&3"}`, token)
+	Expect(code).To(Equal(http.StatusAccepted))
+	_, err := env.deletion.Purge(context.Background())
+	Expect(err).To(BeNil())
+	_, err = env.outbox.Deliver(context.Background())
+	Expect(err).To(BeNil())
+
+	delivered, err := env.dispatcher.Deliver(context.Background())
+	Expect(err).To(BeNil())
+	Expect(delivered).To(Equal(4))
+	Expect(env.events).To(Equal([]string{
+		webhook.EventUserCreated,
+		webhook.EventUserVerified,
+		webhook.EventUserEmailChanged,
+		webhook.EventUserDeleted,
+	}))
+
+	header := http.Header{}
+	header.Set("X-API-Key", testAdminKey)
+	w := env.serve(http.MethodGet, "/admin/webhooks/deliveries?status=delivered&limit=3", "", header)
+	Expect(w.Code).To(Equal(http.StatusOK))
+	var resp struct {
+		Data struct {
+			Deliveries []webhook.Delivery `json:"deliveries"`
+			Next       int64              `json:"next"`
+		} `json:"data"`
+	}
+	Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+	Expect(resp.Data.Deliveries).To(HaveLen(3))
+	Expect(resp.Data.Deliveries[0].Event).To(Equal(webhook.EventUserDeleted))
+	Expect(resp.Data.Deliveries[0].Attempts).To(Equal(1))
+	Expect(resp.Data.Next).NotTo(BeZero())
+	Expect(env.serve(http.MethodGet, "/admin/webhooks/deliveries?status=unknown", "", header).Code).To(Equal(http.StatusBadRequest))
+	Expect(env.serve(http.MethodGet, "/admin/webhooks/deliveries", "", http.Header{}).Code).To(Equal(http.StatusUnauthorized))
+}
+
+// jwtClaims decodes the payload of token without checking its signature.
+func jwtClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+func TestHashingMetrics(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("user1@example.com", "password1", database.UserStatusActive)
+	code, _ := env.login("user1@example.com", "password1")
+	Expect(code).To(Equal(http.StatusOK))
+
+	header := http.Header{}
+	header.Set("X-API-Key", testAdminKey)
+	w := env.serve(http.MethodGet, "/admin/metrics/hashing", "", header)
+	Expect(w.Code).To(Equal(http.StatusOK))
+	var resp struct {
+		Data password.PoolStats `json:"data"`
+	}
+	Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(BeNil())
+	Expect(resp.Data.Workers).To(Equal(2))
+	Expect(resp.Data.Completed).To(Equal(int64(2)))
+	Expect(resp.Data.Rejected).To(BeZero())
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	m.Run()
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"auth/admin"
+	"auth/audit"
+	"auth/common"
+	"auth/database"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// claims that can be embedded in tokens, named after the OpenID Connect
+// standard claims where there is one.
+const (
+	ClaimName         = "name"
+	ClaimLocale       = "locale"
+	ClaimZoneinfo     = "zoneinfo"
+	ClaimPicture      = "picture"
+	ClaimAppMetadata  = "app_metadata"
+	ClaimUserMetadata = "user_metadata"
+)
+
+var profileClaims = map[string]func(u database.User) interface{}{
+	ClaimName:         func(u database.User) interface{} { return u.Profile.DisplayName },
+	ClaimLocale:       func(u database.User) interface{} { return u.Profile.Locale },
+	ClaimZoneinfo:     func(u database.User) interface{} { return u.Profile.Timezone },
+	ClaimPicture:      func(u database.User) interface{} { return u.Profile.AvatarURL },
+	ClaimAppMetadata:  func(u database.User) interface{} { return metadata(u.AppMetadata) },
+	ClaimUserMetadata: func(u database.User) interface{} { return metadata(u.UserMetadata) },
+}
+
+const (
+	maxDisplayNameLength = 100
+	maxAvatarURLLength   = 2048
+	maxMetadataSize      = 16 << 10
+)
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// identity is what gets embedded in the tokens of user.
+func (h *Handler) identity(user database.User) *IdentityData {
+	claims := make(map[string]interface{})
+	for _, name := range h.tokenClaims {
+		claims[name] = profileClaims[name](user)
+	}
+	return &IdentityData{Id: user.Id, Email: user.Email, TokenVersion: user.TokenVersion, Claims: claims}
+}
+
+// profile is what users get to see about themselves, it must never include
+// secrets like the password hash.
+type profile struct {
+	Id           database.ObjectId   `json:"id"`
+	Email        string              `json:"email"`
+	Status       database.UserStatus `json:"status"`
+	Roles        []string            `json:"roles"`
+	MFA          mfaState            `json:"mfa"`
+	DisplayName  string              `json:"display_name"`
+	Locale       string              `json:"locale"`
+	Timezone     string              `json:"timezone"`
+	AvatarURL    string              `json:"avatar_url"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+	LastLogin    *time.Time          `json:"last_login,omitempty"`
+	AppMetadata  json.RawMessage     `json:"app_metadata"`
+	UserMetadata json.RawMessage     `json:"user_metadata"`
+}
+
+// mfaState reports the second factors of a user, there are none yet.
+type mfaState struct {
+	Enabled bool `json:"enabled"`
+}
+
+func newProfile(u database.User) profile {
+	p := profile{
+		Id:           u.Id,
+		Email:        u.Email,
+		Status:       u.Status,
+		Roles:        roles(u),
+		DisplayName:  u.Profile.DisplayName,
+		Locale:       u.Profile.Locale,
+		Timezone:     u.Profile.Timezone,
+		AvatarURL:    u.Profile.AvatarURL,
+		CreatedAt:    u.CreatedAt,
+		UpdatedAt:    u.UpdatedAt,
+		AppMetadata:  metadata(u.AppMetadata),
+		UserMetadata: metadata(u.UserMetadata),
+	}
+	if !u.LastLogin.IsZero() {
+		p.LastLogin = &u.LastLogin
+	}
+	return p
+}
+
+// getProfile returns the profile of the logged-in user. responses carry an
+// ETag, clients sending it back in If-None-Match get 304 while nothing
+// changed.
+func (h *Handler) getProfile(c *gin.Context) {
+	user, err := h.db.GetUserById(c.Request.Context(), ExtractUser(c))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	p := newProfile(user)
+	etag, err := profileETag(p)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusInternalServerError, "cannot encode profile", err)
+		return
+	}
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	common.SuccessResponse(c, http.StatusOK, "successful", p)
+}
+
+// updateProfile changes the given attributes of the logged-in user, user
+// metadata is applied as a json merge patch. with If-Match the update is only
+// applied if the profile is unchanged since the client read it.
+func (h *Handler) updateProfile(c *gin.Context) {
+	var r profileUpdate
+	err := c.ShouldBindBodyWith(&r, binding.JSON)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid profile update", err)
+		return
+	}
+	user, err := h.db.GetUserById(c.Request.Context(), ExtractUser(c))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		etag, err := profileETag(newProfile(user))
+		if err != nil {
+			common.ErrorResponse(c, http.StatusInternalServerError, "cannot encode profile", err)
+			return
+		}
+		if !etagMatches(ifMatch, etag) {
+			common.ErrorResponse(c, http.StatusPreconditionFailed, "profile has been changed", nil)
+			return
+		}
+	}
+	p := user.Profile
+	if r.DisplayName != nil {
+		p.DisplayName = *r.DisplayName
+	}
+	if r.Locale != nil {
+		p.Locale = *r.Locale
+	}
+	if r.Timezone != nil {
+		p.Timezone = *r.Timezone
+	}
+	if r.AvatarURL != nil {
+		p.AvatarURL = *r.AvatarURL
+	}
+	if err := validateProfile(p); err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	userMetadata := user.UserMetadata
+	if r.UserMetadata != nil {
+		userMetadata, err = mergeMetadata(userMetadata, r.UserMetadata)
+		if err != nil {
+			common.ErrorResponse(c, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+	}
+	err = h.db.UpdateProfile(c.Request.Context(), user.Id, p, userMetadata, time.Now())
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.getProfile(c)
+}
+
+// updateAppMetadata applies a json merge patch to the app metadata of a user.
+func (h *Handler) updateAppMetadata(c *gin.Context) {
+	patch, err := c.GetRawData()
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid app metadata", err)
+		return
+	}
+	user, err := h.db.GetUserById(c.Request.Context(), database.ObjectId(c.Param("id")))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	appMetadata, err := mergeMetadata(user.AppMetadata, patch)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	err = h.db.SetAppMetadata(c.Request.Context(), user.Id, appMetadata, time.Now())
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	zap.L().Info("app metadata updated",
+		zap.String("user", string(user.Id)),
+		zap.String("admin", admin.KeyName(c)),
+	)
+	h.audit.Record(c, audit.EventAdminAppMetadata, adminActor(c), string(user.Id), "")
+
+	common.SuccessResponse(c, http.StatusOK, "app metadata updated", metadata(appMetadata))
+}
+
+func validateProfile(p database.Profile) error {
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		return errors.New("display name is too long")
+	}
+	if p.Locale != "" && !localePattern.MatchString(p.Locale) {
+		return errors.New("invalid locale")
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "Local" {
+			return errors.New("invalid timezone")
+		}
+	}
+	if p.AvatarURL != "" {
+		u, err := url.Parse(p.AvatarURL)
+		if err != nil || len(p.AvatarURL) > maxAvatarURLLength || u.Scheme != "https" || u.Host == "" {
+			return errors.New("avatar url must be an https url")
+		}
+	}
+	return nil
+}
+
+// mergeMetadata applies a json merge patch (RFC 7396) to a metadata object.
+// the result has to be an object, an empty object is stored as no metadata.
+func mergeMetadata(target json.RawMessage, patch json.RawMessage) (json.RawMessage, error) {
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, errors.New("metadata is not valid json")
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, errors.New("metadata must be a json object")
+	}
+	t := make(map[string]interface{})
+	if len(target) > 0 {
+		if err := json.Unmarshal(target, &t); err != nil {
+			return nil, err
+		}
+	}
+	merged := mergePatch(t, p).(map[string]interface{})
+	if len(merged) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxMetadataSize {
+		return nil, errors.New("metadata is too large")
+	}
+	return b, nil
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// roles are kept by admins in the app metadata, as a list of names under
+// the roles key.
+func roles(u database.User) []string {
+	var m struct {
+		Roles []interface{} `json:"roles"`
+	}
+	r := []string{}
+	if len(u.AppMetadata) == 0 || json.Unmarshal(u.AppMetadata, &m) != nil {
+		return r
+	}
+	for _, role := range m.Roles {
+		if name, ok := role.(string); ok {
+			r = append(r, name)
+		}
+	}
+	return r
+}
+
+func profileETag(p profile) (string, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists etag.
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// metadata returns stored metadata, with no metadata as an empty object.
+func metadata(b json.RawMessage) json.RawMessage {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return json.RawMessage("{}")
+	}
+	return b
+}
@@ -0,0 +1,328 @@
+package handler
+
+import (
+	"auth/audit"
+	"auth/common"
+	"auth/database"
+	"auth/outbox"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"time"
+)
+
+// touchInterval limits how often the last seen time of a session is written.
+const touchInterval = time.Minute
+
+// maxUserAgentLength matches the UserAgent column of the Session table.
+const maxUserAgentLength = 512
+
+// session is what users get to see about one of their sessions.
+type session struct {
+	Id        database.ObjectId `json:"id"`
+	UserAgent string            `json:"user_agent"`
+	IP        string            `json:"ip"`
+	CreatedAt time.Time         `json:"created_at"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Current   bool              `json:"current"`
+}
+
+// sessionTimeout is how long a session survives without being used: its
+// last token expires and can no longer be refreshed after that.
+func (h *Handler) sessionTimeout() time.Duration {
+	return h.jwtMiddleWare.Timeout + h.jwtMiddleWare.MaxRefresh
+}
+
+// startSession records a login of user from the current client.
+func (h *Handler) startSession(c *gin.Context, user database.User) (database.ObjectId, error) {
+	now := time.Now()
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	s := database.Session{
+		Id:        database.NewObjectId(),
+		UserId:    user.Id,
+		UserAgent: userAgent,
+		IP:        c.ClientIP(),
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+	if err := h.db.AddSession(c.Request.Context(), s, now.Add(-h.sessionTimeout())); err != nil {
+		return "", err
+	}
+	return s.Id, nil
+}
+
+// checkSession rejects tokens whose session was revoked, and keeps the last
+// seen time of the others up to date.
+func (h *Handler) checkSession(c *gin.Context, identity *IdentityData) bool {
+	if identity.SessionId == database.EmptyObjectId {
+		return false
+	}
+	s, err := h.db.GetSession(c.Request.Context(), identity.SessionId)
+	if err != nil {
+		zap.L().Warn("cannot load token session", zap.String("session", string(identity.SessionId)), zap.Error(err))
+		return false
+	}
+	if s.UserId != identity.Id || s.Generation != identity.Generation {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(s.LastSeen) >= touchInterval {
+		if err := h.db.TouchSession(c.Request.Context(), s.Id, now); err != nil {
+			zap.L().Error("cannot update session", zap.Error(err))
+		}
+	}
+	return true
+}
+
+// detectTokenReuse runs before refreshes. a token of an older generation of
+// its session was refreshed already, so it is being replayed by whoever else
+// has a copy of it. the session is revoked, which ends the token family for
+// the legitimate client as well as for the replayer.
+func (h *Handler) detectTokenReuse(c *gin.Context) {
+	claims, err := h.jwtMiddleWare.CheckIfTokenExpire(c)
+	if err != nil {
+		return
+	}
+	userId, _ := claims[IdentityKey].(string)
+	sessionId, _ := claims[sessionKey].(string)
+	generation, _ := claims[generationKey].(float64)
+	if userId == "" || sessionId == "" {
+		return
+	}
+	s, err := h.db.GetSession(c.Request.Context(), database.ObjectId(sessionId))
+	if err != nil || s.UserId != database.ObjectId(userId) || int(generation) >= s.Generation {
+		return
+	}
+	zap.L().Warn("refresh token reused", zap.String("user", userId), zap.String("session", sessionId))
+	err = h.db.DeleteSession(c.Request.Context(), s.UserId, s.Id)
+	if err != nil && err != database.ErrNotFound {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		c.Abort()
+		return
+	}
+	h.audit.Record(c, audit.EventTokenReuse, "", userId, "session "+sessionId)
+	common.ErrorResponse(c, http.StatusUnauthorized, "token was already refreshed", nil)
+	c.Abort()
+}
+
+// refreshToken replaces the token of the current session with one of the
+// next generation. the token it was called with can not be used any more.
+func (h *Handler) refreshToken(c *gin.Context) {
+	current := extractIdentity(c)
+	generation, err := h.db.RotateSession(c.Request.Context(), current.SessionId, current.Generation, time.Now())
+	if err == database.ErrNotFound {
+		// a concurrent refresh of the same token won
+		common.ErrorResponse(c, http.StatusUnauthorized, "token was already refreshed", err)
+		return
+	}
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	user, err := h.db.GetUserById(c.Request.Context(), current.Id)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	identity := h.identity(user)
+	identity.SessionId = current.SessionId
+	identity.Generation = generation
+	h.sendToken(c, identity)
+}
+
+// sendToken responds with a new token for identity, as the login does.
+func (h *Handler) sendToken(c *gin.Context, identity *IdentityData) {
+	token, expire, err := h.jwtMiddleWare.TokenGenerator(identity)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusInternalServerError, "cannot create token", err)
+		return
+	}
+	if h.jwtMiddleWare.SendCookie {
+		c.SetCookie(h.jwtMiddleWare.CookieName, token, int(h.jwtMiddleWare.CookieMaxAge.Seconds()), "/",
+			h.jwtMiddleWare.CookieDomain, h.jwtMiddleWare.SecureCookie, h.jwtMiddleWare.CookieHTTPOnly)
+	}
+	c.JSON(http.StatusOK, &authenticationToken{
+		Code:   http.StatusOK,
+		Token:  token,
+		Expire: expire.Format(time.RFC3339),
+	})
+}
+
+func (h *Handler) listSessions(c *gin.Context) {
+	identity := extractIdentity(c)
+	sessions, err := h.db.GetSessions(c.Request.Context(), identity.Id)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	expiredBefore := time.Now().Add(-h.sessionTimeout())
+	result := []session{}
+	for _, s := range sessions {
+		if s.LastSeen.Before(expiredBefore) {
+			continue
+		}
+		result = append(result, session{
+			Id:        s.Id,
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			CreatedAt: s.CreatedAt.UTC(),
+			LastSeen:  s.LastSeen.UTC(),
+			Current:   s.Id == identity.SessionId,
+		})
+	}
+	common.SuccessResponse(c, http.StatusOK, "active sessions", result)
+}
+
+// revokeSession logs out one of the sessions of the logged-in user, which
+// may be the current one.
+func (h *Handler) revokeSession(c *gin.Context) {
+	userId := ExtractUser(c)
+	err := h.db.DeleteSession(c.Request.Context(), userId, database.ObjectId(c.Param("id")))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.audit.Record(c, audit.EventSessionRevoke, string(userId), string(userId), "session "+c.Param("id"))
+	common.SuccessResponse(c, http.StatusOK, "session revoked", nil)
+}
+
+// revokeOtherSessions logs out every session of the logged-in user except
+// the current one.
+func (h *Handler) revokeOtherSessions(c *gin.Context) {
+	identity := extractIdentity(c)
+	err := h.db.DeleteOtherSessions(c.Request.Context(), identity.Id, identity.SessionId)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.audit.Record(c, audit.EventSessionRevoke, string(identity.Id), string(identity.Id), "all other sessions")
+	common.SuccessResponse(c, http.StatusOK, "other sessions revoked", nil)
+}
+
+// revokeCurrentSession ends the session of the token sent to logout, if any.
+// logout succeeds regardless, so it never aborts.
+func (h *Handler) revokeCurrentSession(c *gin.Context) {
+	claims, err := h.jwtMiddleWare.GetClaimsFromJWT(c)
+	if err != nil {
+		return
+	}
+	userId, _ := claims[IdentityKey].(string)
+	sessionId, _ := claims[sessionKey].(string)
+	if userId == "" || sessionId == "" {
+		return
+	}
+	err = h.db.DeleteSession(c.Request.Context(), database.ObjectId(userId), database.ObjectId(sessionId))
+	if err != nil && err != database.ErrNotFound {
+		zap.L().Error("cannot revoke session on logout", zap.Error(err))
+	}
+	if err == nil {
+		h.audit.Record(c, audit.EventLogout, userId, userId, "session "+sessionId)
+	}
+}
+
+// deviceFingerprint identifies the client software of a login.
+func deviceFingerprint(userAgent string) string {
+	sum := sha256.Sum256([]byte(userAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+// ipNetwork is the address range ip belongs to, so that a user moving
+// within the same network does not look like a new location.
+func ipNetwork(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// alertNewDevice mails the user if a login came from a device or network
+// that was not seen before. the very first login of a user is not alerted.
+// failures are only logged, they must not fail the login.
+func (h *Handler) alertNewDevice(c *gin.Context, user database.User) {
+	now := time.Now()
+	device := database.KnownDevice{
+		UserId:      user.Id,
+		Fingerprint: deviceFingerprint(c.Request.UserAgent()),
+		Network:     ipNetwork(c.ClientIP()),
+		FirstSeen:   now,
+		LastSeen:    now,
+	}
+	known, err := h.db.GetKnownDevices(c.Request.Context(), user.Id)
+	if err != nil {
+		zap.L().Error("cannot load known devices", zap.Error(err))
+		return
+	}
+	if err := h.db.AddKnownDevice(c.Request.Context(), device); err != nil {
+		zap.L().Error("cannot record known device", zap.Error(err))
+	}
+	if len(known) == 0 {
+		return
+	}
+	knownFingerprint, knownNetwork := false, false
+	for _, d := range known {
+		knownFingerprint = knownFingerprint || d.Fingerprint == device.Fingerprint
+		knownNetwork = knownNetwork || d.Network == device.Network
+	}
+	if knownFingerprint && knownNetwork {
+		return
+	}
+	zap.L().Info("login from new device",
+		zap.String("user", string(user.Id)),
+		zap.Bool("new_device", !knownFingerprint),
+		zap.Bool("new_network", !knownNetwork),
+	)
+	login := outbox.Login{UserAgent: c.Request.UserAgent(), IP: c.ClientIP(), At: now}
+	_, err = h.db.SetReportCode(c.Request.Context(), user.Id, h.outbox.LoginAlert(user.Id, user.Email, login))
+	if err != nil {
+		zap.L().Error("cannot create login report code", zap.Error(err))
+		return
+	}
+	h.outbox.Notify()
+}
+
+// reportLogin is the "this wasn't me" link of new login alerts. it logs out
+// everyone and sends the user a recovery code to choose a new password.
+func (h *Handler) reportLogin(c *gin.Context) {
+	var v verification
+	err := c.ShouldBindQuery(&v)
+	if err != nil {
+		common.ErrorResponse(c, http.StatusBadRequest, "invalid code", err)
+		return
+	}
+	userId, err := h.db.ReportLogin(c.Request.Context(), v.Code)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	zap.L().Warn("login reported by user", zap.String("user", string(userId)))
+	h.audit.Record(c, audit.EventLoginReport, string(userId), string(userId), "")
+	user, err := h.db.GetUserById(c.Request.Context(), userId)
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	_, err = h.db.SetRecoveryCode(c.Request.Context(), user.Id, h.outbox.Mail(outbox.KindPasswordReset, user.Id, user.Email))
+	if err != nil {
+		common.ErrorResponse(common.StatusFromError(c, err))
+		return
+	}
+	h.outbox.Notify()
+
+	c.HTML(
+		http.StatusOK,
+		"login-reported.tmpl",
+		gin.H{
+			"Server": h.serverName,
+		},
+	)
+}
@@ -2,24 +2,39 @@ package handler
 
 import (
 	"auth/database"
+	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"time"
 )
 
 const IdentityKey = "identity"
 
+// IdentityData is what tokens carry about a user, Claims are the configured
+// profile claims. SessionId is kept across token refreshes, Generation grows
+// with each of them.
 type IdentityData struct {
-	Id    database.ObjectId
-	Email string
+	Id           database.ObjectId
+	Email        string
+	TokenVersion int
+	SessionId    database.ObjectId
+	Generation   int
+	Claims       map[string]interface{}
 }
 
 func ExtractUser(c *gin.Context) database.ObjectId {
+	return extractIdentity(c).Id
+}
+
+func extractIdentity(c *gin.Context) *IdentityData {
 	user, _ := c.Get(IdentityKey)
-	return user.(*IdentityData).Id
+	return user.(*IdentityData)
 }
 
 type NewUser struct {
-	Email    string `form:"email" json:"email" binding:"required"`
-	Password string `form:"password" json:"password" binding:"required"`
+	Email       string `form:"email" json:"email" binding:"required"`
+	Password    string `form:"password" json:"password" binding:"required"`
+	ClientId    string `form:"client_id" json:"client_id"`
+	RedirectURI string `form:"redirect_uri" json:"redirect_uri" binding:"max=2048"`
 }
 
 type loginCredentials struct {
@@ -37,6 +52,12 @@ type authenticationToken struct {
 	Expire string `form:"expire" json:"expire" binding:"required"`
 }
 
+type verificationResend struct {
+	Email       string `form:"email" json:"email" binding:"required"`
+	ClientId    string `form:"client_id" json:"client_id"`
+	RedirectURI string `form:"redirect_uri" json:"redirect_uri" binding:"max=2048"`
+}
+
 type recovery struct {
 	Email string `form:"email" json:"email" binding:"required"`
 }
@@ -45,3 +66,48 @@ type passwordReset struct {
 	Password string `form:"password" json:"password" binding:"required"`
 	Code     string `form:"code" json:"code" binding:"required"`
 }
+
+type passwordChange struct {
+	CurrentPassword string `form:"current_password" json:"current_password" binding:"required"`
+	Password        string `form:"password" json:"password" binding:"required"`
+}
+
+type emailChange struct {
+	Email    string `form:"email" json:"email" binding:"required,email"`
+	Password string `form:"password" json:"password" binding:"required"`
+}
+
+type accountDeletion struct {
+	Password string `form:"password" json:"password" binding:"required"`
+}
+
+type profileUpdate struct {
+	DisplayName  *string         `json:"display_name"`
+	Locale       *string         `json:"locale"`
+	Timezone     *string         `json:"timezone"`
+	AvatarURL    *string         `json:"avatar_url"`
+	UserMetadata json.RawMessage `json:"user_metadata"`
+}
+
+type unlock struct {
+	Email string `form:"email" json:"email" binding:"required"`
+	IP    string `form:"ip" json:"ip"`
+}
+
+type auditQuery struct {
+	Type   string    `form:"type"`
+	Actor  string    `form:"actor"`
+	Target string    `form:"target"`
+	IP     string    `form:"ip"`
+	From   time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To     time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Before int64     `form:"before" binding:"min=0"`
+	Limit  int       `form:"limit" binding:"min=0,max=500"`
+}
+
+type deliveryQuery struct {
+	Endpoint string `form:"endpoint"`
+	Status   string `form:"status" binding:"omitempty,oneof=pending delivered failed"`
+	Before   int64  `form:"before" binding:"min=0"`
+	Limit    int    `form:"limit" binding:"min=0,max=500"`
+}
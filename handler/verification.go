@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"auth/common"
+	"auth/database"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+)
+
+// VerificationConfig controls where users end up after following their
+// signup verification link. successful verifications go to the redirect_uri
+// given at signup, or SuccessURL, failed ones go to FailureURL. without a
+// target the verification-successful page is rendered and errors are
+// returned as json.
+type VerificationConfig struct {
+	SuccessURL string   `json:"success_url"`
+	FailureURL string   `json:"failure_url"`
+	Clients    []Client `json:"clients"`
+}
+
+// Client is an application that may send its users back to one of its
+// RedirectURIs after verification. uris must match exactly.
+type Client struct {
+	Id           string   `json:"id"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// reasons of failed verifications, passed to FailureURL as the error
+// parameter.
+const (
+	verifyInvalidRequest = "invalid_request"
+	verifyInvalidCode    = "invalid_code"
+	verifyServerError    = "server_error"
+)
+
+// allowedRedirect tells whether redirectURI is registered for the client,
+// or for any client if clientId is empty.
+func (v *VerificationConfig) allowedRedirect(clientId string, redirectURI string) bool {
+	for _, client := range v.Clients {
+		if clientId != "" && client.Id != clientId {
+			continue
+		}
+		for _, uri := range client.RedirectURIs {
+			if uri == redirectURI {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkRedirect rejects requests asking for a redirect that is not
+// registered for their client, it returns false if the request was
+// rejected.
+func (h *Handler) checkRedirect(c *gin.Context, clientId string, redirectURI string) bool {
+	if redirectURI == "" {
+		return true
+	}
+	if clientId == "" || !h.verification.allowedRedirect(clientId, redirectURI) {
+		common.ErrorResponse(c, http.StatusBadRequest, "redirect_uri is not registered for the client", nil)
+		return false
+	}
+	return true
+}
+
+// signupRedirect is the redirect uri stored with the signup code of a user.
+func (h *Handler) signupRedirect(c *gin.Context, userId database.ObjectId) string {
+	verifications, err := h.db.GetVerifications(c.Request.Context(), userId)
+	if err != nil {
+		zap.L().Error("cannot load signup redirect", zap.Error(err))
+		return ""
+	}
+	for _, v := range verifications {
+		if v.Type == database.VerificationTypeSignup {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// verified answers a successful verification. the redirect uri is checked
+// again, clients may have been removed since signup.
+func (h *Handler) verified(c *gin.Context, redirectURI string) {
+	target := h.verification.SuccessURL
+	if redirectURI != "" && h.verification.allowedRedirect("", redirectURI) {
+		target = redirectURI
+	}
+	if target == "" {
+		c.HTML(
+			http.StatusOK,
+			"verification-successful.tmpl",
+			gin.H{
+				"Server": h.serverName,
+			},
+		)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, withQuery(target, "status", "verified"))
+}
+
+// verificationFailed answers a failed verification with a redirect to
+// FailureURL if there is one, or a json error.
+func (h *Handler) verificationFailed(c *gin.Context, reason string, code int, message string, err error) {
+	if h.verification.FailureURL == "" {
+		common.ErrorResponse(c, code, message, err)
+		return
+	}
+	if common.IsServerError(code) {
+		zap.L().Error(message, zap.String("reason", reason), zap.Error(err))
+	} else {
+		zap.L().Warn(message, zap.String("reason", reason), zap.Error(err))
+	}
+	c.Redirect(http.StatusSeeOther, withQuery(h.verification.FailureURL, "error", reason))
+}
+
+// confirmPage answers links opened from text mails, which can only GET.
+// opening a link must not change anything, mail scanners follow links too,
+// so the page asks the user to confirm with a POST to the same address.
+func (h *Handler) confirmPage(title string, message string, button string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var v verification
+		if err := c.ShouldBindQuery(&v); err != nil {
+			common.ErrorResponse(c, http.StatusBadRequest, "invalid code", err)
+			return
+		}
+		action := url.URL{Path: c.Request.URL.Path, RawQuery: url.Values{"code": {v.Code}}.Encode()}
+		c.HTML(
+			http.StatusOK,
+			"confirm.tmpl",
+			gin.H{
+				"Title":   title,
+				"Message": message,
+				"Button":  button,
+				"Action":  action.String(),
+			},
+		)
+	}
+}
+
+// withQuery adds a query parameter to a configured url.
+func withQuery(target string, key string, value string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,12 @@
+package lockout
+
+// Config controls login throttling. all durations are in seconds, a zero
+// threshold disables locking for that kind of key.
+type Config struct {
+	UserThreshold   int `json:"user_threshold"`
+	IPThreshold     int `json:"ip_threshold"`
+	BaseDelay       int `json:"base_delay"`
+	MaxDelay        int `json:"max_delay"`
+	LockoutDuration int `json:"lockout_duration"`
+	Window          int `json:"window"`
+}
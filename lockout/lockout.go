@@ -0,0 +1,145 @@
+package lockout
+
+import (
+	"auth/database"
+	"context"
+	"errors"
+	"time"
+)
+
+type Storage interface {
+	GetLoginFailure(ctx context.Context, kind database.LoginFailureKind, name string) (database.LoginFailure, error)
+	AddLoginFailure(ctx context.Context, kind database.LoginFailureKind, name string, at time.Time, resetBefore time.Time) (database.LoginFailure, error)
+	LockLogin(ctx context.Context, kind database.LoginFailureKind, name string, until time.Time) error
+	ClearLoginFailure(ctx context.Context, kind database.LoginFailureKind, name string) error
+}
+
+// Tracker keeps count of failed logins per user and per ip, and decides how
+// long a client has to wait before its next attempt is accepted.
+type Tracker struct {
+	db      Storage
+	enabled bool
+	config  Config
+	now     func() time.Time
+}
+
+// maxDoublings keeps the exponential delay from overflowing.
+const maxDoublings = 20
+
+func New(config *Config, db Storage) *Tracker {
+	t := &Tracker{
+		db:  db,
+		now: time.Now,
+	}
+	if config != nil {
+		t.enabled = true
+		t.config = *config
+	}
+	return t
+}
+
+// Check returns how long a login for email from ip has to wait, zero means
+// the attempt may go ahead.
+func (t *Tracker) Check(ctx context.Context, email string, ip string) (time.Duration, error) {
+	if !t.enabled {
+		return 0, nil
+	}
+	var wait time.Duration
+	for _, key := range t.keys(email, ip) {
+		f, err := t.db.GetLoginFailure(ctx, key.kind, key.name)
+		if errors.Is(err, database.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, t.delay(f))
+	}
+	return wait, nil
+}
+
+// Fail records a failed login for email from ip. if this failure locked the
+// user, the time the lock expires is returned so the owner can be notified.
+func (t *Tracker) Fail(ctx context.Context, email string, ip string) (time.Time, error) {
+	if !t.enabled {
+		return time.Time{}, nil
+	}
+	now := t.now()
+	var resetBefore time.Time
+	if t.config.Window > 0 {
+		resetBefore = now.Add(-seconds(t.config.Window))
+	}
+	var userLockedUntil time.Time
+	for _, key := range t.keys(email, ip) {
+		f, err := t.db.AddLoginFailure(ctx, key.kind, key.name, now, resetBefore)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if key.threshold <= 0 || f.Count < key.threshold {
+			continue
+		}
+		until := now.Add(seconds(t.config.LockoutDuration))
+		if err := t.db.LockLogin(ctx, key.kind, key.name, until); err != nil {
+			return time.Time{}, err
+		}
+		if key.kind == database.LoginFailureUser && f.Count == key.threshold {
+			userLockedUntil = until
+		}
+	}
+	return userLockedUntil, nil
+}
+
+// Succeed forgets failed attempts against email. failures from the ip are
+// kept, so a valid login cannot be used to reset a guessing client.
+func (t *Tracker) Succeed(ctx context.Context, email string) error {
+	if !t.enabled {
+		return nil
+	}
+	return t.db.ClearLoginFailure(ctx, database.LoginFailureUser, email)
+}
+
+// Unlock removes any delay or lock on email and, if given, on ip.
+func (t *Tracker) Unlock(ctx context.Context, email string, ip string) error {
+	if err := t.db.ClearLoginFailure(ctx, database.LoginFailureUser, email); err != nil {
+		return err
+	}
+	if ip == "" {
+		return nil
+	}
+	return t.db.ClearLoginFailure(ctx, database.LoginFailureIP, ip)
+}
+
+type key struct {
+	kind      database.LoginFailureKind
+	name      string
+	threshold int
+}
+
+func (t *Tracker) keys(email string, ip string) []key {
+	return []key{
+		{database.LoginFailureUser, email, t.config.UserThreshold},
+		{database.LoginFailureIP, ip, t.config.IPThreshold},
+	}
+}
+
+func (t *Tracker) delay(f database.LoginFailure) time.Duration {
+	now := t.now()
+	if f.LockedUntil.After(now) {
+		return f.LockedUntil.Sub(now)
+	}
+	if f.Count == 0 || t.config.BaseDelay <= 0 {
+		return 0
+	}
+	if t.config.Window > 0 && f.LastFailure.Before(now.Add(-seconds(t.config.Window))) {
+		return 0
+	}
+	delay := seconds(t.config.BaseDelay) << min(f.Count-1, maxDoublings)
+	if t.config.MaxDelay > 0 {
+		delay = min(delay, seconds(t.config.MaxDelay))
+	}
+	return max(f.LastFailure.Add(delay).Sub(now), 0)
+}
+
+func seconds(s int) time.Duration {
+	return time.Duration(s) * time.Second
+}
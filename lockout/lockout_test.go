@@ -0,0 +1,115 @@
+package lockout
+
+import (
+	"auth/database"
+	"context"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func newTestTracker(now *time.Time) *Tracker {
+	t := New(&Config{
+		UserThreshold:   3,
+		IPThreshold:     5,
+		BaseDelay:       1,
+		MaxDelay:        2,
+		LockoutDuration: 60,
+		Window:          600,
+	}, database.NewMemory())
+	t.now = func() time.Time { return *now }
+	return t
+}
+
+func TestBackoff(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	now := time.Now()
+	tracker := newTestTracker(&now)
+
+	wait, err := tracker.Check(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(wait).To(BeZero())
+
+	_, err = tracker.Fail(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	wait, err = tracker.Check(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(wait).To(Equal(time.Second))
+
+	// ip delay applies to other users as well
+	wait, err = tracker.Check(ctx, "user2", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(wait).To(Equal(time.Second))
+
+	// delay doubles, up to max delay
+	_, err = tracker.Fail(ctx, "user1", "2.2.2.2")
+	Expect(err).To(BeNil())
+	wait, err = tracker.Check(ctx, "user1", "3.3.3.3")
+	Expect(err).To(BeNil())
+	Expect(wait).To(Equal(2 * time.Second))
+
+	now = now.Add(2 * time.Second)
+	wait, err = tracker.Check(ctx, "user1", "3.3.3.3")
+	Expect(err).To(BeNil())
+	Expect(wait).To(BeZero())
+
+	// failures outside the window are forgotten
+	now = now.Add(time.Hour)
+	_, err = tracker.Fail(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	wait, err = tracker.Check(ctx, "user1", "4.4.4.4")
+	Expect(err).To(BeNil())
+	Expect(wait).To(Equal(time.Second))
+}
+
+func TestLockout(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	now := time.Now()
+	tracker := newTestTracker(&now)
+
+	for i := 0; i < 2; i++ {
+		lockedUntil, err := tracker.Fail(ctx, "user1", "1.1.1.1")
+		Expect(err).To(BeNil())
+		Expect(lockedUntil.IsZero()).To(BeTrue())
+	}
+	lockedUntil, err := tracker.Fail(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(lockedUntil).To(Equal(now.Add(time.Minute)))
+
+	wait, err := tracker.Check(ctx, "user1", "2.2.2.2")
+	Expect(err).To(BeNil())
+	Expect(wait).To(Equal(time.Minute))
+
+	// only the failure that locks the user is reported
+	lockedUntil, err = tracker.Fail(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(lockedUntil.IsZero()).To(BeTrue())
+
+	// ip gets locked after its own threshold
+	_, err = tracker.Fail(ctx, "user2", "1.1.1.1")
+	Expect(err).To(BeNil())
+	wait, err = tracker.Check(ctx, "user3", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(wait).To(Equal(time.Minute))
+
+	Expect(tracker.Unlock(ctx, "user1", "1.1.1.1")).To(BeNil())
+	wait, err = tracker.Check(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(wait).To(BeZero())
+}
+
+func TestDisabled(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	tracker := New(nil, database.NewMemory())
+	for i := 0; i < 10; i++ {
+		lockedUntil, err := tracker.Fail(ctx, "user1", "1.1.1.1")
+		Expect(err).To(BeNil())
+		Expect(lockedUntil.IsZero()).To(BeTrue())
+	}
+	wait, err := tracker.Check(ctx, "user1", "1.1.1.1")
+	Expect(err).To(BeNil())
+	Expect(wait).To(BeZero())
+}
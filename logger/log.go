@@ -2,10 +2,20 @@ package logger
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"regexp"
 )
 
+// RequestIdHeader carries the id of a request. ids sent by clients or proxies
+// are kept if they look sane, otherwise a new one is made.
+const RequestIdHeader = "X-Request-Id"
+
+const requestIdKey = "request_id"
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
 func NewLogger(config ZapConfig) (*zap.Logger, error) {
 	level := zapcore.InfoLevel
 	_ = level.UnmarshalText([]byte(config.GetLevel()))
@@ -34,11 +44,24 @@ func NewLogger(config ZapConfig) (*zap.Logger, error) {
 
 func MiddlewareFunc(logger *zap.Logger) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		requestId := ctx.GetHeader(RequestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			requestId = uuid.New().String()
+		}
+		ctx.Set(requestIdKey, requestId)
+		ctx.Header(RequestIdHeader, requestId)
 		logger.Info("",
 			zap.String("method", ctx.Request.Method),
 			zap.String("uri", ctx.Request.RequestURI),
 			zap.String("query", ctx.Request.URL.RawQuery),
+			zap.String("request_id", requestId),
 		)
 		ctx.Next()
 	}
 }
+
+// RequestId returns the id the middleware assigned to the request, or an
+// empty string outside of it.
+func RequestId(ctx *gin.Context) string {
+	return ctx.GetString(requestIdKey)
+}
@@ -0,0 +1,105 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// loginAuth implements the LOGIN mechanism, which some servers offer
+// instead of PLAIN. like smtp.PlainAuth it refuses to send the password
+// over unencrypted connections to other hosts than localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// smtpAuth creates the configured authentication for host, nil if no user
+// name is configured.
+func smtpAuth(config Auth, host string) (smtp.Auth, error) {
+	if config.Username == "" {
+		return nil, nil
+	}
+	switch config.Mechanism {
+	case "", AuthPlain:
+		return smtp.PlainAuth("", config.Username, config.Password, host), nil
+	case AuthLogin:
+		return &loginAuth{username: config.Username, password: config.Password, host: host}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(config.Username, config.Password), nil
+	default:
+		return nil, fmt.Errorf("unknown smtp auth mechanism %s", config.Mechanism)
+	}
+}
+
+// tlsMode is the configured tls mode, or the one implied by the auth
+// settings if none is configured.
+func tlsMode(config *Config) (string, error) {
+	switch config.TLS.Mode {
+	case "":
+		if config.Auth.Username != "" {
+			return TLSImplicit, nil
+		}
+		return TLSNone, nil
+	case TLSNone, TLSStartTLS, TLSImplicit:
+		return config.TLS.Mode, nil
+	default:
+		return "", fmt.Errorf("unknown smtp tls mode %s", config.TLS.Mode)
+	}
+}
+
+// tlsConfig creates the client tls settings for host.
+func tlsConfig(config TLS, host string) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.ServerName != "" {
+		c.ServerName = config.ServerName
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+	}
+	return c, nil
+}
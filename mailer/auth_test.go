@@ -0,0 +1,279 @@
+package mailer
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	. "github.com/onsi/gomega"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a self signed certificate for 127.0.0.1 and
+// writes it to a pem file usable as CAFile.
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "smtp test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	Expect(err).To(BeNil())
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+type testSession struct {
+	tls      bool
+	username string
+	password string
+	from     string
+	to       string
+	data     string
+}
+
+// testServer accepts one smtp session in the given tls mode, offering
+// LOGIN authentication.
+func testServer(t *testing.T, cert tls.Certificate, mode string) (string, <-chan testSession) {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	var (
+		l   net.Listener
+		err error
+	)
+	if mode == TLSImplicit {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	Expect(err).To(BeNil())
+	t.Cleanup(func() { l.Close() })
+	sessions := make(chan testSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := testSession{tls: mode == TLSImplicit}
+		defer func() { sessions <- s }()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		read := func() string {
+			line, _ := r.ReadString('\n')
+			return strings.TrimRight(line, "\r\n")
+		}
+		decode := func(line string) string {
+			b, _ := base64.StdEncoding.DecodeString(line)
+			return string(b)
+		}
+		reply("220 localhost ESMTP")
+		for {
+			line := read()
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch cmd {
+			case "EHLO":
+				reply("250-localhost")
+				if mode == TLSStartTLS && !s.tls {
+					reply("250 STARTTLS")
+				} else {
+					reply("250 AUTH LOGIN")
+				}
+			case "STARTTLS":
+				reply("220 ready")
+				tlsConn := tls.Server(conn, tlsConfig)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+				conn = tlsConn
+				r = bufio.NewReader(conn)
+				s.tls = true
+			case "AUTH":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				s.username = decode(read())
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				s.password = decode(read())
+				reply("235 ok")
+			case "MAIL":
+				s.from = line
+				reply("250 ok")
+			case "RCPT":
+				s.to = line
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				for line := read(); line != "."; line = read() {
+					s.data += line + "\n"
+				}
+				reply("250 ok")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown")
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), sessions
+}
+
+func testSMTP(address string, tls TLS, auth Auth) (*SMTP, error) {
+	m, err := NewSMTP(&Config{
+		Address:       address,
+		FromEmail:     "noreply@z42.com",
+		HtmlTemplates: "../templates/*.tmpl",
+		TextTemplates: "../templates/*.txt",
+		TLS:           tls,
+		Auth:          auth,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.(*SMTP), nil
+}
+
+var testMessage = &Message{
+	From:    mail.Address{Address: "noreply@z42.com"},
+	To:      mail.Address{Address: "user1@example.com"},
+	Subject: "test",
+	Text:    "hello",
+	HTML:    "<p>hello</p>",
+}
+
+func TestSendStartTLS(t *testing.T) {
+	RegisterTestingT(t)
+	cert, caFile := testCertificate(t)
+	address, sessions := testServer(t, cert, TLSStartTLS)
+
+	m, err := testSMTP(address, TLS{Mode: TLSStartTLS, CAFile: caFile}, Auth{Mechanism: AuthLogin, Username: "user", Password: "secret"})
+	Expect(err).To(BeNil())
+	Expect(m.send(testMessage)).To(BeNil())
+
+	s := <-sessions
+	Expect(s.tls).To(BeTrue())
+	Expect(s.username).To(Equal("user"))
+	Expect(s.password).To(Equal("secret"))
+	Expect(s.from).To(Equal("MAIL FROM:<noreply@z42.com>"))
+	Expect(s.to).To(Equal("RCPT TO:<user1@example.com>"))
+	Expect(s.data).To(ContainSubstring("Subject: test"))
+}
+
+func TestSendImplicitTLS(t *testing.T) {
+	RegisterTestingT(t)
+	cert, caFile := testCertificate(t)
+	address, sessions := testServer(t, cert, TLSImplicit)
+
+	// the mode defaults to implicit tls when authenticating
+	m, err := testSMTP(address, TLS{CAFile: caFile}, Auth{Mechanism: AuthLogin, Username: "user", Password: "secret"})
+	Expect(err).To(BeNil())
+	Expect(m.tlsMode).To(Equal(TLSImplicit))
+	Expect(m.send(testMessage)).To(BeNil())
+
+	s := <-sessions
+	Expect(s.tls).To(BeTrue())
+	Expect(s.username).To(Equal("user"))
+}
+
+func TestSendVerifiesCertificate(t *testing.T) {
+	RegisterTestingT(t)
+	cert, _ := testCertificate(t)
+
+	// the self signed certificate is not trusted by the system roots
+	address, _ := testServer(t, cert, TLSStartTLS)
+	m, err := testSMTP(address, TLS{Mode: TLSStartTLS}, Auth{})
+	Expect(err).To(BeNil())
+	err = m.send(testMessage)
+	Expect(err).NotTo(BeNil())
+	Expect(err.Error()).To(ContainSubstring("certificate"))
+
+	address, sessions := testServer(t, cert, TLSStartTLS)
+	m, err = testSMTP(address, TLS{Mode: TLSStartTLS, InsecureSkipVerify: true}, Auth{})
+	Expect(err).To(BeNil())
+	Expect(m.send(testMessage)).To(BeNil())
+	Expect((<-sessions).tls).To(BeTrue())
+}
+
+func TestSendRequiresStartTLS(t *testing.T) {
+	RegisterTestingT(t)
+	cert, caFile := testCertificate(t)
+	address, sessions := testServer(t, cert, TLSNone)
+
+	// without STARTTLS the password must not be sent in plaintext
+	m, err := testSMTP(address, TLS{Mode: TLSStartTLS, CAFile: caFile}, Auth{Mechanism: AuthLogin, Username: "user", Password: "secret"})
+	Expect(err).To(BeNil())
+	err = m.send(testMessage)
+	Expect(err).NotTo(BeNil())
+	Expect(err.Error()).To(ContainSubstring("does not support STARTTLS"))
+	Expect((<-sessions).password).To(BeEmpty())
+}
+
+func TestSMTPConfig(t *testing.T) {
+	RegisterTestingT(t)
+	_, err := testSMTP("127.0.0.1:25", TLS{Mode: "ssl"}, Auth{})
+	Expect(err).NotTo(BeNil())
+	_, err = testSMTP("127.0.0.1:25", TLS{}, Auth{Mechanism: "xoauth2", Username: "user"})
+	Expect(err).NotTo(BeNil())
+	_, err = testSMTP("127.0.0.1:25", TLS{CAFile: "missing.pem"}, Auth{})
+	Expect(err).NotTo(BeNil())
+
+	m, err := testSMTP("127.0.0.1:25", TLS{}, Auth{})
+	Expect(err).To(BeNil())
+	Expect(m.tlsMode).To(Equal(TLSNone))
+	Expect(m.auth).To(BeNil())
+	Expect(m.tls.ServerName).To(Equal("127.0.0.1"))
+
+	m, err = testSMTP("127.0.0.1:587", TLS{Mode: TLSStartTLS, ServerName: "mail.z42.com"}, Auth{Mechanism: AuthCRAMMD5, Username: "user", Password: "secret"})
+	Expect(err).To(BeNil())
+	Expect(m.tls.ServerName).To(Equal("mail.z42.com"))
+	name, _, err := m.auth.Start(&smtp.ServerInfo{Name: "127.0.0.1", TLS: true})
+	Expect(err).To(BeNil())
+	Expect(name).To(Equal("CRAM-MD5"))
+}
+
+func TestLoginAuth(t *testing.T) {
+	RegisterTestingT(t)
+	a := &loginAuth{username: "user", password: "secret", host: "mail.z42.com"}
+
+	_, _, err := a.Start(&smtp.ServerInfo{Name: "mail.z42.com"})
+	Expect(err).NotTo(BeNil())
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "other.z42.com", TLS: true})
+	Expect(err).NotTo(BeNil())
+	name, _, err := a.Start(&smtp.ServerInfo{Name: "mail.z42.com", TLS: true})
+	Expect(err).To(BeNil())
+	Expect(name).To(Equal("LOGIN"))
+
+	b, err := a.Next([]byte("Username:"), true)
+	Expect(err).To(BeNil())
+	Expect(string(b)).To(Equal("user"))
+	b, err = a.Next([]byte("Password:"), true)
+	Expect(err).To(BeNil())
+	Expect(string(b)).To(Equal("secret"))
+	_, err = a.Next([]byte("Token:"), true)
+	Expect(err).NotTo(BeNil())
+	b, err = a.Next(nil, false)
+	Expect(err).To(BeNil())
+	Expect(b).To(BeNil())
+}
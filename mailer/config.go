@@ -6,12 +6,44 @@ type Config struct {
 	WebServer     string `json:"web_server"`
 	ApiServer     string `json:"api_server"`
 	HtmlTemplates string `json:"html_templates"`
-	Auth          Auth   `json:"auth"`
+	TextTemplates string `json:"text_templates"`
+	// ListUnsubscribe is a mailto: or https: uri sent in the
+	// List-Unsubscribe header, it is left out if empty.
+	ListUnsubscribe string `json:"list_unsubscribe"`
+	TLS             TLS    `json:"tls"`
+	Auth            Auth   `json:"auth"`
 }
 
+// tls modes of the smtp connection.
+const (
+	TLSNone     = "none"
+	TLSStartTLS = "starttls"
+	TLSImplicit = "implicit"
+)
+
+// TLS secures the connection to the smtp server. without a Mode, servers
+// that need authentication are connected with implicit tls and others
+// without tls. certificates are checked against the system roots, or the
+// pem bundle in CAFile, unless InsecureSkipVerify is set. ServerName
+// overrides the host name expected in the certificate.
+type TLS struct {
+	Mode               string `json:"mode"`
+	CAFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// authentication mechanisms, plain is used if none is set.
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+)
+
 type Auth struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Mechanism string `json:"mechanism"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
 }
 
 func DefaultConfig() Config {
@@ -21,5 +53,6 @@ func DefaultConfig() Config {
 		WebServer:     "www.chordsoft.org",
 		ApiServer:     "auth.chordsoft.org",
 		HtmlTemplates: "./templates/*.tmpl",
+		TextTemplates: "./templates/*.txt",
 	}
 }
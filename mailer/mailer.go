@@ -2,22 +2,42 @@ package mailer
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"strings"
+	texttemplate "text/template"
+	"time"
 )
 
 type Mailer interface {
 	SendEMailVerification(toName string, toEmail string, code string) error
 	SendPasswordReset(toName string, toEmail string, code string) error
+	SendAccountLocked(toName string, toEmail string, until time.Time) error
+	SendPasswordChanged(toName string, toEmail string) error
+	SendEmailChangeVerification(toName string, toEmail string, code string) error
+	SendEmailChangeNotice(toName string, toEmail string, newEmail string, code string) error
+	SendAccountDeleted(toName string, toEmail string) error
+	SendNewLoginAlert(toName string, toEmail string, userAgent string, ip string, at time.Time, code string) error
+	SendSignupAttempt(toName string, toEmail string) error
 }
 
 type Mock struct {
 	SendEMailVerificationFunc func(toName string, toEmail string, code string) error
 	SendPasswordResetFunc     func(toName string, toEmail string, code string) error
+	SendAccountLockedFunc     func(toName string, toEmail string, until time.Time) error
+	SendPasswordChangedFunc   func(toName string, toEmail string) error
+
+	SendEmailChangeVerificationFunc func(toName string, toEmail string, code string) error
+	SendEmailChangeNoticeFunc       func(toName string, toEmail string, newEmail string, code string) error
+	SendAccountDeletedFunc          func(toName string, toEmail string) error
+	SendNewLoginAlertFunc           func(toName string, toEmail string, userAgent string, ip string, at time.Time, code string) error
+	SendSignupAttemptFunc           func(toName string, toEmail string) error
 }
 
 func (m *Mock) SendEMailVerification(toName string, toEmail string, code string) error {
@@ -28,28 +48,94 @@ func (m *Mock) SendPasswordReset(toName string, toEmail string, code string) err
 	return m.SendPasswordResetFunc(toName, toEmail, code)
 }
 
+func (m *Mock) SendAccountLocked(toName string, toEmail string, until time.Time) error {
+	return m.SendAccountLockedFunc(toName, toEmail, until)
+}
+
+func (m *Mock) SendPasswordChanged(toName string, toEmail string) error {
+	return m.SendPasswordChangedFunc(toName, toEmail)
+}
+
+func (m *Mock) SendEmailChangeVerification(toName string, toEmail string, code string) error {
+	return m.SendEmailChangeVerificationFunc(toName, toEmail, code)
+}
+
+func (m *Mock) SendEmailChangeNotice(toName string, toEmail string, newEmail string, code string) error {
+	return m.SendEmailChangeNoticeFunc(toName, toEmail, newEmail, code)
+}
+
+func (m *Mock) SendAccountDeleted(toName string, toEmail string) error {
+	return m.SendAccountDeletedFunc(toName, toEmail)
+}
+
+func (m *Mock) SendNewLoginAlert(toName string, toEmail string, userAgent string, ip string, at time.Time, code string) error {
+	return m.SendNewLoginAlertFunc(toName, toEmail, userAgent, ip, at, code)
+}
+
+func (m *Mock) SendSignupAttempt(toName string, toEmail string) error {
+	return m.SendSignupAttemptFunc(toName, toEmail)
+}
+
+// SMTP sends every mail as an html and a plain text version, rendered from
+// a pair of templates with the same name: name.tmpl from HtmlTemplates and
+// name.txt from TextTemplates.
 type SMTP struct {
-	config *Config
-	tmpl   *template.Template
+	config   *Config
+	from     *mail.Address
+	tmpl     *template.Template
+	textTmpl *texttemplate.Template
+	host     string
+	tlsMode  string
+	tls      *tls.Config
+	auth     smtp.Auth
+	now      func() time.Time
 }
 
 func NewSMTP(config *Config) (Mailer, error) {
+	from, err := mail.ParseAddress(config.FromEmail)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from email: %w", err)
+	}
 	tmpl, err := template.ParseGlob(config.HtmlTemplates)
 	if err != nil {
 		return nil, err
 	}
+	textTmpl, err := texttemplate.ParseGlob(config.TextTemplates)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp address: %w", err)
+	}
+	mode, err := tlsMode(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf, err := tlsConfig(config.TLS, host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp tls config: %w", err)
+	}
+	auth, err := smtpAuth(config.Auth, host)
+	if err != nil {
+		return nil, err
+	}
 	m := &SMTP{
-		config: config,
-		tmpl:   tmpl,
+		config:   config,
+		from:     from,
+		tmpl:     tmpl,
+		textTmpl: textTmpl,
+		host:     host,
+		tlsMode:  mode,
+		tls:      tlsConf,
+		auth:     auth,
+		now:      time.Now,
 	}
 	return m, nil
 }
 
 func (m *SMTP) SendEMailVerification(toName string, toEmail string, code string) error {
-	var b bytes.Buffer
-	err := m.tmpl.ExecuteTemplate(
-		&b,
-		"verification-email.tmpl",
+	return m.sendTemplate(toName, toEmail, "email verification", "verification-email",
 		struct {
 			Server string
 			Code   string
@@ -57,17 +143,10 @@ func (m *SMTP) SendEMailVerification(toName string, toEmail string, code string)
 			Server: m.config.ApiServer,
 			Code:   code,
 		})
-	if err != nil {
-		return err
-	}
-	return m.send(toName, toEmail, "email verification", b.String())
 }
 
 func (m *SMTP) SendPasswordReset(toName string, toEmail string, code string) error {
-	var b bytes.Buffer
-	err := m.tmpl.ExecuteTemplate(
-		&b,
-		"password-reset-email.tmpl",
+	return m.sendTemplate(toName, toEmail, "password reset", "password-reset-email",
 		struct {
 			Server string
 			Code   string
@@ -75,61 +154,187 @@ func (m *SMTP) SendPasswordReset(toName string, toEmail string, code string) err
 			Server: m.config.WebServer,
 			Code:   code,
 		})
+}
+
+func (m *SMTP) SendAccountLocked(toName string, toEmail string, until time.Time) error {
+	return m.sendTemplate(toName, toEmail, "account locked", "account-locked-email",
+		struct {
+			Server string
+			Until  string
+		}{
+			Server: m.config.WebServer,
+			Until:  until.UTC().Format(time.RFC1123),
+		})
+}
+
+func (m *SMTP) SendPasswordChanged(toName string, toEmail string) error {
+	return m.sendTemplate(toName, toEmail, "password changed", "password-changed-email",
+		struct {
+			Server string
+		}{
+			Server: m.config.WebServer,
+		})
+}
+
+func (m *SMTP) SendEmailChangeVerification(toName string, toEmail string, code string) error {
+	return m.sendTemplate(toName, toEmail, "confirm your new email address", "email-change-verification-email",
+		struct {
+			Server string
+			Code   string
+		}{
+			Server: m.config.ApiServer,
+			Code:   code,
+		})
+}
+
+func (m *SMTP) SendEmailChangeNotice(toName string, toEmail string, newEmail string, code string) error {
+	return m.sendTemplate(toName, toEmail, "email change requested", "email-change-notice-email",
+		struct {
+			Server   string
+			NewEmail string
+			Code     string
+		}{
+			Server:   m.config.ApiServer,
+			NewEmail: newEmail,
+			Code:     code,
+		})
+}
+
+func (m *SMTP) SendAccountDeleted(toName string, toEmail string) error {
+	return m.sendTemplate(toName, toEmail, "account deleted", "account-deleted-email",
+		struct {
+			Server string
+		}{
+			Server: m.config.WebServer,
+		})
+}
+
+func (m *SMTP) SendSignupAttempt(toName string, toEmail string) error {
+	return m.sendTemplate(toName, toEmail, "sign up attempt", "signup-attempt-email",
+		struct {
+			Server string
+		}{
+			Server: m.config.WebServer,
+		})
+}
+
+func (m *SMTP) SendNewLoginAlert(toName string, toEmail string, userAgent string, ip string, at time.Time, code string) error {
+	return m.sendTemplate(toName, toEmail, "new login to your account", "new-login-email",
+		struct {
+			Server    string
+			UserAgent string
+			IP        string
+			At        string
+			Code      string
+		}{
+			Server:    m.config.ApiServer,
+			UserAgent: userAgent,
+			IP:        ip,
+			At:        at.UTC().Format(time.RFC1123),
+			Code:      code,
+		})
+}
+
+// compose renders the templates of a mail into a message.
+func (m *SMTP) compose(toName string, toEmail string, subject string, name string, data interface{}) (*Message, error) {
+	var html, text bytes.Buffer
+	if err := m.tmpl.ExecuteTemplate(&html, name+".tmpl", data); err != nil {
+		return nil, err
+	}
+	if err := m.textTmpl.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return nil, err
+	}
+	messageId, err := m.messageId()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		From:            *m.from,
+		To:              mail.Address{Name: toName, Address: toEmail},
+		Subject:         subject,
+		MessageId:       messageId,
+		Date:            m.now(),
+		ListUnsubscribe: m.config.ListUnsubscribe,
+		Text:            text.String(),
+		HTML:            html.String(),
+	}, nil
+}
+
+// messageId is a random id in the domain of the sender.
+func (m *SMTP) messageId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	domain := m.from.Address[strings.LastIndex(m.from.Address, "@")+1:]
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">", nil
+}
+
+func (m *SMTP) sendTemplate(toName string, toEmail string, subject string, name string, data interface{}) error {
+	msg, err := m.compose(toName, toEmail, subject, name, data)
 	if err != nil {
 		return err
 	}
-	return m.send(toName, toEmail, "password reset", b.String())
+	return m.send(msg)
 }
 
-func (m *SMTP) send(toName string, toEmail string, subject string, body string) error {
+// dial connects to the smtp server, upgrades the connection if starttls
+// is configured and authenticates.
+func (m *SMTP) dial() (*smtp.Client, error) {
 	var (
 		c   *smtp.Client
 		err error
 	)
-	host, _, err := net.SplitHostPort(m.config.Address)
-	if err != nil {
-		return err
-	}
-	if m.config.Auth.Username != "" {
-		conn, err := tls.Dial("tcp", m.config.Address, &tls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         host,
-		})
-		if err != nil {
-			return err
-		}
-		c, err = smtp.NewClient(conn, host)
+	if m.tlsMode == TLSImplicit {
+		conn, err := tls.Dial("tcp", m.config.Address, m.tls)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = c.Auth(smtp.PlainAuth("", m.config.Auth.Username, m.config.Auth.Password, host))
+		c, err = smtp.NewClient(conn, m.host)
 		if err != nil {
-			return err
+			conn.Close()
+			return nil, err
 		}
 	} else {
 		c, err = smtp.Dial(m.config.Address)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	if m.tlsMode == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("smtp server %s does not support STARTTLS", m.config.Address)
+		}
+		if err = c.StartTLS(m.tls); err != nil {
+			c.Close()
+			return nil, err
 		}
 	}
+	if m.auth != nil {
+		if err = c.Auth(m.auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (m *SMTP) send(msg *Message) error {
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
 	defer c.Close()
 
-	to := mail.Address{Name: toName, Address: toEmail}
-	header := make(map[string]string)
-	header["To"] = to.String()
-	header["From"] = m.config.FromEmail
-	header["Subject"] = subject
-	header["Content-Type"] = `text/html; charset="UTF-8"`
-	msg := ""
-	for k, v := range header {
-		msg += fmt.Sprintf("%s: %s\r\n", k, v)
-	}
-	msg += "\r\n" + body
-	bMsg := []byte(msg)
-	if err = c.Mail(m.config.FromEmail); err != nil {
+	bMsg, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	if err = c.Mail(msg.From.Address); err != nil {
 		return err
 	}
-	err = c.Rcpt(toEmail)
+	err = c.Rcpt(msg.To.Address)
 	if err != nil {
 		return err
 	}
@@ -14,6 +14,7 @@ func TestSend(t *testing.T) {
 		WebServer:     "www.z42.com",
 		ApiServer:     "api.z42.com",
 		HtmlTemplates: "../../templates/*.tmpl",
+		TextTemplates: "../../templates/*.txt",
 	})
 	Expect(err).To(BeNil())
 	err = m.SendEMailVerification("arash", "arash@legioner", "test")
@@ -29,6 +30,7 @@ func TestSendWithAuthGMail(t *testing.T) {
 		WebServer:     "www.zone-42.com",
 		ApiServer:     "api.zone-42.com",
 		HtmlTemplates: "../../templates/*.tmpl",
+		TextTemplates: "../../templates/*.txt",
 		Auth: Auth{
 			Username: "AAAA.AAAA@gmail.com",
 			Password: "XXXXXXXX",
@@ -48,6 +50,7 @@ func TestSendWithAuthAWS(t *testing.T) {
 		WebServer:     "www.z42.com",
 		ApiServer:     "api.z42.com",
 		HtmlTemplates: "../../templates/*.tmpl",
+		TextTemplates: "../../templates/*.txt",
 		Auth: Auth{
 			Username: "AAAAAAAAAAAAAAAAAAAA",
 			Password: "XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX",
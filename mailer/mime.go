@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"time"
+)
+
+// Message is an email with a plain text and an html version of the same
+// content. its encoding only depends on its fields, headers are always
+// written in the same order and the boundary is derived from the content.
+type Message struct {
+	From            mail.Address
+	To              mail.Address
+	Subject         string
+	MessageId       string
+	Date            time.Time
+	ListUnsubscribe string
+	Text            string
+	HTML            string
+}
+
+// Bytes encodes the message as multipart/alternative, the text part first
+// so that clients prefer the html part. subjects and names are RFC 2047
+// encoded, bodies are quoted-printable.
+func (msg *Message) Bytes() ([]byte, error) {
+	boundary := msg.boundary()
+	headers := [][2]string{
+		{"Date", msg.Date.Format(time.RFC1123Z)},
+		{"From", msg.From.String()},
+		{"To", msg.To.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Message-ID", msg.MessageId},
+	}
+	if msg.ListUnsubscribe != "" {
+		headers = append(headers, [2]string{"List-Unsubscribe", "<" + msg.ListUnsubscribe + ">"})
+	}
+	headers = append(headers,
+		[2]string{"MIME-Version", "1.0"},
+		[2]string{"Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": boundary})},
+	)
+
+	var b bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	b.WriteString("\r\n")
+	w := multipart.NewWriter(&b)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// boundary is derived from the content. it starts with "=_", which never
+// appears in quoted-printable bodies: their "=" is always followed by hex
+// digits or a line break.
+func (msg *Message) boundary() string {
+	h := sha256.New()
+	for _, s := range []string{msg.MessageId, msg.Subject, msg.Text, msg.HTML} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return "=_" + hex.EncodeToString(h.Sum(nil))[:40]
+}
@@ -0,0 +1,121 @@
+package mailer
+
+import (
+	"bytes"
+	. "github.com/onsi/gomega"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	RegisterTestingT(t)
+	msg := &Message{
+		From:            mail.Address{Name: "Zone-42", Address: "noreply@z42.com"},
+		To:              mail.Address{Name: "Zoë", Address: "user1@example.com"},
+		Subject:         "Bestätigung Ihrer E-Mail-Adresse",
+		MessageId:       "<1234@z42.com>",
+		Date:            time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ListUnsubscribe: "mailto:unsubscribe@z42.com",
+		Text:            "Hallo Zoë,\nplease open https://z42.com/verify?code=abc=def\n",
+		HTML:            "<p>Hallo Zoë, <a href=\"https://z42.com/verify?code=abc=def\">verify</a></p>",
+	}
+	b, err := msg.Bytes()
+	Expect(err).To(BeNil())
+
+	// equal messages encode equally, headers in a fixed order
+	again, err := msg.Bytes()
+	Expect(err).To(BeNil())
+	Expect(again).To(Equal(b))
+	Expect(string(b)).To(HavePrefix("Date: Fri, 01 Mar 2024 12:30:00 +0000\r\n" +
+		"From: \"Zone-42\" <noreply@z42.com>\r\n" +
+		"To: =?utf-8?q?Zo=C3=AB?= <user1@example.com>\r\n" +
+		"Subject: =?utf-8?q?"))
+	Expect(string(b)).NotTo(ContainSubstring("Bestätigung"))
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(b))
+	Expect(err).To(BeNil())
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	Expect(err).To(BeNil())
+	Expect(subject).To(Equal(msg.Subject))
+	Expect(parsed.Header.Get("Message-ID")).To(Equal("<1234@z42.com>"))
+	Expect(parsed.Header.Get("List-Unsubscribe")).To(Equal("<mailto:unsubscribe@z42.com>"))
+	Expect(parsed.Header.Get("MIME-Version")).To(Equal("1.0"))
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	Expect(err).To(BeNil())
+	Expect(mediaType).To(Equal("multipart/alternative"))
+	r := multipart.NewReader(parsed.Body, params["boundary"])
+	var (
+		types  []string
+		bodies []string
+	)
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).To(BeNil())
+		body, err := io.ReadAll(part)
+		Expect(err).To(BeNil())
+		types = append(types, part.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	Expect(types).To(Equal([]string{"text/plain; charset=utf-8", "text/html; charset=utf-8"}))
+	Expect(strings.ReplaceAll(bodies[0], "\r\n", "\n")).To(Equal(msg.Text))
+	Expect(bodies[1]).To(Equal(msg.HTML))
+
+	// the header is optional
+	msg.ListUnsubscribe = ""
+	b, err = msg.Bytes()
+	Expect(err).To(BeNil())
+	Expect(string(b)).NotTo(ContainSubstring("List-Unsubscribe"))
+}
+
+func TestCompose(t *testing.T) {
+	RegisterTestingT(t)
+	m, err := NewSMTP(&Config{
+		Address:         "127.0.0.1:25",
+		FromEmail:       "Zone-42 <noreply@z42.com>",
+		WebServer:       "www.z42.com",
+		ApiServer:       "api.z42.com",
+		HtmlTemplates:   "../templates/*.tmpl",
+		TextTemplates:   "../templates/*.txt",
+		ListUnsubscribe: "https://www.z42.com/unsubscribe",
+	})
+	Expect(err).To(BeNil())
+	s := m.(*SMTP)
+	data := map[string]string{"Server": "api.z42.com", "Code": "abc", "Until": "now", "NewEmail": "user2@example.com", "UserAgent": "curl", "IP": "1.1.1.1", "At": "now"}
+	for _, name := range []string{
+		"verification-email", "password-reset-email", "account-locked-email", "password-changed-email",
+		"email-change-verification-email", "email-change-notice-email", "account-deleted-email",
+		"new-login-email", "signup-attempt-email",
+	} {
+		msg, err := s.compose("User One", "user1@example.com", "subject", name, data)
+		Expect(err).To(BeNil(), name)
+		Expect(msg.HTML).To(ContainSubstring("<html>"), name)
+		Expect(msg.Text).NotTo(BeEmpty(), name)
+		Expect(msg.Text).NotTo(ContainSubstring("<"), name)
+		Expect(msg.From.Address).To(Equal("noreply@z42.com"))
+		Expect(msg.MessageId).To(MatchRegexp(`^<[0-9a-f]{32}@z42\.com>$`))
+		Expect(msg.ListUnsubscribe).To(Equal("https://www.z42.com/unsubscribe"))
+	}
+	data["Code"] = ""
+	notice, err := s.compose("User One", "user1@example.com", "subject", "email-change-notice-email", data)
+	Expect(err).To(BeNil())
+	Expect(notice.Text).NotTo(ContainSubstring("/auth/email/cancel"))
+	Expect(notice.HTML).NotTo(ContainSubstring("/auth/email/cancel"))
+	data["Code"] = "abc"
+	other, err := s.compose("User One", "user1@example.com", "subject", "verification-email", data)
+	Expect(err).To(BeNil())
+	first, err := s.compose("User One", "user1@example.com", "subject", "verification-email", data)
+	Expect(err).To(BeNil())
+	Expect(other.MessageId).NotTo(Equal(first.MessageId))
+
+	_, err = NewSMTP(&Config{FromEmail: "not an address", HtmlTemplates: "../templates/*.tmpl", TextTemplates: "../templates/*.txt"})
+	Expect(err).NotTo(BeNil())
+}
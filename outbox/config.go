@@ -0,0 +1,43 @@
+package outbox
+
+// Config controls how outbox messages are carried out. failed messages are
+// retried after BaseDelay, doubling up to MaxDelay, until MaxAttempts were
+// made. durations are in seconds.
+type Config struct {
+	Interval    int `json:"interval"`
+	BatchSize   int `json:"batch_size"`
+	MaxAttempts int `json:"max_attempts"`
+	BaseDelay   int `json:"base_delay"`
+	MaxDelay    int `json:"max_delay"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:    10,
+		BatchSize:   100,
+		MaxAttempts: 10,
+		BaseDelay:   30,
+		MaxDelay:    3600,
+	}
+}
+
+// withDefaults fills in the defaults of fields that are not set.
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.Interval <= 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaults.BatchSize
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaults.MaxAttempts
+	}
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = defaults.BaseDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaults.MaxDelay
+	}
+	return c
+}
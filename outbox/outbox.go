@@ -0,0 +1,339 @@
+package outbox
+
+import (
+	"auth/database"
+	"auth/mailer"
+	"auth/webhook"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"time"
+)
+
+type Storage interface {
+	GetDueOutboxMessages(ctx context.Context, before time.Time, limit int) ([]database.OutboxMessage, error)
+	UpdateOutboxMessage(ctx context.Context, m database.OutboxMessage) error
+	GetVerifications(ctx context.Context, userId database.ObjectId) ([]database.Verification, error)
+}
+
+// kinds of outbox messages.
+const (
+	KindEmailVerification = "mail.email_verification"
+	KindPasswordReset     = "mail.password_reset"
+	KindSignupAttempt     = "mail.signup_attempt"
+	KindAccountLocked     = "mail.account_locked"
+	KindPasswordChanged   = "mail.password_changed"
+	KindAccountDeleted    = "mail.account_deleted"
+	// email change mails, the verification goes to the new address and the
+	// notice with the cancel link to the current one
+	KindEmailChangeVerification = "mail.email_change_verification"
+	KindEmailChangeNotice       = "mail.email_change_notice"
+	KindNewLoginAlert           = "mail.new_login_alert"
+	KindEvent                   = "event"
+)
+
+// maxErrorLength matches the LastError column of the Outbox table.
+const maxErrorLength = 255
+
+// maxDoublings keeps the exponential delay from overflowing.
+const maxDoublings = 20
+
+// Mail is the payload of mail messages. codes are not stored, they are read
+// from the user's pending verification when the mail is sent, so a mail of
+// a verification that is gone is dropped. Login is set for new login alerts,
+// Until for account locked mails and NewEmail for email change notices.
+type Mail struct {
+	UserId   database.ObjectId `json:"user_id"`
+	Email    string            `json:"email"`
+	Login    *Login            `json:"login,omitempty"`
+	Until    *time.Time        `json:"until,omitempty"`
+	NewEmail string            `json:"new_email,omitempty"`
+}
+
+// Login is the login a new login alert is about.
+type Login struct {
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	At        time.Time `json:"at"`
+}
+
+// Event is the payload of webhook event messages. the id is fixed when the
+// message is created, so retries publish the same event.
+type Event struct {
+	Id   database.ObjectId `json:"id"`
+	Type string            `json:"type"`
+	Data json.RawMessage   `json:"data"`
+}
+
+// verificationTypes are the codes sent by the mail kinds.
+var verificationTypes = map[string]database.VerificationType{
+	KindEmailVerification:       database.VerificationTypeSignup,
+	KindPasswordReset:           database.VerificationTypeRecover,
+	KindEmailChangeVerification: database.VerificationTypeChangeEmail,
+	KindNewLoginAlert:           database.VerificationTypeReportLogin,
+}
+
+// errObsolete marks messages that no longer need to be carried out.
+var errObsolete = errors.New("obsolete")
+
+// Dispatcher creates outbox messages, to be stored along with the change
+// they belong to, and carries them out in the background. messages are
+// carried out at least once.
+type Dispatcher struct {
+	db       Storage
+	config   Config
+	mailer   mailer.Mailer
+	webhooks *webhook.Dispatcher
+	wake     chan struct{}
+	now      func() time.Time
+}
+
+// New creates a dispatcher, a nil config gives the defaults.
+func New(config *Config, db Storage, mailer mailer.Mailer, webhooks *webhook.Dispatcher) *Dispatcher {
+	d := &Dispatcher{
+		db:       db,
+		config:   DefaultConfig(),
+		mailer:   mailer,
+		webhooks: webhooks,
+		wake:     make(chan struct{}, 1),
+		now:      time.Now,
+	}
+	if config != nil {
+		d.config = config.withDefaults()
+	}
+	return d
+}
+
+// Mail creates a message sending a mail of the given kind to a user.
+func (d *Dispatcher) Mail(kind string, userId database.ObjectId, email string) database.OutboxMessage {
+	payload, _ := json.Marshal(Mail{UserId: userId, Email: email})
+	return d.message(kind, payload)
+}
+
+// LoginAlert creates a message alerting a user of a login from a new device.
+func (d *Dispatcher) LoginAlert(userId database.ObjectId, email string, login Login) database.OutboxMessage {
+	payload, _ := json.Marshal(Mail{UserId: userId, Email: email, Login: &login})
+	return d.message(KindNewLoginAlert, payload)
+}
+
+// AccountLocked creates a message telling a user that logins are locked
+// until the given time.
+func (d *Dispatcher) AccountLocked(userId database.ObjectId, email string, until time.Time) database.OutboxMessage {
+	payload, _ := json.Marshal(Mail{UserId: userId, Email: email, Until: &until})
+	return d.message(KindAccountLocked, payload)
+}
+
+// EmailChangeNotice creates a message telling the current address of a user
+// that a change to newEmail was requested.
+func (d *Dispatcher) EmailChangeNotice(userId database.ObjectId, email string, newEmail string) database.OutboxMessage {
+	payload, _ := json.Marshal(Mail{UserId: userId, Email: email, NewEmail: newEmail})
+	return d.message(KindEmailChangeNotice, payload)
+}
+
+// Event creates a message publishing a webhook event.
+func (d *Dispatcher) Event(event string, data interface{}) (database.OutboxMessage, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return database.OutboxMessage{}, err
+	}
+	payload, err := json.Marshal(Event{Id: database.NewObjectId(), Type: event, Data: encoded})
+	if err != nil {
+		return database.OutboxMessage{}, err
+	}
+	return d.message(KindEvent, payload), nil
+}
+
+func (d *Dispatcher) message(kind string, payload json.RawMessage) database.OutboxMessage {
+	now := d.now()
+	return database.OutboxMessage{
+		Kind:        kind,
+		Payload:     payload,
+		Status:      database.OutboxPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+// Notify wakes Run up after new messages were stored, so that they do not
+// wait for the next interval. it never blocks.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run carries out due messages every interval, or when notified, until ctx
+// is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(d.config.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if _, err := d.Deliver(ctx); err != nil && ctx.Err() == nil {
+			zap.L().Error("processing outbox failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Deliver carries out one batch of due messages, it returns the number of
+// successful ones.
+func (d *Dispatcher) Deliver(ctx context.Context) (int, error) {
+	due, err := d.db.GetDueOutboxMessages(ctx, d.now(), d.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, m := range due {
+		if d.attempt(ctx, &m) {
+			sent++
+		}
+		if err := d.db.UpdateOutboxMessage(ctx, m); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// attempt carries out a message and records the outcome in it.
+func (d *Dispatcher) attempt(ctx context.Context, m *database.OutboxMessage) bool {
+	m.Attempts++
+	m.UpdatedAt = d.now()
+	err := d.process(ctx, m)
+	if err == nil || errors.Is(err, errObsolete) {
+		m.Status = database.OutboxSent
+		m.LastError = ""
+		if err != nil {
+			zap.L().Info("dropped obsolete outbox message", zap.Int64("message", m.Id), zap.String("kind", m.Kind))
+		}
+		return err == nil
+	}
+	m.LastError = err.Error()
+	if len(m.LastError) > maxErrorLength {
+		m.LastError = m.LastError[:maxErrorLength]
+	}
+	if m.Attempts >= d.config.MaxAttempts {
+		m.Status = database.OutboxFailed
+		zap.L().Error("outbox message failed",
+			zap.Int64("message", m.Id),
+			zap.String("kind", m.Kind),
+			zap.String("error", m.LastError),
+		)
+		return false
+	}
+	m.NextAttempt = d.now().Add(d.delay(m.Attempts))
+	return false
+}
+
+func (d *Dispatcher) process(ctx context.Context, m *database.OutboxMessage) error {
+	if m.Kind == KindEvent {
+		var e Event
+		if err := json.Unmarshal(m.Payload, &e); err != nil {
+			return err
+		}
+		return d.webhooks.Publish(ctx, e.Id, e.Type, e.Data)
+	}
+	var mail Mail
+	if err := json.Unmarshal(m.Payload, &mail); err != nil {
+		return err
+	}
+	switch m.Kind {
+	case KindSignupAttempt:
+		return d.mailer.SendSignupAttempt(mail.Email, mail.Email)
+	case KindPasswordChanged:
+		return d.mailer.SendPasswordChanged(mail.Email, mail.Email)
+	case KindAccountDeleted:
+		return d.mailer.SendAccountDeleted(mail.Email, mail.Email)
+	case KindAccountLocked:
+		if mail.Until == nil {
+			return fmt.Errorf("account locked mail without lock time")
+		}
+		return d.mailer.SendAccountLocked(mail.Email, mail.Email, *mail.Until)
+	case KindEmailChangeNotice:
+		return d.emailChangeNotice(ctx, mail)
+	}
+	verificationType, ok := verificationTypes[m.Kind]
+	if !ok {
+		return fmt.Errorf("unknown outbox message kind %s", m.Kind)
+	}
+	v, err := d.verification(ctx, mail.UserId, verificationType)
+	if err != nil {
+		return err
+	}
+	switch m.Kind {
+	case KindEmailVerification:
+		return d.mailer.SendEMailVerification(mail.Email, mail.Email, v.Code)
+	case KindEmailChangeVerification:
+		// replaced by a request for another address
+		if v.Value != mail.Email {
+			return errObsolete
+		}
+		return d.mailer.SendEmailChangeVerification(mail.Email, mail.Email, v.Code)
+	case KindNewLoginAlert:
+		if mail.Login == nil {
+			return fmt.Errorf("login alert without login")
+		}
+		return d.mailer.SendNewLoginAlert(mail.Email, mail.Email, mail.Login.UserAgent, mail.Login.IP, mail.Login.At, v.Code)
+	default:
+		return d.mailer.SendPasswordReset(mail.Email, mail.Email, v.Code)
+	}
+}
+
+// emailChangeNotice is sent even if the change was confirmed, cancelled or
+// replaced in the meantime, the current address has to learn about it. the
+// cancel link is left out unless the change is still pending.
+func (d *Dispatcher) emailChangeNotice(ctx context.Context, mail Mail) error {
+	verifications, err := d.db.GetVerifications(ctx, mail.UserId)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return err
+	}
+	pending := false
+	cancelCode := ""
+	for _, v := range verifications {
+		switch v.Type {
+		case database.VerificationTypeChangeEmail:
+			pending = v.Value == mail.NewEmail
+		case database.VerificationTypeCancelEmail:
+			cancelCode = v.Code
+		}
+	}
+	if !pending {
+		cancelCode = ""
+	}
+	return d.mailer.SendEmailChangeNotice(mail.Email, mail.Email, mail.NewEmail, cancelCode)
+}
+
+// verification returns the pending verification of a user, errObsolete if
+// there is none of the type.
+func (d *Dispatcher) verification(ctx context.Context, userId database.ObjectId, verificationType database.VerificationType) (database.Verification, error) {
+	verifications, err := d.db.GetVerifications(ctx, userId)
+	if errors.Is(err, database.ErrNotFound) {
+		return database.Verification{}, errObsolete
+	}
+	if err != nil {
+		return database.Verification{}, err
+	}
+	for _, v := range verifications {
+		if v.Type == verificationType {
+			return v, nil
+		}
+	}
+	return database.Verification{}, errObsolete
+}
+
+// delay is the back-off before the next attempt after the given number of
+// failed attempts.
+func (d *Dispatcher) delay(attempts int) time.Duration {
+	base := time.Duration(d.config.BaseDelay) * time.Second
+	maxDelay := time.Duration(d.config.MaxDelay) * time.Second
+	delay := base << min(attempts-1, maxDoublings)
+	return min(delay, maxDelay)
+}
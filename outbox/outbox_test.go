@@ -0,0 +1,242 @@
+package outbox
+
+import (
+	"auth/database"
+	"auth/mailer"
+	"auth/webhook"
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	db := database.NewMemory()
+	mailFailure := errors.New("smtp server unavailable")
+	var (
+		failing bool
+		sent    []string
+	)
+	m := &mailer.Mock{
+		SendEMailVerificationFunc: func(toName string, toEmail string, code string) error {
+			if failing {
+				return mailFailure
+			}
+			sent = append(sent, toEmail+" "+code)
+			return nil
+		},
+		SendPasswordResetFunc: func(toName string, toEmail string, code string) error {
+			sent = append(sent, toEmail+" "+code)
+			return nil
+		},
+	}
+	webhooks := webhook.New(&webhook.Config{Endpoints: []webhook.Endpoint{{Name: "test", URL: "http://localhost"}}, BatchSize: 10}, db)
+	d := New(&Config{BatchSize: 10, MaxAttempts: 2, BaseDelay: 60, MaxDelay: 600}, db, m, webhooks)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	// signup mails are retried while the mail server is down
+	userId := database.NewObjectId()
+	event, err := d.Event(webhook.EventUserCreated, webhook.User{Id: userId, Email: "user1@example.com"})
+	Expect(err).To(BeNil())
+	_, code, err := db.AddUser(ctx, database.NewUser{Id: userId, Email: "user1@example.com", Status: database.UserStatusPending},
+		d.Mail(KindEmailVerification, userId, "user1@example.com"), event)
+	Expect(err).To(BeNil())
+	failing = true
+	n, err := d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(Equal(1))
+	Expect(sent).To(BeEmpty())
+	deliveries, err := webhooks.Deliveries(ctx, database.WebhookFilter{Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(deliveries).To(HaveLen(1))
+	Expect(deliveries[0].Event).To(Equal(webhook.EventUserCreated))
+
+	failing = false
+	n, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(BeZero())
+	now = now.Add(time.Minute)
+	n, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(Equal(1))
+	Expect(sent).To(Equal([]string{"user1@example.com " + code}))
+
+	// mails of verifications that are gone are dropped
+	_, err = db.SetRecoveryCode(ctx, userId, d.Mail(KindPasswordReset, userId, "user1@example.com"))
+	Expect(err).To(BeNil())
+	recoveryCode, err := db.GetVerification(ctx, userId, database.VerificationTypeRecover)
+	Expect(err).To(BeNil())
+	Expect(db.ResetPassword(ctx, recoveryCode, "hash")).To(Succeed())
+	n, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(BeZero())
+	due, err := db.GetDueOutboxMessages(ctx, now.Add(time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(BeEmpty())
+
+	// messages fail for good after MaxAttempts
+	_, err = db.SetRecoveryCode(ctx, userId, d.message("unknown", nil))
+	Expect(err).To(BeNil())
+	for i := 0; i < 3; i++ {
+		n, err = d.Deliver(ctx)
+		Expect(err).To(BeNil())
+		Expect(n).To(BeZero())
+		now = now.Add(time.Hour)
+	}
+	due, err = db.GetDueOutboxMessages(ctx, now, 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(BeEmpty())
+}
+
+func TestOutboxEmailChange(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	db := database.NewMemory()
+	var sent []string
+	m := &mailer.Mock{
+		SendEmailChangeVerificationFunc: func(toName string, toEmail string, code string) error {
+			sent = append(sent, "confirm "+toEmail+" "+code)
+			return nil
+		},
+		SendEmailChangeNoticeFunc: func(toName string, toEmail string, newEmail string, code string) error {
+			sent = append(sent, "notice "+toEmail+" "+newEmail+" "+code)
+			return nil
+		},
+	}
+	d := New(&Config{BatchSize: 10, MaxAttempts: 2}, db, m, nil)
+	userId, _, err := db.AddUser(ctx, database.NewUser{Email: "user1@example.com", Status: database.UserStatusActive})
+	Expect(err).To(BeNil())
+
+	// a request replaced before its mails went out still notifies the current
+	// address, only the pending request comes with a cancel link
+	_, _, err = db.SetEmailChange(ctx, userId, "user2@example.com",
+		d.Mail(KindEmailChangeVerification, userId, "user2@example.com"),
+		d.EmailChangeNotice(userId, "user1@example.com", "user2@example.com"))
+	Expect(err).To(BeNil())
+	confirmCode, cancelCode, err := db.SetEmailChange(ctx, userId, "user3@example.com",
+		d.Mail(KindEmailChangeVerification, userId, "user3@example.com"),
+		d.EmailChangeNotice(userId, "user1@example.com", "user3@example.com"))
+	Expect(err).To(BeNil())
+	n, err := d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(Equal(3))
+	Expect(sent).To(ConsistOf(
+		"confirm user3@example.com "+confirmCode,
+		"notice user1@example.com user2@example.com ",
+		"notice user1@example.com user3@example.com "+cancelCode,
+	))
+
+	// a change confirmed before the notice went out is still announced
+	sent = nil
+	confirmCode, _, err = db.SetEmailChange(ctx, userId, "user4@example.com",
+		d.EmailChangeNotice(userId, "user1@example.com", "user4@example.com"))
+	Expect(err).To(BeNil())
+	Expect(db.ConfirmEmailChange(ctx, confirmCode)).To(Succeed())
+	n, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(Equal(1))
+	Expect(sent).To(Equal([]string{"notice user1@example.com user4@example.com "}))
+	due, err := db.GetDueOutboxMessages(ctx, time.Now().Add(time.Hour), 10)
+	Expect(err).To(BeNil())
+	Expect(due).To(BeEmpty())
+}
+
+func TestOutboxNewLoginAlert(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	db := database.NewMemory()
+	var sent []string
+	m := &mailer.Mock{
+		SendNewLoginAlertFunc: func(toName string, toEmail string, userAgent string, ip string, at time.Time, code string) error {
+			sent = append(sent, fmt.Sprintf("%s %s %s %s %s", toEmail, userAgent, ip, at.UTC().Format(time.RFC3339), code))
+			return nil
+		},
+	}
+	d := New(&Config{BatchSize: 10, MaxAttempts: 2}, db, m, nil)
+	userId, _, err := db.AddUser(ctx, database.NewUser{Email: "user1@example.com", Status: database.UserStatusActive})
+	Expect(err).To(BeNil())
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	code, err := db.SetReportCode(ctx, userId, d.LoginAlert(userId, "user1@example.com", Login{UserAgent: "browser", IP: "1.1.1.1", At: at}))
+	Expect(err).To(BeNil())
+	n, err := d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(Equal(1))
+	Expect(sent).To(Equal([]string{"user1@example.com browser 1.1.1.1 2024-05-01T12:00:00Z " + code}))
+
+	// alerts of logins that were reported already are dropped
+	_, err = db.SetReportCode(ctx, userId, d.LoginAlert(userId, "user1@example.com", Login{UserAgent: "browser", IP: "2.2.2.2", At: at}))
+	Expect(err).To(BeNil())
+	code, err = db.SetReportCode(ctx, userId)
+	Expect(err).To(BeNil())
+	_, err = db.ReportLogin(ctx, code)
+	Expect(err).To(BeNil())
+	n, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(BeZero())
+	Expect(sent).To(HaveLen(1))
+}
+
+func TestOutboxNotices(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	db := database.NewMemory()
+	var sent []string
+	m := &mailer.Mock{
+		SendAccountLockedFunc: func(toName string, toEmail string, until time.Time) error {
+			sent = append(sent, "locked "+toEmail+" "+until.UTC().Format(time.RFC3339))
+			return nil
+		},
+		SendPasswordChangedFunc: func(toName string, toEmail string) error {
+			sent = append(sent, "changed "+toEmail)
+			return nil
+		},
+	}
+	d := New(&Config{BatchSize: 10, MaxAttempts: 2}, db, m, nil)
+	userId, _, err := db.AddUser(ctx, database.NewUser{Email: "user1@example.com", Status: database.UserStatusActive})
+	Expect(err).To(BeNil())
+
+	until := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	Expect(db.AddOutboxMessages(ctx, d.AccountLocked(userId, "user1@example.com", until))).To(Succeed())
+	Expect(db.ChangePassword(ctx, userId, "hash", d.Mail(KindPasswordChanged, userId, "user1@example.com"))).To(Succeed())
+	n, err := d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(n).To(Equal(2))
+	Expect(sent).To(Equal([]string{"locked user1@example.com 2024-05-01T12:00:00Z", "changed user1@example.com"}))
+}
+
+func TestDelay(t *testing.T) {
+	RegisterTestingT(t)
+	d := New(&Config{BaseDelay: 30, MaxDelay: 3600}, nil, nil, nil)
+	Expect(d.delay(1)).To(Equal(30 * time.Second))
+	Expect(d.delay(2)).To(Equal(time.Minute))
+	Expect(d.delay(8)).To(Equal(time.Hour))
+	Expect(d.delay(1000)).To(Equal(time.Hour))
+}
+
+func TestConfigDefaults(t *testing.T) {
+	RegisterTestingT(t)
+	d := New(&Config{BatchSize: 10}, database.NewMemory(), nil, nil)
+	expected := DefaultConfig()
+	expected.BatchSize = 10
+	Expect(d.config).To(Equal(expected))
+
+	// a section without an interval must not make the ticker panic
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx)
+}
+
+func TestNotify(t *testing.T) {
+	RegisterTestingT(t)
+	d := New(nil, nil, nil, nil)
+	// repeated notifications never block
+	d.Notify()
+	d.Notify()
+	Expect(d.wake).To(HaveLen(1))
+}
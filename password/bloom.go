@@ -0,0 +1,146 @@
+package password
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// BloomFilter is a compact, probabilistic set of SHA-1 password hashes. it
+// never misses a breached password but reports a small fraction of other
+// passwords as breached too.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint32
+}
+
+var bloomMagic = [4]byte{'P', 'W', 'B', 'F'}
+
+var ErrInvalidBloomFilter = errors.New("invalid bloom filter")
+
+// NewBloomFilter sizes a filter for n entries with the given false positive rate.
+func NewBloomFilter(n uint64, falsePositiveRate float64) *BloomFilter {
+	n = max(n, 1)
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := uint32(max(math.Round(float64(m)/float64(n)*math.Ln2), 1))
+	return &BloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// positions derives the k bit positions of a SHA-1 digest by double hashing.
+func (f *BloomFilter) positions(digest [sha1.Size]byte, fn func(pos uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	for i := uint32(0); i < f.k; i++ {
+		if !fn((h1 + uint64(i)*h2) % f.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) AddHash(digest [sha1.Size]byte) {
+	f.positions(digest, func(pos uint64) bool {
+		f.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+func (f *BloomFilter) ContainsHash(digest [sha1.Size]byte) bool {
+	return f.positions(digest, func(pos uint64) bool {
+		return f.bits[pos/64]&(1<<(pos%64)) != 0
+	})
+}
+
+func (f *BloomFilter) IsBreached(ctx context.Context, password string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return f.ContainsHash(sha1.Sum([]byte(password))), nil
+}
+
+// WriteTo stores the filter as a magic number, m, k and the bit array, all
+// big endian.
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 16)
+	copy(header, bloomMagic[:])
+	binary.BigEndian.PutUint64(header[4:12], f.m)
+	binary.BigEndian.PutUint32(header[12:16], f.k)
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+	word := make([]byte, 8)
+	for _, b := range f.bits {
+		binary.BigEndian.PutUint64(word, b)
+		if _, err := bw.Write(word); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(header) + 8*len(f.bits)), bw.Flush()
+}
+
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrInvalidBloomFilter
+	}
+	if [4]byte(header[:4]) != bloomMagic {
+		return nil, ErrInvalidBloomFilter
+	}
+	f := &BloomFilter{
+		m: binary.BigEndian.Uint64(header[4:12]),
+		k: binary.BigEndian.Uint32(header[12:16]),
+	}
+	if f.m == 0 || f.k == 0 {
+		return nil, ErrInvalidBloomFilter
+	}
+	f.bits = make([]uint64, (f.m+63)/64)
+	word := make([]byte, 8)
+	for i := range f.bits {
+		if _, err := io.ReadFull(br, word); err != nil {
+			return nil, ErrInvalidBloomFilter
+		}
+		f.bits[i] = binary.BigEndian.Uint64(word)
+	}
+	return f, nil
+}
+
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	return ReadBloomFilter(file)
+}
+
+// ParseCorpusLine reads one line of a breach corpus, either a HIBP style
+// "SHA1:COUNT" entry or a plain text password, and returns its SHA-1 digest.
+func ParseCorpusLine(line string) ([sha1.Size]byte, bool) {
+	var digest [sha1.Size]byte
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return digest, false
+	}
+	entry, _, _ := strings.Cut(line, ":")
+	if len(entry) == 2*sha1.Size {
+		if _, err := hex.Decode(digest[:], []byte(entry)); err == nil {
+			return digest, true
+		}
+	}
+	return sha1.Sum([]byte(line)), true
+}
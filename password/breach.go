@@ -0,0 +1,144 @@
+package password
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BreachChecker tells whether a password appears in a corpus of breached
+// passwords.
+type BreachChecker interface {
+	IsBreached(ctx context.Context, password string) (bool, error)
+}
+
+const (
+	BreachModePrefixFiles = "prefix_files"
+	BreachModeBloom       = "bloom"
+	BreachModeRange       = "range"
+)
+
+// NewBreachChecker creates the checker selected by config, a nil config or
+// an empty mode disables screening and returns nil.
+func NewBreachChecker(config *BreachConfig) (BreachChecker, error) {
+	if config == nil {
+		return nil, nil
+	}
+	switch config.Mode {
+	case "":
+		return nil, nil
+	case BreachModePrefixFiles:
+		return NewPrefixFiles(config.Path)
+	case BreachModeBloom:
+		return LoadBloomFilter(config.Path)
+	case BreachModeRange:
+		return NewRangeClient(config.URL, time.Duration(config.Timeout)*time.Second), nil
+	default:
+		return nil, fmt.Errorf("unknown breach mode %q", config.Mode)
+	}
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// rangeContains scans a HIBP range response, lines of "SUFFIX:COUNT", for
+// suffix. entries with a zero count are padding and are ignored.
+func rangeContains(r io.Reader, suffix string) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entry, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(entry, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// PrefixFiles looks passwords up in a directory of HIBP range files, one file
+// per 5 character SHA-1 prefix as written by the pwned passwords downloader.
+type PrefixFiles struct {
+	dir string
+}
+
+func NewPrefixFiles(dir string) (*PrefixFiles, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &PrefixFiles{dir: dir}, nil
+}
+
+func (p *PrefixFiles) IsBreached(ctx context.Context, password string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	hash := sha1Hex(password)
+	prefix, suffix := hash[:5], hash[5:]
+	for _, name := range []string{prefix + ".txt", prefix} {
+		f, err := os.Open(filepath.Join(p.dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		found, err := rangeContains(f, suffix)
+		_ = f.Close()
+		return found, err
+	}
+	return false, nil
+}
+
+// RangeClient queries a pwned passwords style k-anonymity api, only the first
+// 5 characters of the password's SHA-1 ever leave the process.
+type RangeClient struct {
+	client *http.Client
+	url    string
+}
+
+const DefaultRangeURL = "https://api.pwnedpasswords.com/range/"
+
+func NewRangeClient(url string, timeout time.Duration) *RangeClient {
+	if url == "" {
+		url = DefaultRangeURL
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &RangeClient{
+		client: &http.Client{Timeout: timeout},
+		url:    strings.TrimSuffix(url, "/") + "/",
+	}
+}
+
+func (c *RangeClient) IsBreached(ctx context.Context, password string) (bool, error) {
+	hash := sha1Hex(password)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+hash[:5], nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Add-Padding", "true")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("range request failed with status %d", resp.StatusCode)
+	}
+	return rangeContains(resp.Body, hash[5:])
+}
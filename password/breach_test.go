@@ -0,0 +1,112 @@
+package password
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var breached = []string{"password", "letmein", "Tr0ub4dor&3"}
+
+func TestPrefixFiles(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, p := range breached {
+		hash := sha1Hex(p)
+		content := fmt.Sprintf("0000000000000000000000000000000000A:1\n%s:42\n", hash[5:])
+		Expect(os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(content), 0600)).To(BeNil())
+	}
+
+	checker, err := NewBreachChecker(&BreachConfig{Mode: BreachModePrefixFiles, Path: dir})
+	Expect(err).To(BeNil())
+	for _, p := range breached {
+		Expect(checker.IsBreached(ctx, p)).To(BeTrue(), p)
+	}
+	Expect(checker.IsBreached(ctx, "correct horse battery")).To(BeFalse())
+
+	_, err = NewBreachChecker(&BreachConfig{Mode: BreachModePrefixFiles, Path: filepath.Join(dir, "missing")})
+	Expect(err).NotTo(BeNil())
+}
+
+func TestBloomFilter(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	filter := NewBloomFilter(1000, 0.001)
+	for i, p := range breached {
+		// corpus lines may be hashes with counts or plain passwords
+		line := p
+		if i%2 == 0 {
+			line = sha1Hex(p) + ":10"
+		}
+		digest, ok := ParseCorpusLine(line)
+		Expect(ok).To(BeTrue())
+		filter.AddHash(digest)
+	}
+
+	var b bytes.Buffer
+	_, err := filter.WriteTo(&b)
+	Expect(err).To(BeNil())
+	path := filepath.Join(t.TempDir(), "breached.bloom")
+	Expect(os.WriteFile(path, b.Bytes(), 0600)).To(BeNil())
+
+	checker, err := NewBreachChecker(&BreachConfig{Mode: BreachModeBloom, Path: path})
+	Expect(err).To(BeNil())
+	for _, p := range breached {
+		Expect(checker.IsBreached(ctx, p)).To(BeTrue(), p)
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if found, _ := checker.IsBreached(ctx, fmt.Sprintf("not breached %d", i)); found {
+			falsePositives++
+		}
+	}
+	Expect(falsePositives).To(BeNumerically("<", 10))
+
+	_, err = ReadBloomFilter(strings.NewReader("garbage"))
+	Expect(err).To(Equal(ErrInvalidBloomFilter))
+}
+
+func TestRangeClient(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/range/")
+		requested = append(requested, prefix)
+		Expect(r.Header.Get("Add-Padding")).To(Equal("true"))
+		for _, p := range breached {
+			if hash := sha1Hex(p); hash[:5] == prefix {
+				_, _ = fmt.Fprintf(w, "%s:3\r\n", hash[5:])
+			}
+		}
+		// padding
+		_, _ = fmt.Fprintf(w, "%s:0\r\n", sha1Hex("correct horse battery")[5:])
+	}))
+	defer server.Close()
+
+	checker := NewRangeClient(server.URL+"/range", time.Second)
+	Expect(checker.IsBreached(ctx, "letmein")).To(BeTrue())
+	Expect(checker.IsBreached(ctx, "correct horse battery")).To(BeFalse())
+	// only the prefix is sent
+	Expect(requested).To(Equal([]string{sha1Hex("letmein")[:5], sha1Hex("correct horse battery")[:5]}))
+}
+
+func TestPolicyBreached(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	filter := NewBloomFilter(10, 0.001)
+	digest, _ := ParseCorpusLine("Tr0ub4dor&3")
+	filter.AddHash(digest)
+	p := NewPolicy(nil, filter)
+	Expect(rules(p.Check(ctx, "Tr0ub4dor&3", "user1@example.com"))).To(ConsistOf(RuleBreached))
+	Expect(p.Check(ctx, "correct horse battery", "user1@example.com")).To(BeEmpty())
+}
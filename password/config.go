@@ -0,0 +1,74 @@
+package password
+
+// PolicyConfig lists the rules new passwords have to satisfy.
+type PolicyConfig struct {
+	MinLength     int  `json:"min_length"`
+	MaxLength     int  `json:"max_length"`
+	RequireLower  bool `json:"require_lower"`
+	RequireUpper  bool `json:"require_upper"`
+	RequireDigit  bool `json:"require_digit"`
+	RequireSymbol bool `json:"require_symbol"`
+	DisallowEmail bool `json:"disallow_email"`
+	MinStrength   int  `json:"min_strength"`
+}
+
+func DefaultPolicyConfig() PolicyConfig {
+	return PolicyConfig{
+		MinLength:     8,
+		MaxLength:     72,
+		DisallowEmail: true,
+		MinStrength:   2,
+	}
+}
+
+// BreachConfig selects where breached passwords are looked up. Mode is one of
+// "prefix_files" (Path is a directory of HIBP range files), "bloom" (Path is
+// a filter built with the bloom command) or "range" (URL of a k-anonymity
+// range api, Timeout in seconds). an empty mode disables screening.
+type BreachConfig struct {
+	Mode    string `json:"mode"`
+	Path    string `json:"path"`
+	URL     string `json:"url"`
+	Timeout int    `json:"timeout"`
+}
+
+// HasherConfig selects the algorithm new password hashes are created with.
+// hashes made by the other algorithm, or with other parameters, are still
+// accepted and get upgraded on the next successful login.
+type HasherConfig struct {
+	Algorithm  string       `json:"algorithm"`
+	BcryptCost int          `json:"bcrypt_cost"`
+	Argon2     Argon2Config `json:"argon2"`
+}
+
+// Argon2Config holds argon2id parameters, Memory is in KiB.
+type Argon2Config struct {
+	Memory      uint32 `json:"memory"`
+	Iterations  uint32 `json:"iterations"`
+	Parallelism uint8  `json:"parallelism"`
+	SaltLength  uint32 `json:"salt_length"`
+	KeyLength   uint32 `json:"key_length"`
+}
+
+func DefaultHasherConfig() HasherConfig {
+	return HasherConfig{
+		Algorithm:  AlgorithmArgon2id,
+		BcryptCost: 12,
+		Argon2: Argon2Config{
+			Memory:      19456,
+			Iterations:  2,
+			Parallelism: 1,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	}
+}
+
+// PoolConfig bounds the cpu spent on hashing. Workers hashes run at the same
+// time, up to QueueSize more wait for a worker and anything beyond that is
+// rejected. zero values default to the number of cpus and 4 times the
+// number of workers.
+type PoolConfig struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queue_size"`
+}
@@ -0,0 +1,177 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Algorithm is a password hashing scheme with its parameters.
+type Algorithm interface {
+	// Identify reports whether hash was created by this algorithm.
+	Identify(hash string) bool
+	Hash(password string) (string, error)
+	Verify(password string, hash string) (bool, error)
+	// Outdated reports whether hash was created with other parameters than
+	// the ones currently configured.
+	Outdated(hash string) bool
+}
+
+// Hasher creates hashes with the preferred algorithm and verifies hashes of
+// every known algorithm.
+type Hasher struct {
+	preferred  Algorithm
+	algorithms []Algorithm
+}
+
+// NewHasher creates a hasher from config, a nil config gives the defaults.
+func NewHasher(config *HasherConfig) (*Hasher, error) {
+	if config == nil {
+		c := DefaultHasherConfig()
+		config = &c
+	}
+	b := &Bcrypt{Cost: config.BcryptCost}
+	a := &Argon2id{Config: config.Argon2}
+	h := &Hasher{algorithms: []Algorithm{b, a}}
+	switch config.Algorithm {
+	case AlgorithmBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("invalid bcrypt cost %d", config.BcryptCost)
+		}
+		h.preferred = b
+	case AlgorithmArgon2id:
+		p := config.Argon2
+		if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 || p.SaltLength == 0 || p.KeyLength == 0 {
+			return nil, errors.New("invalid argon2 parameters")
+		}
+		h.preferred = a
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm %q", config.Algorithm)
+	}
+	return h, nil
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	return h.preferred.Hash(password)
+}
+
+func (h *Hasher) Verify(password string, hash string) (bool, error) {
+	for _, a := range h.algorithms {
+		if a.Identify(hash) {
+			return a.Verify(password, hash)
+		}
+	}
+	return false, ErrUnknownHash
+}
+
+// NeedsRehash reports whether hash should be replaced by a fresh hash of the
+// same password, because its algorithm or parameters are outdated.
+func (h *Hasher) NeedsRehash(hash string) bool {
+	return !h.preferred.Identify(hash) || h.preferred.Outdated(hash)
+}
+
+type Bcrypt struct {
+	Cost int
+}
+
+func (b *Bcrypt) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(bytes), err
+}
+
+func (b *Bcrypt) Verify(password string, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.Cost
+}
+
+// Argon2id hashes are stored in PHC string format:
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2id struct {
+	Config Argon2Config
+}
+
+const argon2Prefix = "$argon2id$"
+
+func (a *Argon2id) Identify(hash string) bool {
+	return strings.HasPrefix(hash, argon2Prefix)
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.Config.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Config.Iterations, a.Config.Memory, a.Config.Parallelism, a.Config.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		a.Config.Memory, a.Config.Iterations, a.Config.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a *Argon2id) Verify(password string, hash string) (bool, error) {
+	params, salt, key, err := decodeArgon2(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a *Argon2id) Outdated(hash string) bool {
+	params, _, _, err := decodeArgon2(hash)
+	return err != nil || params != a.Config
+}
+
+func decodeArgon2(hash string) (Argon2Config, []byte, []byte, error) {
+	var (
+		params  Argon2Config
+		version int
+	)
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
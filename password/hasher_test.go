@@ -0,0 +1,76 @@
+package password
+
+import (
+	"encoding/base64"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/argon2"
+	"testing"
+)
+
+var testArgon2 = Argon2Config{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHasher(t *testing.T) {
+	RegisterTestingT(t)
+	for _, config := range []HasherConfig{
+		{Algorithm: AlgorithmBcrypt, BcryptCost: 4, Argon2: testArgon2},
+		{Algorithm: AlgorithmArgon2id, BcryptCost: 4, Argon2: testArgon2},
+	} {
+		h, err := NewHasher(&config)
+		Expect(err).To(BeNil())
+		hash, err := h.Hash("password1")
+		Expect(err).To(BeNil())
+		Expect(h.Verify("password1", hash)).To(BeTrue())
+		Expect(h.Verify("password2", hash)).To(BeFalse())
+		Expect(h.NeedsRehash(hash)).To(BeFalse())
+
+		// salted
+		other, err := h.Hash("password1")
+		Expect(err).To(BeNil())
+		Expect(other).NotTo(Equal(hash))
+	}
+}
+
+func TestArgon2Format(t *testing.T) {
+	RegisterTestingT(t)
+	a := &Argon2id{Config: testArgon2}
+	hash, err := a.Hash("password1")
+	Expect(err).To(BeNil())
+	Expect(hash).To(MatchRegexp(`^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`))
+
+	// hashes with other parameters are verified using their own parameters
+	key := argon2.IDKey([]byte("password"), []byte("somesalt"), 2, 256, 2, 24)
+	phc := "$argon2id$v=19$m=256,t=2,p=2$c29tZXNhbHQ$" + base64.RawStdEncoding.EncodeToString(key)
+	ok, err := a.Verify("password", phc)
+	Expect(err).To(BeNil())
+	Expect(ok).To(BeTrue())
+	Expect(a.Outdated(phc)).To(BeTrue())
+
+	_, err = a.Verify("password", "$argon2id$v=19$m=64,t=1$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG")
+	Expect(err).To(Equal(ErrUnknownHash))
+}
+
+func TestNeedsRehash(t *testing.T) {
+	RegisterTestingT(t)
+	h, err := NewHasher(&HasherConfig{Algorithm: AlgorithmArgon2id, BcryptCost: 4, Argon2: testArgon2})
+	Expect(err).To(BeNil())
+
+	legacy, err := (&Bcrypt{Cost: 4}).Hash("password1")
+	Expect(err).To(BeNil())
+	Expect(h.Verify("password1", legacy)).To(BeTrue())
+	Expect(h.NeedsRehash(legacy)).To(BeTrue())
+
+	weaker := testArgon2
+	weaker.Iterations = 2
+	old, err := (&Argon2id{Config: weaker}).Hash("password1")
+	Expect(err).To(BeNil())
+	Expect(h.Verify("password1", old)).To(BeTrue())
+	Expect(h.NeedsRehash(old)).To(BeTrue())
+
+	_, err = h.Verify("password1", "plain text")
+	Expect(err).To(Equal(ErrUnknownHash))
+
+	_, err = NewHasher(&HasherConfig{Algorithm: "md5"})
+	Expect(err).NotTo(BeNil())
+	_, err = NewHasher(&HasherConfig{Algorithm: AlgorithmBcrypt, BcryptCost: 1})
+	Expect(err).NotTo(BeNil())
+}
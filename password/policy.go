@@ -0,0 +1,124 @@
+package password
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	RuleMinLength = "min_length"
+	RuleMaxLength = "max_length"
+	RuleLower     = "lower"
+	RuleUpper     = "upper"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleEmail     = "email"
+	RuleStrength  = "strength"
+	RuleBreached  = "breached"
+)
+
+// Violation is a policy rule a password failed.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type Policy struct {
+	config PolicyConfig
+	breach BreachChecker
+}
+
+// NewPolicy creates a policy from config, a nil config gives the default
+// policy. breach is optional and screens passwords against known breaches.
+func NewPolicy(config *PolicyConfig, breach BreachChecker) *Policy {
+	if config == nil {
+		c := DefaultPolicyConfig()
+		config = &c
+	}
+	return &Policy{config: *config, breach: breach}
+}
+
+// Check returns every rule password breaks for the account identified by
+// email, an empty result means the password is acceptable.
+func (p *Policy) Check(ctx context.Context, password string, email string) []Violation {
+	var violations []Violation
+	add := func(rule string, format string, args ...interface{}) {
+		violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if p.config.MinLength > 0 && length < p.config.MinLength {
+		add(RuleMinLength, "password must be at least %d characters long", p.config.MinLength)
+	}
+	if p.config.MaxLength > 0 && length > p.config.MaxLength {
+		add(RuleMaxLength, "password must be at most %d characters long", p.config.MaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.config.RequireLower && !lower {
+		add(RuleLower, "password must contain a lowercase letter")
+	}
+	if p.config.RequireUpper && !upper {
+		add(RuleUpper, "password must contain an uppercase letter")
+	}
+	if p.config.RequireDigit && !digit {
+		add(RuleDigit, "password must contain a digit")
+	}
+	if p.config.RequireSymbol && !symbol {
+		add(RuleSymbol, "password must contain a symbol")
+	}
+
+	if p.config.DisallowEmail && derivedFromEmail(password, email) {
+		add(RuleEmail, "password must not be based on your email address")
+	}
+	if p.config.MinStrength > 0 && Strength(password, email) < p.config.MinStrength {
+		add(RuleStrength, "password is too easy to guess")
+	}
+	if p.breach != nil {
+		breached, err := p.breach.IsBreached(ctx, password)
+		if err != nil {
+			// screening is best effort, an unavailable corpus should not block users
+			zap.L().Error("breached password check failed", zap.Error(err))
+		} else if breached {
+			add(RuleBreached, "password has appeared in a data breach")
+		}
+	}
+	return violations
+}
+
+// derivedFromEmail reports whether password is mostly the user part of email,
+// ignoring case, digits and punctuation.
+func derivedFromEmail(password string, email string) bool {
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	local = lettersOnly(local)
+	pw := lettersOnly(strings.ToLower(password))
+	if len(local) < 3 || len(pw) < 3 {
+		return false
+	}
+	return strings.Contains(pw, local) || strings.Contains(local, pw)
+}
+
+func lettersOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
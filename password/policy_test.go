@@ -0,0 +1,70 @@
+package password
+
+import (
+	"context"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func rules(violations []Violation) []string {
+	var r []string
+	for _, v := range violations {
+		r = append(r, v.Rule)
+	}
+	return r
+}
+
+func TestPolicy(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	p := NewPolicy(&PolicyConfig{
+		MinLength:     8,
+		MaxLength:     20,
+		RequireLower:  true,
+		RequireUpper:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		DisallowEmail: true,
+		MinStrength:   3,
+	}, nil)
+
+	Expect(p.Check(ctx, "Vq7#mZ2!kd", "user1@example.com")).To(BeEmpty())
+	Expect(rules(p.Check(ctx, "12345", "user1@example.com"))).To(ConsistOf(
+		RuleMinLength, RuleLower, RuleUpper, RuleSymbol, RuleStrength,
+	))
+	Expect(rules(p.Check(ctx, "Vq7#mZ2!kdVq7#mZ2!kd1", "user1@example.com"))).To(ConsistOf(RuleMaxLength))
+	Expect(rules(p.Check(ctx, "JohnSmith#1985", "john.smith@example.com"))).To(ContainElement(RuleEmail))
+	Expect(rules(p.Check(ctx, "Password123!", "user1@example.com"))).To(ConsistOf(RuleStrength))
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	p := NewPolicy(nil, nil)
+	Expect(p.Check(ctx, "correct horse battery", "user1@example.com")).To(BeEmpty())
+	Expect(rules(p.Check(ctx, "12345", "user1@example.com"))).To(ConsistOf(RuleMinLength, RuleStrength))
+	Expect(rules(p.Check(ctx, "user1@example.com", "user1@example.com"))).To(ConsistOf(RuleEmail, RuleStrength))
+}
+
+func TestStrength(t *testing.T) {
+	RegisterTestingT(t)
+	for password, score := range map[string]int{
+		"password":            0,
+		"Password123!":        0,
+		"qwerty":              0,
+		"aaaaaaaa":            1,
+		"abcdefgh":            1,
+		"asdfghjk":            1,
+		"zx9#kq2!":            4,
+		"Tr0ub4dor&3":         4,
+		"correcthorsebattery": 4,
+		"monkeydragon":        1,
+		"robertsmith.example": 4,
+	} {
+		Expect(Strength(password)).To(Equal(score), password)
+	}
+
+	// the user's own inputs are easy to guess
+	Expect(Strength("robertsmith", "robert.smith@example.com")).To(BeNumerically("<", Strength("robertsmith")))
+	Expect(Strength("example", "robert@example.com")).To(Equal(0))
+}
@@ -0,0 +1,181 @@
+package password
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrBusy   = errors.New("password hashing queue is full")
+	ErrClosed = errors.New("password hashing pool is closed")
+)
+
+// Pool runs the hashing and verification of a Hasher on a fixed number of
+// workers, so bursts of logins cannot starve the rest of the server.
+type Pool struct {
+	hasher *Hasher
+	jobs   chan func()
+	wg     sync.WaitGroup
+	stats  PoolStats
+	// mu guards closed, jobs are only queued under its read lock.
+	mu     sync.RWMutex
+	closed bool
+
+	queued    atomic.Int64
+	active    atomic.Int64
+	completed atomic.Int64
+	rejected  atomic.Int64
+	waitTotal atomic.Int64
+}
+
+// PoolStats is a snapshot of the pool's queue, WaitTime is the total time
+// jobs spent queued before a worker picked them up.
+type PoolStats struct {
+	Workers   int           `json:"workers"`
+	QueueSize int           `json:"queue_size"`
+	Queued    int64         `json:"queued"`
+	Active    int64         `json:"active"`
+	Completed int64         `json:"completed"`
+	Rejected  int64         `json:"rejected"`
+	WaitTime  time.Duration `json:"wait_time"`
+}
+
+// NewPool starts the workers of a pool for hasher, a nil config gives the
+// defaults.
+func NewPool(hasher *Hasher, config *PoolConfig) *Pool {
+	var c PoolConfig
+	if config != nil {
+		c = *config
+	}
+	if c.Workers <= 0 {
+		c.Workers = runtime.NumCPU()
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 4 * c.Workers
+	}
+	p := &Pool{
+		hasher: hasher,
+		jobs:   make(chan func(), c.QueueSize),
+		stats:  PoolStats{Workers: c.Workers, QueueSize: c.QueueSize},
+	}
+	for i := 0; i < c.Workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		job()
+	}
+}
+
+// Close stops the workers after the queued jobs are done. jobs submitted
+// afterwards fail with ErrClosed.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// result is what a job hands back to its caller. it is sent over a channel
+// rather than written to the caller's variables, which the caller no longer
+// reads once it gave up waiting.
+type result struct {
+	hash  string
+	match bool
+	err   error
+}
+
+func (p *Pool) Hash(ctx context.Context, password string) (string, error) {
+	r := p.run(ctx, func() result {
+		hash, err := p.hasher.Hash(password)
+		return result{hash: hash, err: err}
+	})
+	return r.hash, r.err
+}
+
+func (p *Pool) Verify(ctx context.Context, password string, hash string) (bool, error) {
+	r := p.run(ctx, func() result {
+		match, err := p.hasher.Verify(password, hash)
+		return result{match: match, err: err}
+	})
+	return r.match, r.err
+}
+
+// NeedsRehash is cheap and runs on the caller's goroutine.
+func (p *Pool) NeedsRehash(hash string) bool {
+	return p.hasher.NeedsRehash(hash)
+}
+
+func (p *Pool) Stats() PoolStats {
+	s := p.stats
+	s.Queued = p.queued.Load()
+	s.Active = p.active.Load()
+	s.Completed = p.completed.Load()
+	s.Rejected = p.rejected.Load()
+	s.WaitTime = time.Duration(p.waitTotal.Load())
+	return s
+}
+
+// run queues fn and waits for its result. it fails with ErrBusy if the queue
+// is full, and gives up waiting when ctx is done. jobs whose caller gave up
+// before a worker picked them up are skipped.
+func (p *Pool) run(ctx context.Context, fn func() result) result {
+	done := make(chan result, 1)
+	var cancelled atomic.Bool
+	queuedAt := time.Now()
+	job := func() {
+		p.queued.Add(-1)
+		p.waitTotal.Add(int64(time.Since(queuedAt)))
+		if cancelled.Load() {
+			done <- result{err: ctx.Err()}
+			return
+		}
+		p.active.Add(1)
+		r := fn()
+		p.active.Add(-1)
+		p.completed.Add(1)
+		done <- r
+	}
+	if err := p.submit(job); err != nil {
+		return result{err: err}
+	}
+	select {
+	case r := <-done:
+		return r
+	case <-ctx.Done():
+		cancelled.Store(true)
+		return result{err: ctx.Err()}
+	}
+}
+
+// submit queues a job without waiting for room in the queue.
+func (p *Pool) submit(job func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.queued.Add(1)
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		p.queued.Add(-1)
+		p.rejected.Add(1)
+		return ErrBusy
+	}
+}
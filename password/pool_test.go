@@ -0,0 +1,109 @@
+package password
+
+import (
+	"context"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+// blockingAlgorithm hashes only when released, so tests can fill the pool.
+type blockingAlgorithm struct {
+	release chan struct{}
+}
+
+func (b *blockingAlgorithm) Identify(hash string) bool { return true }
+func (b *blockingAlgorithm) Hash(password string) (string, error) {
+	<-b.release
+	return "hash:" + password, nil
+}
+func (b *blockingAlgorithm) Verify(password string, hash string) (bool, error) {
+	<-b.release
+	return hash == "hash:"+password, nil
+}
+func (b *blockingAlgorithm) Outdated(hash string) bool { return false }
+
+func TestPool(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	a := &blockingAlgorithm{release: make(chan struct{})}
+	p := NewPool(&Hasher{preferred: a, algorithms: []Algorithm{a}}, &PoolConfig{Workers: 1, QueueSize: 1})
+	defer p.Close()
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := p.Hash(ctx, "password")
+			results <- err
+		}()
+	}
+	// one job is running and one is queued
+	Eventually(func() PoolStats { return p.Stats() }).Should(And(
+		HaveField("Active", int64(1)),
+		HaveField("Queued", int64(1)),
+	))
+	_, err := p.Verify(ctx, "password", "hash:password")
+	Expect(err).To(Equal(ErrBusy))
+	Expect(p.Stats().Rejected).To(Equal(int64(1)))
+
+	close(a.release)
+	Expect(<-results).To(BeNil())
+	Expect(<-results).To(BeNil())
+	match, err := p.Verify(ctx, "password", "hash:password")
+	Expect(err).To(BeNil())
+	Expect(match).To(BeTrue())
+	Expect(p.Stats()).To(And(
+		HaveField("Active", int64(0)),
+		HaveField("Queued", int64(0)),
+		HaveField("Completed", int64(3)),
+	))
+}
+
+func TestPoolContext(t *testing.T) {
+	RegisterTestingT(t)
+	a := &blockingAlgorithm{release: make(chan struct{})}
+	p := NewPool(&Hasher{preferred: a, algorithms: []Algorithm{a}}, &PoolConfig{Workers: 1, QueueSize: 1})
+	defer p.Close()
+
+	go func() { _, _ = p.Hash(context.Background(), "password") }()
+	Eventually(func() int64 { return p.Stats().Active }).Should(Equal(int64(1)))
+
+	// callers stop waiting when their request is gone, and the queued job is skipped
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := p.Hash(ctx, "password")
+	Expect(err).To(Equal(context.DeadlineExceeded))
+	close(a.release)
+	Eventually(func() int64 { return p.Stats().Queued }).Should(BeZero())
+	Expect(p.Stats().Completed).To(Equal(int64(1)))
+}
+
+func TestPoolCancelRunning(t *testing.T) {
+	RegisterTestingT(t)
+	a := &blockingAlgorithm{release: make(chan struct{})}
+	p := NewPool(&Hasher{preferred: a, algorithms: []Algorithm{a}}, &PoolConfig{Workers: 1, QueueSize: 1})
+
+	// the worker finishes a job after its caller gave up, run with -race
+	ctx, cancel := context.WithCancel(context.Background())
+	type hashResult struct {
+		hash string
+		err  error
+	}
+	results := make(chan hashResult, 1)
+	go func() {
+		hash, err := p.Hash(ctx, "password")
+		results <- hashResult{hash, err}
+	}()
+	Eventually(func() int64 { return p.Stats().Active }).Should(Equal(int64(1)))
+	cancel()
+	Expect(<-results).To(Equal(hashResult{err: context.Canceled}))
+	close(a.release)
+	Eventually(func() int64 { return p.Stats().Completed }).Should(Equal(int64(1)))
+
+	p.Close()
+	p.Close()
+	_, err := p.Hash(context.Background(), "password")
+	Expect(err).To(Equal(ErrClosed))
+	_, err = p.Verify(context.Background(), "password", "hash:password")
+	Expect(err).To(Equal(ErrClosed))
+}
@@ -0,0 +1,188 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Strength estimates how hard password is to guess on the zxcvbn scale from
+// 0 (trivial) to 4 (very strong). the estimate is based on the search space
+// left after discounting common passwords, repeats, sequences, keyboard walks
+// and the user's own inputs such as the email address.
+func Strength(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+	if lower == "" || isCommon(lower) {
+		return 0
+	}
+	for _, input := range userInputs {
+		if input != "" && lower == strings.ToLower(input) {
+			return 0
+		}
+	}
+	charBits := math.Log2(float64(poolSize(password)))
+	bits := patternBits(lower, charBits, dictionary(userInputs))
+	guesses := bits * math.Log10(2)
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func isCommon(lower string) bool {
+	if _, ok := commonPasswords[lower]; ok {
+		return true
+	}
+	// common passwords with digits or symbols appended, e.g. password123!
+	trimmed := strings.TrimRightFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	_, ok := commonPasswords[trimmed]
+	return ok && trimmed != ""
+}
+
+func poolSize(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r > unicode.MaxASCII:
+			other = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	size := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			size += class.size
+		}
+	}
+	return size
+}
+
+// dictionary returns the words a guesser would try first: common passwords
+// and the parts of the user's inputs.
+func dictionary(userInputs []string) []string {
+	words := make([]string, 0, len(userInputs))
+	for _, input := range userInputs {
+		for _, part := range strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len(part) >= minWordLength {
+				words = append(words, part)
+			}
+		}
+	}
+	return words
+}
+
+const minWordLength = 4
+
+// patternBits is the entropy of s, where the longest dictionary word in it
+// counts as a single guess out of the dictionary.
+func patternBits(s string, charBits float64, userWords []string) float64 {
+	word := ""
+	for _, w := range userWords {
+		if len(w) > len(word) && strings.Contains(s, w) {
+			word = w
+		}
+	}
+	for w := range commonPasswords {
+		if len(w) >= minWordLength && len(w) > len(word) && strings.Contains(s, w) {
+			word = w
+		}
+	}
+	if word == "" {
+		return sequenceBits(s, charBits)
+	}
+	before, after, _ := strings.Cut(s, word)
+	wordBits := math.Log2(float64(len(commonPasswords) + len(userWords)))
+	return patternBits(before, charBits, userWords) + wordBits + patternBits(after, charBits, userWords)
+}
+
+// sequenceBits charges full entropy for every character except those that
+// repeat the previous one, continue an alphabetic or numeric sequence, or
+// are next to the previous one on the keyboard.
+func sequenceBits(s string, charBits float64) float64 {
+	runes := []rune(s)
+	bits := 0.0
+	var prevDelta rune
+	for i, r := range runes {
+		if i == 0 {
+			bits += charBits
+			continue
+		}
+		prev := runes[i-1]
+		delta := r - prev
+		switch {
+		case delta == 0:
+			bits += 1
+		case (delta == 1 || delta == -1) && (i == 1 || delta == prevDelta):
+			bits += 1
+		case keyboardAdjacent(prev, r):
+			bits += 2
+		default:
+			bits += charBits
+		}
+		prevDelta = delta
+	}
+	return bits
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+func keyboardAdjacent(a rune, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+var commonPasswords = make(map[string]struct{})
+
+func init() {
+	for _, p := range strings.Fields(commonPasswordList) {
+		commonPasswords[p] = struct{}{}
+	}
+}
+
+// commonPasswordList holds the most used passwords from public breach corpora.
+const commonPasswordList = `
+123456 password 12345678 qwerty 123456789 12345 1234 111111 1234567 dragon
+123123 baseball abc123 football monkey letmein 696969 shadow master 666666
+qwertyuiop 123321 mustang 1234567890 michael 654321 superman 1qaz2wsx 7777777
+121212 000000 qazwsx 123qwe killer trustno1 jordan jennifer zxcvbnm asdfgh
+hunter buster soccer harley batman andrew tigger sunshine iloveyou 2000
+charlie robert thomas hockey ranger daniel starwars klaster 112233 george
+computer michelle jessica pepper 1111 zxcvbn 555555 11111111 131313 freedom
+777777 pass maggie 159753 aaaaaa ginger princess joshua cheese amanda summer
+love ashley nicole chelsea biteme matthew access yankees 987654321 dallas
+austin thunder taylor matrix admin welcome login passw0rd p@ssw0rd secret
+changeme letmein1 qwerty123 monkey1 dragon1 football1 whatever hello
+`
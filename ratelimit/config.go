@@ -0,0 +1,21 @@
+package ratelimit
+
+// Config maps full route paths (e.g. "/auth/login") to their limits.
+type Config struct {
+	Routes map[string]Rule `json:"routes"`
+}
+
+// Rule allows Limit requests per Period seconds for every key, with bursts of
+// up to Burst requests (defaults to Limit). Keys selects what requests are
+// grouped by: "ip", "email" or both, each key being limited separately.
+type Rule struct {
+	Limit  int      `json:"limit"`
+	Period int      `json:"period"`
+	Burst  int      `json:"burst"`
+	Keys   []string `json:"keys"`
+}
+
+const (
+	KeyIP    = "ip"
+	KeyEmail = "email"
+)
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"auth/common"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type Limiter struct {
+	rules map[string]Rule
+	store Store
+}
+
+type emailField struct {
+	Email string `form:"email" json:"email"`
+}
+
+func New(config *Config, store Store) *Limiter {
+	l := &Limiter{
+		rules: make(map[string]Rule),
+		store: store,
+	}
+	if config != nil {
+		for route, rule := range config.Routes {
+			if rule.Burst <= 0 {
+				rule.Burst = rule.Limit
+			}
+			l.rules[route] = rule
+		}
+	}
+	return l
+}
+
+func (l *Limiter) MiddlewareFunc() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		l.Limit(ctx)
+	}
+}
+
+// Limit takes a token for every key of the matched route's rule, requests
+// to routes without a rule are not limited.
+func (l *Limiter) Limit(ctx *gin.Context) {
+	route := ctx.FullPath()
+	rule, ok := l.rules[route]
+	if !ok || rule.Limit <= 0 || rule.Period <= 0 {
+		ctx.Next()
+		return
+	}
+	rate := float64(rule.Limit) / float64(rule.Period)
+	for _, key := range rule.Keys {
+		value := keyValue(ctx, key)
+		if value == "" {
+			continue
+		}
+		allowed, wait, err := l.store.Take(ctx.Request.Context(), route+"|"+key+"|"+value, rate, rule.Burst)
+		if err != nil {
+			// a broken store should not take the service down with it
+			zap.L().Error("rate limit store failed", zap.String("route", route), zap.Error(err))
+			continue
+		}
+		if !allowed {
+			ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			common.ErrorResponse(ctx, http.StatusTooManyRequests, "too many requests", nil)
+			ctx.Abort()
+			return
+		}
+	}
+	ctx.Next()
+}
+
+func keyValue(ctx *gin.Context, key string) string {
+	switch key {
+	case KeyIP:
+		return ctx.ClientIP()
+	case KeyEmail:
+		var e emailField
+		if err := ctx.ShouldBindBodyWith(&e, binding.JSON); err != nil {
+			return ""
+		}
+		return strings.ToLower(strings.TrimSpace(e.Email))
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	now := time.Now()
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+
+	// burst of 2, refills one token every 2 seconds
+	for i := 0; i < 2; i++ {
+		allowed, _, err := s.Take(ctx, "key1", 0.5, 2)
+		Expect(err).To(BeNil())
+		Expect(allowed).To(BeTrue())
+	}
+	allowed, wait, err := s.Take(ctx, "key1", 0.5, 2)
+	Expect(err).To(BeNil())
+	Expect(allowed).To(BeFalse())
+	Expect(wait).To(Equal(2 * time.Second))
+
+	// other keys have their own bucket
+	allowed, _, err = s.Take(ctx, "key2", 0.5, 2)
+	Expect(err).To(BeNil())
+	Expect(allowed).To(BeTrue())
+
+	now = now.Add(time.Second)
+	allowed, wait, err = s.Take(ctx, "key1", 0.5, 2)
+	Expect(err).To(BeNil())
+	Expect(allowed).To(BeFalse())
+	Expect(wait).To(Equal(time.Second))
+
+	now = now.Add(time.Second)
+	allowed, _, err = s.Take(ctx, "key1", 0.5, 2)
+	Expect(err).To(BeNil())
+	Expect(allowed).To(BeTrue())
+
+	// full buckets are dropped
+	now = now.Add(time.Hour)
+	_, _, err = s.Take(ctx, "key3", 0.5, 2)
+	Expect(err).To(BeNil())
+	Expect(s.buckets).To(HaveLen(1))
+}
+
+func TestMiddleware(t *testing.T) {
+	RegisterTestingT(t)
+	gin.SetMode(gin.TestMode)
+	l := New(&Config{
+		Routes: map[string]Rule{
+			"/login": {Limit: 2, Period: 60, Keys: []string{KeyIP, KeyEmail}},
+			"/check": {Limit: 1, Period: 60, Keys: []string{KeyEmail}},
+		},
+	}, NewMemoryStore())
+	router := gin.New()
+	router.Use(l.MiddlewareFunc())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.POST("/login", ok)
+	router.POST("/check", ok)
+	router.POST("/free", ok)
+	request := func(path string, ip string, email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"email": "`+email+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	Expect(request("/login", "1.1.1.1", "user1").Code).To(Equal(http.StatusOK))
+	Expect(request("/login", "1.1.1.1", "user2").Code).To(Equal(http.StatusOK))
+	w := request("/login", "1.1.1.1", "user3")
+	Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+	Expect(w.Header().Get("Retry-After")).To(Equal("30"))
+
+	// email is limited across ips, and compared case-insensitively
+	Expect(request("/login", "2.2.2.2", "User1").Code).To(Equal(http.StatusOK))
+	Expect(request("/login", "3.3.3.3", "user1").Code).To(Equal(http.StatusTooManyRequests))
+
+	// routes are limited separately
+	Expect(request("/check", "1.1.1.1", "user1").Code).To(Equal(http.StatusOK))
+	Expect(request("/check", "1.1.1.1", "user1").Code).To(Equal(http.StatusTooManyRequests))
+	Expect(request("/check", "1.1.1.1", "").Code).To(Equal(http.StatusOK))
+
+	for i := 0; i < 5; i++ {
+		Expect(request("/free", "1.1.1.1", "user1").Code).To(Equal(http.StatusOK))
+	}
+}
@@ -23,9 +23,21 @@ CREATE TABLE IF NOT EXISTS `auth`.`User` (
     `Id` CHAR(36) NOT NULL,
     `Email` VARCHAR(100) NOT NULL,
     `Password` VARCHAR(600) NOT NULL,
-    `Status` ENUM('active', 'disabled', 'pending') NOT NULL,
+    `Status` ENUM('active', 'disabled', 'pending', 'deleting') NOT NULL,
+    `TokenVersion` INT NOT NULL DEFAULT 0,
+    `DeleteAt` DATETIME NULL,
+    `DisplayName` VARCHAR(100) NOT NULL DEFAULT '',
+    `Locale` VARCHAR(35) NOT NULL DEFAULT '',
+    `Timezone` VARCHAR(64) NOT NULL DEFAULT '',
+    `AvatarURL` VARCHAR(2048) NOT NULL DEFAULT '',
+    `CreatedAt` DATETIME NOT NULL,
+    `UpdatedAt` DATETIME NOT NULL,
+    `LastLogin` DATETIME NULL,
+    `AppMetadata` JSON NULL,
+    `UserMetadata` JSON NULL,
     PRIMARY KEY (`Id`),
-    UNIQUE INDEX `Email_UNIQUE` (`Email` ASC) VISIBLE)
+    UNIQUE INDEX `Email_UNIQUE` (`Email` ASC) VISIBLE,
+    INDEX `Status_DeleteAt` (`Status` ASC, `DeleteAt` ASC) VISIBLE)
     ENGINE = InnoDB;
 
 
@@ -36,7 +48,8 @@ DROP TABLE IF EXISTS `auth`.`Verification` ;
 
 CREATE TABLE IF NOT EXISTS `auth`.`Verification` (
     `Code` VARCHAR(100) NOT NULL,
-    `Type` ENUM('signup', 'recover') NOT NULL,
+    `Type` ENUM('signup', 'recover', 'change_email', 'cancel_email', 'report_login') NOT NULL,
+    `Value` VARCHAR(2048) NULL,
     `User_Id` CHAR(36) NOT NULL,
     UNIQUE INDEX `Code_UNIQUE` (`Code` ASC) VISIBLE,
     PRIMARY KEY (`User_Id`, `Type`),
@@ -48,6 +61,152 @@ CREATE TABLE IF NOT EXISTS `auth`.`Verification` (
     ENGINE = InnoDB;
 
 
+-- -----------------------------------------------------
+-- Table `auth`.`Session`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `auth`.`Session` ;
+
+CREATE TABLE IF NOT EXISTS `auth`.`Session` (
+    `Id` CHAR(36) NOT NULL,
+    `User_Id` CHAR(36) NOT NULL,
+    `UserAgent` VARCHAR(512) NOT NULL,
+    `IP` VARCHAR(45) NOT NULL,
+    `CreatedAt` DATETIME NOT NULL,
+    `LastSeen` DATETIME NOT NULL,
+    `Generation` INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (`Id`),
+    INDEX `fk_Session_User_idx` (`User_Id` ASC) VISIBLE,
+    CONSTRAINT `fk_Session_User`
+    FOREIGN KEY (`User_Id`)
+    REFERENCES `auth`.`User` (`Id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+    ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `auth`.`KnownDevice`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `auth`.`KnownDevice` ;
+
+CREATE TABLE IF NOT EXISTS `auth`.`KnownDevice` (
+    `User_Id` CHAR(36) NOT NULL,
+    `Fingerprint` CHAR(64) NOT NULL,
+    `Network` VARCHAR(45) NOT NULL,
+    `FirstSeen` DATETIME NOT NULL,
+    `LastSeen` DATETIME NOT NULL,
+    PRIMARY KEY (`User_Id`, `Fingerprint`, `Network`),
+    CONSTRAINT `fk_KnownDevice_User`
+    FOREIGN KEY (`User_Id`)
+    REFERENCES `auth`.`User` (`Id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+    ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `auth`.`StatusChange`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `auth`.`StatusChange` ;
+
+CREATE TABLE IF NOT EXISTS `auth`.`StatusChange` (
+    `Id` BIGINT NOT NULL AUTO_INCREMENT,
+    `User_Id` CHAR(36) NOT NULL,
+    `Status` ENUM('active', 'disabled', 'pending', 'deleting') NOT NULL,
+    `At` DATETIME NOT NULL,
+    PRIMARY KEY (`Id`),
+    INDEX `fk_StatusChange_User_idx` (`User_Id` ASC) VISIBLE,
+    CONSTRAINT `fk_StatusChange_User`
+    FOREIGN KEY (`User_Id`)
+    REFERENCES `auth`.`User` (`Id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+    ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `auth`.`AuditEvent`
+-- events outlive their users, so there is no foreign key.
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `auth`.`AuditEvent` ;
+
+CREATE TABLE IF NOT EXISTS `auth`.`AuditEvent` (
+    `Id` BIGINT NOT NULL AUTO_INCREMENT,
+    `Type` VARCHAR(50) NOT NULL,
+    `Actor` VARCHAR(100) NOT NULL,
+    `Target` VARCHAR(100) NOT NULL,
+    `IP` VARCHAR(45) NOT NULL,
+    `UserAgent` VARCHAR(512) NOT NULL,
+    `RequestId` VARCHAR(64) NOT NULL,
+    `Detail` VARCHAR(255) NOT NULL,
+    `At` DATETIME NOT NULL,
+    PRIMARY KEY (`Id`),
+    INDEX `Type_idx` (`Type` ASC, `At` ASC) VISIBLE,
+    INDEX `Actor_idx` (`Actor` ASC) VISIBLE,
+    INDEX `Target_idx` (`Target` ASC) VISIBLE)
+    ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `auth`.`WebhookDelivery`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `auth`.`WebhookDelivery` ;
+
+CREATE TABLE IF NOT EXISTS `auth`.`WebhookDelivery` (
+    `Id` BIGINT NOT NULL AUTO_INCREMENT,
+    `EventId` CHAR(36) NOT NULL,
+    `Endpoint` VARCHAR(100) NOT NULL,
+    `Event` VARCHAR(50) NOT NULL,
+    `Payload` TEXT NOT NULL,
+    `Status` ENUM('pending', 'delivered', 'failed') NOT NULL,
+    `Attempts` INT NOT NULL DEFAULT 0,
+    `NextAttempt` DATETIME NOT NULL,
+    `LastStatus` INT NOT NULL DEFAULT 0,
+    `LastError` VARCHAR(255) NOT NULL DEFAULT '',
+    `CreatedAt` DATETIME NOT NULL,
+    `UpdatedAt` DATETIME NOT NULL,
+    PRIMARY KEY (`Id`),
+    UNIQUE INDEX `EventId_Endpoint_UNIQUE` (`EventId` ASC, `Endpoint` ASC) VISIBLE,
+    INDEX `Status_NextAttempt_idx` (`Status` ASC, `NextAttempt` ASC) VISIBLE,
+    INDEX `Endpoint_idx` (`Endpoint` ASC) VISIBLE)
+    ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `auth`.`Outbox`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `auth`.`Outbox` ;
+
+CREATE TABLE IF NOT EXISTS `auth`.`Outbox` (
+    `Id` BIGINT NOT NULL AUTO_INCREMENT,
+    `Kind` VARCHAR(50) NOT NULL,
+    `Payload` TEXT NOT NULL,
+    `Status` ENUM('pending', 'sent', 'failed') NOT NULL,
+    `Attempts` INT NOT NULL DEFAULT 0,
+    `NextAttempt` DATETIME NOT NULL,
+    `LastError` VARCHAR(255) NOT NULL DEFAULT '',
+    `CreatedAt` DATETIME NOT NULL,
+    `UpdatedAt` DATETIME NOT NULL,
+    PRIMARY KEY (`Id`),
+    INDEX `Status_NextAttempt_idx` (`Status` ASC, `NextAttempt` ASC) VISIBLE)
+    ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `auth`.`LoginFailure`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `auth`.`LoginFailure` ;
+
+CREATE TABLE IF NOT EXISTS `auth`.`LoginFailure` (
+    `Kind` ENUM('user', 'ip') NOT NULL,
+    `Name` VARCHAR(100) NOT NULL,
+    `Count` INT NOT NULL,
+    `LastFailure` DATETIME NOT NULL,
+    `LockedUntil` DATETIME NULL,
+    PRIMARY KEY (`Kind`, `Name`))
+    ENGINE = InnoDB;
+
+
 SET SQL_MODE=@OLD_SQL_MODE;
 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS;
 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS;
@@ -1,15 +1,40 @@
 package server
 
-import "auth/recaptcha"
+import (
+	"auth/admin"
+	"auth/audit"
+	"auth/deletion"
+	auth "auth/handler"
+	"auth/lockout"
+	"auth/outbox"
+	"auth/password"
+	"auth/ratelimit"
+	"auth/recaptcha"
+	"auth/webhook"
+)
 
 type Config struct {
-	BindAddress   string            `env:"BIND_ADDRESS" json:"bind_address"`
-	ReadTimeout   int               `json:"read_timeout"`
-	WriteTimeout  int               `json:"write_timeout"`
-	MaxBodyBytes  int64             `json:"max_body_size"`
-	WebServer     string            `json:"web_server"`
-	HtmlTemplates string            `json:"html_templates"`
-	Recaptcha     *recaptcha.Config `json:"recaptcha"`
+	BindAddress       string                   `env:"BIND_ADDRESS" json:"bind_address"`
+	ReadTimeout       int                      `json:"read_timeout"`
+	WriteTimeout      int                      `json:"write_timeout"`
+	MaxBodyBytes      int64                    `json:"max_body_size"`
+	WebServer         string                   `json:"web_server"`
+	HtmlTemplates     string                   `json:"html_templates"`
+	Recaptcha         *recaptcha.Config        `json:"recaptcha"`
+	Lockout           *lockout.Config          `json:"lockout"`
+	Admin             *admin.Config            `json:"admin"`
+	RateLimit         *ratelimit.Config        `json:"rate_limit"`
+	PasswordPolicy    *password.PolicyConfig   `json:"password_policy"`
+	BreachedPasswords *password.BreachConfig   `json:"breached_passwords"`
+	PasswordHasher    *password.HasherConfig   `json:"password_hasher"`
+	HashingPool       *password.PoolConfig     `json:"hashing_pool"`
+	AccountDeletion   *deletion.Config         `json:"account_deletion"`
+	TokenClaims       []string                 `json:"token_claims"`
+	PrivacyMode       bool                     `json:"privacy_mode"`
+	Verification      *auth.VerificationConfig `json:"verification"`
+	Audit             *audit.Config            `json:"audit"`
+	Webhooks          *webhook.Config          `json:"webhooks"`
+	Outbox            *outbox.Config           `json:"outbox"`
 }
 
 func DefaultConfig() Config {
@@ -25,5 +50,51 @@ func DefaultConfig() Config {
 			SecretKey: "RECAPTCHA_SECRET_KEY",
 			Server:    "https://www.google.com/recaptcha/api/siteverify",
 		},
+		Lockout: &lockout.Config{
+			UserThreshold:   5,
+			IPThreshold:     50,
+			BaseDelay:       1,
+			MaxDelay:        60,
+			LockoutDuration: 900,
+			Window:          3600,
+		},
+		Admin: &admin.Config{},
+		PasswordPolicy: &password.PolicyConfig{
+			MinLength:     8,
+			MaxLength:     72,
+			DisallowEmail: true,
+			MinStrength:   2,
+		},
+		PasswordHasher: &password.HasherConfig{
+			Algorithm:  password.AlgorithmArgon2id,
+			BcryptCost: 12,
+			Argon2: password.Argon2Config{
+				Memory:      19456,
+				Iterations:  2,
+				Parallelism: 1,
+				SaltLength:  16,
+				KeyLength:   32,
+			},
+		},
+		HashingPool: &password.PoolConfig{},
+		AccountDeletion: &deletion.Config{
+			GracePeriod: 30 * 24 * 3600,
+			Interval:    3600,
+			BatchSize:   100,
+		},
+		RateLimit: &ratelimit.Config{
+			Routes: map[string]ratelimit.Rule{
+				"/auth/signup":          {Limit: 5, Period: 3600, Keys: []string{ratelimit.KeyIP}},
+				"/auth/verify":          {Limit: 10, Period: 60, Keys: []string{ratelimit.KeyIP}},
+				"/auth/verify/resend":   {Limit: 3, Period: 3600, Keys: []string{ratelimit.KeyIP, ratelimit.KeyEmail}},
+				"/auth/recover":         {Limit: 5, Period: 3600, Keys: []string{ratelimit.KeyIP, ratelimit.KeyEmail}},
+				"/auth/reset":           {Limit: 10, Period: 3600, Keys: []string{ratelimit.KeyIP}},
+				"/auth/login":           {Limit: 20, Period: 60, Keys: []string{ratelimit.KeyIP, ratelimit.KeyEmail}},
+				"/auth/email":           {Limit: 5, Period: 3600, Keys: []string{ratelimit.KeyIP}},
+				"/auth/email/confirm":   {Limit: 10, Period: 60, Keys: []string{ratelimit.KeyIP}},
+				"/auth/email/cancel":    {Limit: 10, Period: 60, Keys: []string{ratelimit.KeyIP}},
+				"/auth/sessions/report": {Limit: 10, Period: 60, Keys: []string{ratelimit.KeyIP}},
+			},
+		},
 	}
 }
@@ -3,7 +3,9 @@ package server
 import (
 	"auth/database"
 	"auth/mailer"
+	"auth/password"
 	"auth/recaptcha"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,6 +35,7 @@ var (
 	}
 	connectionStr   = "admin:admin@tcp(127.0.0.1:3306)/auth"
 	db              *database.Database
+	hasher          *password.Hasher
 	client          *http.Client
 	recaptchaServer = recaptcha.NewMockServer("127.0.0.1:9798")
 )
@@ -41,11 +44,11 @@ func TestSignup(t *testing.T) {
 	initialize(t)
 
 	// add new user
-	err := signup("user1@example.com", "password")
+	err := signup("user1@example.com", "Tr0ub4dor&3")
 	Expect(err).To(BeNil())
 
 	// check new user status is pending
-	user, err := db.GetUser("user1@example.com")
+	user, err := db.GetUser(context.Background(), "user1@example.com")
 	Expect(err).To(BeNil())
 	Expect(user.Email).To(Equal("user1@example.com"))
 	Expect(user.Status).To(Equal(database.UserStatusPending))
@@ -63,7 +66,7 @@ func TestVerify(t *testing.T) {
 	Expect(resp.StatusCode).To(Equal(http.StatusOK))
 	_, err = io.ReadAll(resp.Body)
 	// check user status is active
-	user, err := db.GetUser("user2@example.com")
+	user, err := db.GetUser(context.Background(), "user2@example.com")
 	Expect(err).To(BeNil())
 	Expect(user.Email).To(Equal("user2@example.com"))
 	Expect(user.Status).To(Equal(database.UserStatusActive))
@@ -86,7 +89,7 @@ func TestRecover(t *testing.T) {
 	Expect(err).To(BeNil())
 
 	// should have a verification of type recover
-	_, err = db.GetVerification(id, database.VerificationTypeRecover)
+	_, err = db.GetVerification(context.Background(), id, database.VerificationTypeRecover)
 	Expect(err).To(BeNil())
 
 	// duplicate request
@@ -98,7 +101,7 @@ func TestRecover(t *testing.T) {
 	Expect(err).To(BeNil())
 
 	// should overwrite existing code
-	_, err = db.GetVerification(id, database.VerificationTypeRecover)
+	_, err = db.GetVerification(context.Background(), id, database.VerificationTypeRecover)
 	Expect(err).To(BeNil())
 }
 
@@ -116,11 +119,11 @@ func TestReset(t *testing.T) {
 	err = resp.Body.Close()
 	Expect(err).To(BeNil())
 
-	code, err := db.GetVerification(id, database.VerificationTypeRecover)
+	code, err := db.GetVerification(context.Background(), id, database.VerificationTypeRecover)
 	Expect(err).To(BeNil())
 
 	path = "/auth/reset"
-	body = fmt.Sprintf(`{"password": "password2", "code": "%s", "recaptcha_token": "123456"}`, code)
+	body = fmt.Sprintf(`{"password": "correct horse battery", "code": "%s", "recaptcha_token": "123456"}`, code)
 	resp = execRequest(http.MethodPatch, path, body, "")
 	Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
 	_, err = io.ReadAll(resp.Body)
@@ -128,7 +131,7 @@ func TestReset(t *testing.T) {
 	err = resp.Body.Close()
 	Expect(err).To(BeNil())
 
-	_, err = login("user1@email.com", "password2")
+	_, err = login("user1@email.com", "correct horse battery")
 	Expect(err).To(BeNil())
 }
 
@@ -156,6 +159,18 @@ func TestCheck(t *testing.T) {
 	// Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
 }
 
+func TestHealth(t *testing.T) {
+	initialize(t)
+
+	resp := execRequest(http.MethodGet, "/health/live", "", "")
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	Expect(resp.Body.Close()).To(BeNil())
+
+	resp = execRequest(http.MethodGet, "/health/ready", "", "")
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	Expect(resp.Body.Close()).To(BeNil())
+}
+
 func TestMain(m *testing.M) {
 	t := http.DefaultTransport.(*http.Transport).Clone()
 	t.DisableKeepAlives = true
@@ -178,7 +193,11 @@ func TestMain(m *testing.M) {
 	}
 	go recaptchaServer.Start()
 	var err error
-	db, err = database.Connect(&database.Config{connectionStr})
+	hasher, err = password.NewHasher(serverConfig.PasswordHasher)
+	if err != nil {
+		panic(err)
+	}
+	db, err = database.Connect(&database.Config{ConnectionString: connectionStr})
 	if err != nil {
 		panic(err)
 	}
@@ -192,6 +211,27 @@ func TestMain(m *testing.M) {
 			SendPasswordResetFunc: func(toName string, toEmail string, code string) error {
 				return nil
 			},
+			SendAccountLockedFunc: func(toName string, toEmail string, until time.Time) error {
+				return nil
+			},
+			SendPasswordChangedFunc: func(toName string, toEmail string) error {
+				return nil
+			},
+			SendEmailChangeVerificationFunc: func(toName string, toEmail string, code string) error {
+				return nil
+			},
+			SendEmailChangeNoticeFunc: func(toName string, toEmail string, newEmail string, code string) error {
+				return nil
+			},
+			SendAccountDeletedFunc: func(toName string, toEmail string) error {
+				return nil
+			},
+			SendNewLoginAlertFunc: func(toName string, toEmail string, userAgent string, ip string, at time.Time, code string) error {
+				return nil
+			},
+			SendSignupAttemptFunc: func(toName string, toEmail string) error {
+				return nil
+			},
 		},
 		zap.L(),
 	)
@@ -201,7 +241,7 @@ func TestMain(m *testing.M) {
 			panic(err)
 		}
 	}()
-	err = db.Clear(true)
+	err = db.Clear(context.Background(), true)
 	if err != nil {
 		panic(err)
 	}
@@ -265,14 +305,18 @@ func logout(token string) error {
 
 func initialize(t *testing.T) {
 	RegisterTestingT(t)
-	err := db.Clear(true)
+	err := db.Clear(context.Background(), true)
 	Expect(err).To(BeNil())
 }
 
-func addUser(username string, password string, status database.UserStatus) (database.ObjectId, string, error) {
-	id, code, err := db.AddUser(database.NewUser{
+func addUser(username string, pw string, status database.UserStatus) (database.ObjectId, string, error) {
+	hash, err := hasher.Hash(pw)
+	if err != nil {
+		return database.EmptyObjectId, "", err
+	}
+	id, code, err := db.AddUser(context.Background(), database.NewUser{
 		Email:    username,
-		Password: password,
+		Password: hash,
 		Status:   status,
 	})
 	return id, code, err
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"auth/common"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func live(c *gin.Context) {
+	common.SuccessResponse(c, http.StatusOK, "alive", nil)
+}
+
+func ready(db Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := db.Health(c.Request.Context()); err != nil {
+			common.ErrorResponse(c, http.StatusServiceUnavailable, "database is not ready", err)
+			return
+		}
+		common.SuccessResponse(c, http.StatusOK, "ready", nil)
+	}
+}
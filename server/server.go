@@ -1,12 +1,20 @@
 package server
 
 import (
+	"auth/admin"
+	"auth/audit"
 	"auth/common"
-	"auth/database"
+	"auth/deletion"
+	"auth/export"
 	auth "auth/handler"
+	"auth/lockout"
 	"auth/logger"
 	"auth/mailer"
+	"auth/outbox"
+	"auth/password"
+	"auth/ratelimit"
 	"auth/recaptcha"
+	"auth/webhook"
 	"context"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -14,13 +22,33 @@ import (
 	"time"
 )
 
+// Storage is what the server needs from a storage backend: everything the
+// auth handlers use plus a health check for the readiness endpoint.
+type Storage interface {
+	auth.Storage
+	lockout.Storage
+	deletion.Storage
+	export.Storage
+	audit.Storage
+	webhook.Storage
+	outbox.Storage
+	Health(ctx context.Context) error
+}
+
 type Server struct {
-	config     *Config
-	router     *gin.Engine
-	httpServer *http.Server
+	config      *Config
+	router      *gin.Engine
+	httpServer  *http.Server
+	hashingPool *password.Pool
+	deletion    *deletion.Scheduler
+	audit       *audit.Logger
+	webhooks    *webhook.Dispatcher
+	outbox      *outbox.Dispatcher
+	jobs        context.Context
+	stopJobs    context.CancelFunc
 }
 
-func NewServer(config *Config, db *database.Database, mailer mailer.Mailer, accessLogger *zap.Logger) *Server {
+func NewServer(config *Config, db Storage, mailer mailer.Mailer, accessLogger *zap.Logger) *Server {
 	router := gin.New()
 	router.LoadHTMLGlob(config.HtmlTemplates)
 	handleRecovery := func(c *gin.Context, err interface{}) {
@@ -39,7 +67,8 @@ func NewServer(config *Config, db *database.Database, mailer mailer.Mailer, acce
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, ResponseType, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, ResponseType, accept, origin, Cache-Control, X-Requested-With, X-Request-Id, If-Match, If-None-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, Retry-After, X-Request-Id")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE, PATCH")
 
 		if c.Request.Method == "OPTIONS" {
@@ -57,22 +86,82 @@ func NewServer(config *Config, db *database.Database, mailer mailer.Mailer, acce
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	authGroup := router.Group("/auth")
+	healthGroup := router.Group("/health")
+	healthGroup.GET("/live", live)
+	healthGroup.GET("/ready", ready(db))
+
+	limiter := ratelimit.New(config.RateLimit, ratelimit.NewMemoryStore())
+	authGroup := router.Group("/auth", limiter.MiddlewareFunc())
 	recaptchaHandler := recaptcha.New(config.Recaptcha)
-	authHandler := auth.New(db, mailer, recaptchaHandler, config.WebServer)
+	lockoutTracker := lockout.New(config.Lockout, db)
+	breachChecker, err := password.NewBreachChecker(config.BreachedPasswords)
+	if err != nil {
+		zap.L().Fatal("cannot load breached passwords", zap.Error(err))
+	}
+	passwordPolicy := password.NewPolicy(config.PasswordPolicy, breachChecker)
+	hasher, err := password.NewHasher(config.PasswordHasher)
+	if err != nil {
+		zap.L().Fatal("invalid password hasher config", zap.Error(err))
+	}
+	hashingPool := password.NewPool(hasher, config.HashingPool)
+	webhooks := webhook.New(config.Webhooks, db)
+	auditLogger, err := audit.New(config.Audit, db)
+	if err != nil {
+		zap.L().Fatal("cannot open audit log", zap.Error(err))
+	}
+	outboxDispatcher := outbox.New(config.Outbox, db, mailer, webhooks)
+	deletionScheduler := deletion.New(config.AccountDeletion, db, outboxDispatcher)
+	authHandler := auth.New(auth.Dependencies{
+		DB:             db,
+		Recaptcha:      recaptchaHandler,
+		Lockout:        lockoutTracker,
+		PasswordPolicy: passwordPolicy,
+		Hasher:         hashingPool,
+		Deletion:       deletionScheduler,
+		Exporter:       export.New(db),
+		Audit:          auditLogger,
+		Webhooks:       webhooks,
+		Outbox:         outboxDispatcher,
+	}, auth.Options{
+		Verification: config.Verification,
+		PrivacyMode:  config.PrivacyMode,
+		TokenClaims:  config.TokenClaims,
+		ServerName:   config.WebServer,
+	})
 	authHandler.RegisterHandlers(authGroup)
 
+	adminGroup := router.Group("/admin", admin.New(config.Admin).MiddlewareFunc())
+	authHandler.RegisterAdminHandlers(adminGroup)
+
+	jobs, stopJobs := context.WithCancel(context.Background())
 	return &Server{
-		config:     config,
-		router:     router,
-		httpServer: s,
+		config:      config,
+		router:      router,
+		httpServer:  s,
+		hashingPool: hashingPool,
+		deletion:    deletionScheduler,
+		audit:       auditLogger,
+		webhooks:    webhooks,
+		outbox:      outboxDispatcher,
+		jobs:        jobs,
+		stopJobs:    stopJobs,
 	}
 }
 
+// ListenAndServer starts the background jobs and serves until Shutdown.
 func (s *Server) ListenAndServer() error {
+	go s.deletion.Run(s.jobs)
+	go s.webhooks.Run(s.jobs)
+	go s.outbox.Run(s.jobs)
 	return s.httpServer.ListenAndServe()
 }
 
 func (s *Server) Shutdown() error {
-	return s.httpServer.Shutdown(context.Background())
+	err := s.httpServer.Shutdown(context.Background())
+	s.stopJobs()
+	s.hashingPool.Close()
+	if auditErr := s.audit.Close(); err == nil {
+		err = auditErr
+	}
+	return err
 }
@@ -0,0 +1,58 @@
+package webhook
+
+// Config lists the registered endpoints and controls deliveries. failed
+// deliveries are retried after BaseDelay, doubling up to MaxDelay, until
+// MaxAttempts were made. durations are in seconds.
+type Config struct {
+	Endpoints   []Endpoint `json:"endpoints"`
+	Interval    int        `json:"interval"`
+	BatchSize   int        `json:"batch_size"`
+	Timeout     int        `json:"timeout"`
+	MaxAttempts int        `json:"max_attempts"`
+	BaseDelay   int        `json:"base_delay"`
+	MaxDelay    int        `json:"max_delay"`
+}
+
+// Endpoint receives the Events it subscribed to, or all events if Events is
+// empty. payloads are signed with Secret.
+type Endpoint struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:    10,
+		BatchSize:   100,
+		Timeout:     10,
+		MaxAttempts: 10,
+		BaseDelay:   30,
+		MaxDelay:    6 * 3600,
+	}
+}
+
+// withDefaults fills in the defaults of delivery settings that are not set.
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.Interval <= 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaults.BatchSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaults.MaxAttempts
+	}
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = defaults.BaseDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaults.MaxDelay
+	}
+	return c
+}
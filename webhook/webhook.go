@@ -0,0 +1,295 @@
+package webhook
+
+import (
+	"auth/database"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Storage interface {
+	AddWebhookDeliveries(ctx context.Context, deliveries []database.WebhookDelivery) error
+	GetDueWebhookDeliveries(ctx context.Context, before time.Time, limit int) ([]database.WebhookDelivery, error)
+	UpdateWebhookDelivery(ctx context.Context, d database.WebhookDelivery) error
+	GetWebhookDeliveries(ctx context.Context, f database.WebhookFilter) ([]database.WebhookDelivery, error)
+}
+
+// events sent to webhook endpoints.
+const (
+	EventUserCreated      = "user.created"
+	EventUserVerified     = "user.verified"
+	EventUserEmailChanged = "user.email_changed"
+	EventUserDeleted      = "user.deleted"
+)
+
+// headers of webhook requests. the signature is the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, see Sign.
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderId        = "X-Webhook-Id"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// maxErrorLength matches the LastError column of the WebhookDelivery table.
+const maxErrorLength = 255
+
+// maxDoublings keeps the exponential delay from overflowing.
+const maxDoublings = 20
+
+// Payload is the body of webhook requests.
+type Payload struct {
+	Id        database.ObjectId `json:"id"`
+	Type      string            `json:"type"`
+	CreatedAt time.Time         `json:"created_at"`
+	Data      interface{}       `json:"data"`
+}
+
+// User is the data of user events.
+type User struct {
+	Id    database.ObjectId `json:"id"`
+	Email string            `json:"email"`
+}
+
+// EmailChange is the data of email changed events.
+type EmailChange struct {
+	Id            database.ObjectId `json:"id"`
+	Email         string            `json:"email"`
+	PreviousEmail string            `json:"previous_email"`
+}
+
+// Delivery is what the delivery log shows about a delivery.
+type Delivery struct {
+	Id          int64                  `json:"id"`
+	EventId     database.ObjectId      `json:"event_id"`
+	Endpoint    string                 `json:"endpoint"`
+	Event       string                 `json:"event"`
+	Status      database.WebhookStatus `json:"status"`
+	Attempts    int                    `json:"attempts"`
+	NextAttempt *time.Time             `json:"next_attempt,omitempty"`
+	LastStatus  int                    `json:"last_status,omitempty"`
+	LastError   string                 `json:"last_error,omitempty"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+}
+
+// Dispatcher queues events for the subscribed endpoints and delivers them.
+// deliveries are at least once, receivers should ignore repeated ids.
+type Dispatcher struct {
+	db        Storage
+	config    Config
+	endpoints map[string]Endpoint
+	client    *http.Client
+	now       func() time.Time
+}
+
+// New creates a dispatcher, a nil config gives the defaults without any
+// endpoints.
+func New(config *Config, db Storage) *Dispatcher {
+	d := &Dispatcher{
+		db:        db,
+		config:    DefaultConfig(),
+		endpoints: make(map[string]Endpoint),
+		now:       time.Now,
+	}
+	if config != nil {
+		d.config = config.withDefaults()
+	}
+	for _, e := range d.config.Endpoints {
+		d.endpoints[e.Name] = e
+	}
+	d.client = &http.Client{Timeout: time.Duration(d.config.Timeout) * time.Second}
+	return d
+}
+
+// Publish queues an event for every endpoint subscribed to it. the event id
+// is chosen by the caller, publishing it again does not queue it twice.
+func (d *Dispatcher) Publish(ctx context.Context, eventId database.ObjectId, event string, data interface{}) error {
+	now := d.now()
+	payload, err := json.Marshal(Payload{Id: eventId, Type: event, CreatedAt: now.UTC().Truncate(time.Second), Data: data})
+	if err != nil {
+		return err
+	}
+	var deliveries []database.WebhookDelivery
+	for _, e := range d.config.Endpoints {
+		if !e.subscribed(event) {
+			continue
+		}
+		deliveries = append(deliveries, database.WebhookDelivery{
+			EventId:     eventId,
+			Endpoint:    e.Name,
+			Event:       event,
+			Payload:     payload,
+			Status:      database.WebhookPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return d.db.AddWebhookDeliveries(ctx, deliveries)
+}
+
+// Run delivers due events every interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(d.config.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if _, err := d.Deliver(ctx); err != nil && ctx.Err() == nil {
+			zap.L().Error("delivering webhooks failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deliver attempts one batch of due deliveries, it returns the number of
+// successful ones.
+func (d *Dispatcher) Deliver(ctx context.Context) (int, error) {
+	due, err := d.db.GetDueWebhookDeliveries(ctx, d.now(), d.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, delivery := range due {
+		if d.attempt(ctx, &delivery) {
+			delivered++
+		}
+		if err := d.db.UpdateWebhookDelivery(ctx, delivery); err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// attempt sends a delivery and records the outcome in it.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *database.WebhookDelivery) bool {
+	delivery.Attempts++
+	delivery.UpdatedAt = d.now()
+	status, err := d.send(ctx, delivery)
+	delivery.LastStatus = status
+	if err == nil {
+		delivery.Status = database.WebhookDelivered
+		delivery.LastError = ""
+		return true
+	}
+	delivery.LastError = err.Error()
+	if len(delivery.LastError) > maxErrorLength {
+		delivery.LastError = delivery.LastError[:maxErrorLength]
+	}
+	_, known := d.endpoints[delivery.Endpoint]
+	if !known || delivery.Attempts >= d.config.MaxAttempts {
+		delivery.Status = database.WebhookFailed
+		zap.L().Warn("webhook delivery failed",
+			zap.String("endpoint", delivery.Endpoint),
+			zap.String("event", delivery.Event),
+			zap.Int64("delivery", delivery.Id),
+			zap.String("error", delivery.LastError),
+			zap.Bool("endpoint_removed", !known),
+		)
+		return false
+	}
+	delivery.NextAttempt = d.now().Add(d.delay(delivery.Attempts))
+	return false
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery *database.WebhookDelivery) (int, error) {
+	endpoint, ok := d.endpoints[delivery.Endpoint]
+	if !ok {
+		return 0, fmt.Errorf("endpoint %s is not registered", delivery.Endpoint)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderId, string(delivery.EventId))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, delivery.Payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// delay is the back-off before the next attempt after the given number of
+// failed attempts.
+func (d *Dispatcher) delay(attempts int) time.Duration {
+	base := time.Duration(d.config.BaseDelay) * time.Second
+	maxDelay := time.Duration(d.config.MaxDelay) * time.Second
+	delay := base << min(attempts-1, maxDoublings)
+	return min(delay, maxDelay)
+}
+
+// Deliveries returns the delivery log, newest first.
+func (d *Dispatcher) Deliveries(ctx context.Context, f database.WebhookFilter) ([]Delivery, error) {
+	stored, err := d.db.GetWebhookDeliveries(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]Delivery, 0, len(stored))
+	for _, s := range stored {
+		delivery := Delivery{
+			Id:         s.Id,
+			EventId:    s.EventId,
+			Endpoint:   s.Endpoint,
+			Event:      s.Event,
+			Status:     s.Status,
+			Attempts:   s.Attempts,
+			LastStatus: s.LastStatus,
+			LastError:  s.LastError,
+			CreatedAt:  s.CreatedAt.UTC(),
+			UpdatedAt:  s.UpdatedAt.UTC(),
+		}
+		if s.Status == database.WebhookPending {
+			next := s.NextAttempt.UTC()
+			delivery.NextAttempt = &next
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// Sign returns the signature of a webhook request, receivers compare it to
+// the signature header in constant time.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (e Endpoint) subscribed(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range e.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
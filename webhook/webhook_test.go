@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"auth/database"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	. "github.com/onsi/gomega"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint that checks signatures and fails on demand.
+type receiver struct {
+	mu       sync.Mutex
+	secret   string
+	fail     bool
+	received []Payload
+	*httptest.Server
+}
+
+func newReceiver(t *testing.T, secret string) *receiver {
+	r := &receiver{secret: secret}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		body, _ := io.ReadAll(req.Body)
+		signature := Sign(r.secret, req.Header.Get(HeaderTimestamp), body)
+		if !hmac.Equal([]byte(signature), []byte(req.Header.Get(HeaderSignature))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		_ = json.Unmarshal(body, &p)
+		if req.Header.Get(HeaderEvent) != p.Type || req.Header.Get(HeaderId) != string(p.Id) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.received = append(r.received, p)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []string
+	for _, p := range r.received {
+		events = append(events, p.Type)
+	}
+	return events
+}
+
+func TestDeliver(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	db := database.NewMemory()
+	all := newReceiver(t, "secret1")
+	deleted := newReceiver(t, "secret2")
+	d := New(&Config{
+		Endpoints: []Endpoint{
+			{Name: "all", URL: all.URL, Secret: "secret1"},
+			{Name: "deleted", URL: deleted.URL, Secret: "secret2", Events: []string{EventUserDeleted}},
+			{Name: "wrong secret", URL: all.URL, Secret: "other", Events: []string{EventUserDeleted}},
+		},
+		BatchSize:   10,
+		Timeout:     1,
+		MaxAttempts: 3,
+		BaseDelay:   60,
+		MaxDelay:    90,
+	}, db)
+	d.now = func() time.Time { return now }
+
+	Expect(d.Publish(ctx, database.NewObjectId(), EventUserCreated, User{Id: "id1", Email: "user1@example.com"})).To(Succeed())
+	Expect(d.Publish(ctx, database.NewObjectId(), EventUserDeleted, User{Id: "id1", Email: "user1@example.com"})).To(Succeed())
+	delivered, err := d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(delivered).To(Equal(3))
+	Expect(all.events()).To(Equal([]string{EventUserCreated, EventUserDeleted}))
+	Expect(deleted.events()).To(Equal([]string{EventUserDeleted}))
+	Expect(all.received[1].Id).To(Equal(deleted.received[0].Id))
+	Expect(all.received[0].Data).To(HaveKeyWithValue("email", "user1@example.com"))
+
+	// publishing an event again does not deliver it twice
+	eventId := database.NewObjectId()
+	Expect(d.Publish(ctx, eventId, EventUserCreated, User{Id: "id2"})).To(Succeed())
+	Expect(d.Publish(ctx, eventId, EventUserCreated, User{Id: "id2"})).To(Succeed())
+	delivered, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(delivered).To(Equal(1))
+	Expect(all.events()).To(Equal([]string{EventUserCreated, EventUserDeleted, EventUserCreated}))
+
+	// failed deliveries back off exponentially, up to the max delay
+	failed, err := d.Deliveries(ctx, database.WebhookFilter{Endpoint: "wrong secret", Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(failed).To(HaveLen(1))
+	Expect(failed[0]).To(And(
+		HaveField("Status", database.WebhookPending),
+		HaveField("Attempts", 1),
+		HaveField("LastStatus", http.StatusUnauthorized),
+	))
+	Expect(*failed[0].NextAttempt).To(Equal(now.Add(time.Minute)))
+
+	delivered, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(delivered).To(BeZero())
+	now = now.Add(time.Minute)
+	_, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	failed, err = d.Deliveries(ctx, database.WebhookFilter{Endpoint: "wrong secret", Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(failed[0].Attempts).To(Equal(2))
+	Expect(*failed[0].NextAttempt).To(Equal(now.Add(90 * time.Second)))
+
+	now = now.Add(90 * time.Second)
+	_, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	failed, err = d.Deliveries(ctx, database.WebhookFilter{Status: database.WebhookFailed, Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(failed).To(HaveLen(1))
+	Expect(failed[0]).To(And(
+		HaveField("Endpoint", "wrong secret"),
+		HaveField("Attempts", 3),
+		HaveField("NextAttempt", BeNil()),
+	))
+
+	// deliveries are retried until the endpoint is back
+	all.fail = true
+	Expect(d.Publish(ctx, database.NewObjectId(), EventUserVerified, User{Id: "id1", Email: "user1@example.com"})).To(Succeed())
+	delivered, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(delivered).To(BeZero())
+	all.fail = false
+	now = now.Add(time.Minute)
+	delivered, err = d.Deliver(ctx)
+	Expect(err).To(BeNil())
+	Expect(delivered).To(Equal(1))
+	Expect(all.events()).To(Equal([]string{EventUserCreated, EventUserDeleted, EventUserCreated, EventUserVerified}))
+}
+
+func TestPublishWithoutEndpoints(t *testing.T) {
+	RegisterTestingT(t)
+	ctx := context.Background()
+	db := database.NewMemory()
+	d := New(nil, db)
+	Expect(d.Publish(ctx, database.NewObjectId(), EventUserCreated, User{Id: "id1"})).To(Succeed())
+	deliveries, err := d.Deliveries(ctx, database.WebhookFilter{Limit: 10})
+	Expect(err).To(BeNil())
+	Expect(deliveries).To(BeEmpty())
+}
+
+func TestConfigDefaults(t *testing.T) {
+	RegisterTestingT(t)
+	endpoints := []Endpoint{{Name: "test", URL: "http://localhost"}}
+	d := New(&Config{Endpoints: endpoints, MaxAttempts: 3}, database.NewMemory())
+	expected := DefaultConfig()
+	expected.Endpoints = endpoints
+	expected.MaxAttempts = 3
+	Expect(d.config).To(Equal(expected))
+
+	// a section without an interval must not make the ticker panic
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx)
+}